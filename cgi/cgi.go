@@ -0,0 +1,211 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The cgi package serves Twister applications as CGI/1.1 programs (RFC 3875).
+// The package also provides functions for protocol adapters that receive CGI
+// meta-variables from the web server.
+//
+// A CGI program serves a single request:
+//
+//  func main() {
+//      if err := cgi.Serve(handler); err != nil {
+//          log.Fatal("cgi.Serve", err)
+//      }
+//  }
+package cgi
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"http"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+var ErrHijackNotSupported = os.NewError("twister.cgi: hijack not supported")
+
+// Serve serves the request specified by the process environment and stdin.
+// The response is written to stdout.
+func Serve(handler web.Handler) os.Error {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.IndexRune(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return ServeRequest(env, os.Stdin, os.Stdout, handler)
+}
+
+// ServeRequest serves the request specified by the CGI meta-variables in env
+// and the request body. The response is written to w in the CGI response
+// format. The meta-variables are stored in the request Env with the key
+// "twister.cgi.env".
+func ServeRequest(env map[string]string, body io.Reader, w io.Writer, handler web.Handler) os.Error {
+	req, err := NewRequest(env)
+	if err != nil {
+		log.Println("twister.cgi: bad request", err)
+		res := NewResponder(w)
+		body := res.Respond(web.StatusBadRequest, web.NewHeader(web.HeaderContentType, "text/plain; charset=utf-8"))
+		io.WriteString(body, web.StatusText(web.StatusBadRequest))
+		return res.Finish()
+	}
+
+	if req.ContentLength >= 0 {
+		body = io.LimitReader(body, int64(req.ContentLength))
+	}
+	req.Body = body
+	res := NewResponder(w)
+	req.Responder = res
+	req.Env["twister.cgi.env"] = env
+
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("Panic while serving \"%s\": %v\n%s", req.URL, e, debug.Stack())
+			res.Finish()
+		}
+	}()
+	handler.ServeWeb(req)
+	return res.Finish()
+}
+
+// NewRequest creates a request from CGI/1.1 meta-variables. The request
+// header is set from the HTTP_* variables, CONTENT_TYPE and CONTENT_LENGTH.
+// The caller is responsible for setting the request Responder and Body.
+func NewRequest(env map[string]string) (*web.Request, os.Error) {
+	header := web.Header{}
+	for name, value := range env {
+		switch {
+		case strings.HasPrefix(name, "HTTP_"):
+			header.Add(web.HeaderName(strings.Replace(name[len("HTTP_"):], "_", "-", -1)), value)
+		case name == "CONTENT_TYPE" && value != "":
+			header.Set(web.HeaderContentType, value)
+		case name == "CONTENT_LENGTH" && value != "":
+			header.Set(web.HeaderContentLength, value)
+		}
+	}
+
+	url, err := http.ParseURL(requestURI(env))
+	if err != nil {
+		return nil, err
+	}
+
+	url.Host = env["HTTP_HOST"]
+	if url.Host == "" {
+		url.Host = env["SERVER_NAME"]
+		port := env["SERVER_PORT"]
+		if url.Host != "" && port != "" && port != "80" && port != "443" {
+			url.Host = url.Host + ":" + port
+		}
+	}
+
+	if https := strings.ToLower(env["HTTPS"]); https != "" && https != "off" {
+		url.Scheme = "https"
+	} else {
+		url.Scheme = "http"
+	}
+
+	version := web.ProtocolVersion(1, 0)
+	if proto := env["SERVER_PROTOCOL"]; strings.HasPrefix(proto, "HTTP/") {
+		if i := strings.IndexRune(proto, '.'); i > 0 {
+			major, err1 := strconv.Atoi(proto[len("HTTP/"):i])
+			minor, err2 := strconv.Atoi(proto[i+1:])
+			if err1 == nil && err2 == nil {
+				version = web.ProtocolVersion(major, minor)
+			}
+		}
+	}
+
+	remoteAddr := env["REMOTE_ADDR"]
+	if port := env["REMOTE_PORT"]; remoteAddr != "" && port != "" {
+		remoteAddr = net.JoinHostPort(remoteAddr, port)
+	}
+
+	method := env["REQUEST_METHOD"]
+	if method == "" {
+		method = "GET"
+	}
+
+	return web.NewRequest(remoteAddr, method, url, version, header)
+}
+
+// requestURI returns the request URI from the meta-variables. Some web
+// servers do not set REQUEST_URI. In that case, the URI is reconstructed
+// from SCRIPT_NAME, PATH_INFO and QUERY_STRING.
+func requestURI(env map[string]string) string {
+	if uri := env["REQUEST_URI"]; uri != "" {
+		return uri
+	}
+	uri := env["SCRIPT_NAME"] + env["PATH_INFO"]
+	if uri == "" {
+		uri = "/"
+	}
+	if q := env["QUERY_STRING"]; q != "" {
+		uri += "?" + q
+	}
+	return uri
+}
+
+// Responder implements web.Responder by writing a response in the CGI
+// response format. The status is written as a Status header followed by the
+// response headers. Hijack is not supported.
+type Responder struct {
+	w  io.Writer
+	bw *bufio.Writer
+}
+
+// NewResponder returns a responder that writes the response to w.
+func NewResponder(w io.Writer) *Responder {
+	return &Responder{w: w}
+}
+
+// Respond writes the status and header and returns a buffered writer for
+// the response body. The writer implements web.Flusher.
+func (r *Responder) Respond(status int, header web.Header) io.Writer {
+	if r.bw != nil {
+		log.Println("twister.cgi: multiple calls to Respond")
+		return ioutil.Discard
+	}
+	r.bw = bufio.NewWriter(r.w)
+	var b bytes.Buffer
+	b.WriteString("Status: ")
+	b.WriteString(strconv.Itoa(status))
+	b.WriteString(" ")
+	b.WriteString(web.StatusText(status))
+	b.WriteString("\r\n")
+	header.WriteHttpHeader(&b)
+	r.bw.Write(b.Bytes())
+	return r.bw
+}
+
+// Hijack returns ErrHijackNotSupported.
+func (r *Responder) Hijack() (net.Conn, *bufio.Reader, os.Error) {
+	return nil, nil, ErrHijackNotSupported
+}
+
+// Finish completes the response. If Respond was not called, then Finish
+// responds with status 500. Finish flushes buffered data to the underlying
+// writer.
+func (r *Responder) Finish() os.Error {
+	if r.bw == nil {
+		r.Respond(web.StatusInternalServerError, web.NewHeader())
+	}
+	return r.bw.Flush()
+}
@@ -0,0 +1,145 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package cgi
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+var newRequestTests = []struct {
+	params     map[string]string
+	url        string
+	remoteAddr string
+	version    int
+	header     web.Header
+}{
+	{
+		params: map[string]string{
+			"REQUEST_METHOD":  "GET",
+			"REQUEST_URI":     "/a/b?c=d",
+			"HTTP_HOST":       "example.com",
+			"HTTP_USER_AGENT": "test",
+			"REMOTE_ADDR":     "1.2.3.4",
+			"REMOTE_PORT":     "5678",
+			"SERVER_PROTOCOL": "HTTP/1.1",
+		},
+		url:        "http://example.com/a/b?c=d",
+		remoteAddr: "1.2.3.4:5678",
+		version:    web.ProtocolVersion(1, 1),
+		header:     web.NewHeader("Host", "example.com", "User-Agent", "test"),
+	},
+	{
+		params: map[string]string{
+			"REQUEST_METHOD":  "POST",
+			"SCRIPT_NAME":     "/app",
+			"PATH_INFO":       "/x",
+			"QUERY_STRING":    "y=z",
+			"SERVER_NAME":     "example.com",
+			"SERVER_PORT":     "8443",
+			"HTTPS":           "on",
+			"CONTENT_TYPE":    "text/plain",
+			"CONTENT_LENGTH":  "5",
+			"REMOTE_ADDR":     "1.2.3.4",
+			"SERVER_PROTOCOL": "HTTP/1.0",
+		},
+		url:        "https://example.com:8443/app/x?y=z",
+		remoteAddr: "1.2.3.4",
+		version:    web.ProtocolVersion(1, 0),
+		header:     web.NewHeader("Content-Type", "text/plain", "Content-Length", "5"),
+	},
+}
+
+func TestNewRequest(t *testing.T) {
+	for _, tt := range newRequestTests {
+		req, err := NewRequest(tt.params)
+		if err != nil {
+			t.Errorf("NewRequest(%v) returned error %v", tt.params, err)
+			continue
+		}
+		if s := req.URL.String(); s != tt.url {
+			t.Errorf("url = %q, want %q", s, tt.url)
+		}
+		if req.RemoteAddr != tt.remoteAddr {
+			t.Errorf("remoteAddr = %q, want %q", req.RemoteAddr, tt.remoteAddr)
+		}
+		if req.ProtocolVersion != tt.version {
+			t.Errorf("version = %d, want %d", req.ProtocolVersion, tt.version)
+		}
+		if req.Method != tt.params["REQUEST_METHOD"] {
+			t.Errorf("method = %q, want %q", req.Method, tt.params["REQUEST_METHOD"])
+		}
+		for k, v := range tt.header {
+			if req.Header.Get(k) != v[0] {
+				t.Errorf("header %s = %q, want %q", k, req.Header.Get(k), v[0])
+			}
+		}
+	}
+}
+
+func echoHandler(req *web.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain")
+	io.WriteString(w, req.Param.Get("a")+":")
+	w.Write(body)
+}
+
+func panicHandler(req *web.Request) {
+	panic("panic")
+}
+
+var serveRequestTests = []struct {
+	env     map[string]string
+	body    string
+	handler web.Handler
+	out     string
+}{
+	{
+		env: map[string]string{
+			"REQUEST_METHOD": "POST",
+			"REQUEST_URI":    "/?a=b",
+			"CONTENT_LENGTH": "5",
+		},
+		// The body is limited to the content length.
+		body:    "helloworld",
+		handler: web.HandlerFunc(echoHandler),
+		out:     "Status: 200 OK\r\nContent-Type: text/plain\r\n\r\nb:hello",
+	},
+	{
+		env:     map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/"},
+		handler: web.HandlerFunc(panicHandler),
+		out:     "Status: 500 Internal Server Error\r\n\r\n",
+	},
+	{
+		env:     map[string]string{"REQUEST_METHOD": "GET", "REQUEST_URI": "/", "CONTENT_LENGTH": "bad"},
+		handler: web.HandlerFunc(echoHandler),
+		out:     "Status: 400 Bad Request\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nBad Request",
+	},
+}
+
+func TestServeRequest(t *testing.T) {
+	for _, tt := range serveRequestTests {
+		var out bytes.Buffer
+		if err := ServeRequest(tt.env, bytes.NewBufferString(tt.body), &out, tt.handler); err != nil {
+			t.Errorf("ServeRequest(%v) returned error %v", tt.env, err)
+		}
+		if out.String() != tt.out {
+			t.Errorf("ServeRequest(%v)\ngot:  %q\nwant: %q", tt.env, out.String(), tt.out)
+		}
+	}
+}
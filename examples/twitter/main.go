@@ -35,9 +35,20 @@ var oauthClient = oauth.Client{
 	TokenRequestURI:               "http://api.twitter.com/oauth/access_token",
 }
 
+// cookieKeyring encrypts the credentials stored in cookies. The first secret
+// is read from settings.json.
+var cookieKeyring web.Keyring
+
 // credentialsCookie encodes OAuth credentials to a Set-Cookie header value.
+// The credentials are encrypted so that the token secret is not readable by
+// the client.
 func credentialsCookie(name string, c *oauth.Credentials, maxAgeDays int) string {
-	return web.NewCookie(name, http.URLEscape(c.Token)+"/"+http.URLEscape(c.Secret)).
+	maxAge := maxAgeDays * 60 * 60 * 24
+	if maxAge == 0 {
+		maxAge = 60 * 60
+	}
+	value := http.URLEscape(c.Token) + "/" + http.URLEscape(c.Secret)
+	return web.NewCookie(name, cookieKeyring.EncryptValue(name, maxAge, value)).
 		MaxAgeDays(maxAgeDays).
 		String()
 }
@@ -48,6 +59,10 @@ func credentials(req *web.Request, key string) (*oauth.Credentials, os.Error) {
 	if s == "" {
 		return nil, os.NewError("main: missing cookie")
 	}
+	s, err := cookieKeyring.DecryptValue(key, s)
+	if err != nil {
+		return nil, os.NewError("main: bad credential cookie")
+	}
 	a := strings.Split(s, "/", -1)
 	if len(a) != 2 {
 		return nil, os.NewError("main: bad credential cookie")
@@ -150,6 +165,7 @@ func readSettings() {
 	}
 	oauthClient.Credentials.Token = m["ClientToken"].(string)
 	oauthClient.Credentials.Secret = m["ClientSecret"].(string)
+	cookieKeyring = web.Keyring{m["CookieSecret"].(string)}
 }
 
 func main() {
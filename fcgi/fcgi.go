@@ -0,0 +1,550 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The fcgi package serves Twister applications using the FastCGI responder
+// role (http://www.fastcgi.com/devkit/doc/fcgi-spec.html).
+//
+// An application started by the web server as a FastCGI process serves the
+// listening socket passed as stdin:
+//
+//  func main() {
+//      if err := fcgi.Serve(nil, handler); err != nil {
+//          log.Fatal("fcgi.Serve", err)
+//      }
+//  }
+//
+// An application managed separately from the web server listens on a TCP or
+// Unix domain socket:
+//
+//  listener, err := net.Listen("tcp", "127.0.0.1:9000")
+//  if err != nil {
+//      log.Fatal("Listen", err)
+//  }
+//  err = fcgi.Serve(listener, handler)
+package fcgi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/garyburd/twister/cgi"
+	"github.com/garyburd/twister/web"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// Record types.
+const (
+	typeBeginRequest    = 1
+	typeAbortRequest    = 2
+	typeEndRequest      = 3
+	typeParams          = 4
+	typeStdin           = 5
+	typeStdout          = 6
+	typeStderr          = 7
+	typeData            = 8
+	typeGetValues       = 9
+	typeGetValuesResult = 10
+	typeUnknownType     = 11
+)
+
+// Roles in the begin request record.
+const (
+	roleResponder  = 1
+	roleAuthorizer = 2
+	roleFilter     = 3
+)
+
+// Protocol status in the end request record.
+const (
+	statusRequestComplete = 0
+	statusCantMultiplex   = 1
+	statusOverloaded      = 2
+	statusUnknownRole     = 3
+)
+
+// Flag in the begin request record.
+const flagKeepConn = 1
+
+const (
+	maxContentLen   = 65535
+	protocolVersion = 1
+)
+
+// MaxBufferedBodyLen is the maximum number of request body bytes buffered
+// for a request. Body data is buffered until read by the handler. When the
+// buffer is full, the connection stops reading records until the handler
+// reads from the body. Other requests multiplexed on the connection wait
+// while the connection is stopped. Body data received after the handler
+// returns is discarded.
+const MaxBufferedBodyLen = 1 << 20
+
+var ErrBadRecord = os.NewError("twister.fcgi: bad record")
+
+type recordHeader struct {
+	Version       uint8
+	Type          uint8
+	Id            uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// Serve accepts FastCGI connections on l and serves the requests with
+// handler. If l is nil, then Serve accepts connections on the listening
+// socket passed to the process as stdin by the web server.
+//
+// Requests multiplexed on a connection are served concurrently. The
+// parameters received from the web server are stored in the request Env with
+// the key "twister.cgi.env".
+func Serve(l net.Listener, handler web.Handler) os.Error {
+	if l == nil {
+		var err os.Error
+		l, err = net.FileListener(os.Stdin)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				log.Printf("twister.fcgi: accept error %v", e)
+				continue
+			}
+			return err
+		}
+		go newConn(c, handler).serve()
+	}
+	return nil
+}
+
+// conn represents a connection from the web server.
+type conn struct {
+	rwc     net.Conn
+	br      *bufio.Reader
+	handler web.Handler
+
+	// Protects writes to the connection.
+	wmu sync.Mutex
+
+	// Protects requests and closeWhenIdle.
+	mu            sync.Mutex
+	requests      map[uint16]*request
+	closeWhenIdle bool
+}
+
+func newConn(rwc net.Conn, handler web.Handler) *conn {
+	return &conn{
+		rwc:      rwc,
+		br:       bufio.NewReader(rwc),
+		handler:  handler,
+		requests: make(map[uint16]*request),
+	}
+}
+
+// writeRecord writes a record with the given type, id and content. The
+// content must not be longer than maxContentLen.
+func (c *conn) writeRecord(recType uint8, id uint16, content []byte) os.Error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	padding := -len(content) & 7
+	h := recordHeader{
+		Version:       protocolVersion,
+		Type:          recType,
+		Id:            id,
+		ContentLength: uint16(len(content)),
+		PaddingLength: uint8(padding),
+	}
+	if err := binary.Write(c.rwc, binary.BigEndian, &h); err != nil {
+		return err
+	}
+	if _, err := c.rwc.Write(content); err != nil {
+		return err
+	}
+	if padding > 0 {
+		var pad [8]byte
+		if _, err := c.rwc.Write(pad[:padding]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) writeEndRequest(id uint16, appStatus int, protocolStatus uint8) os.Error {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(appStatus))
+	b[4] = protocolStatus
+	return c.writeRecord(typeEndRequest, id, b[:])
+}
+
+func (c *conn) readRecord() (h recordHeader, content []byte, err os.Error) {
+	if err = binary.Read(c.br, binary.BigEndian, &h); err != nil {
+		return
+	}
+	if h.Version != protocolVersion {
+		err = ErrBadRecord
+		return
+	}
+	p := make([]byte, int(h.ContentLength)+int(h.PaddingLength))
+	if _, err = io.ReadFull(c.br, p); err != nil {
+		return
+	}
+	content = p[:h.ContentLength]
+	return
+}
+
+func (c *conn) serve() {
+	defer c.close()
+	for {
+		h, content, err := c.readRecord()
+		if err != nil {
+			c.mu.Lock()
+			closing := c.closeWhenIdle
+			c.mu.Unlock()
+			if err != os.EOF && !closing {
+				log.Println("twister.fcgi: read", err)
+			}
+			return
+		}
+		if !c.handleRecord(&h, content) {
+			return
+		}
+	}
+}
+
+// handleRecord handles a record from the web server. It returns false if
+// the connection should be closed.
+func (c *conn) handleRecord(h *recordHeader, content []byte) bool {
+	if h.Id == 0 {
+		return c.handleManagementRecord(h, content)
+	}
+
+	c.mu.Lock()
+	r := c.requests[h.Id]
+	c.mu.Unlock()
+
+	switch h.Type {
+	case typeBeginRequest:
+		if r != nil {
+			// The web server is not allowed to reuse an active id.
+			return false
+		}
+		if len(content) < 8 {
+			return false
+		}
+		role := binary.BigEndian.Uint16(content)
+		if role != roleResponder {
+			c.writeEndRequest(h.Id, 0, statusUnknownRole)
+			return true
+		}
+		r = newRequest(c, h.Id, content[2]&flagKeepConn != 0)
+		c.mu.Lock()
+		c.requests[h.Id] = r
+		c.mu.Unlock()
+	case typeParams:
+		if r == nil {
+			return true
+		}
+		if len(content) > 0 {
+			r.rawParams = append(r.rawParams, content...)
+			return true
+		}
+		if err := r.parseParams(); err != nil {
+			log.Println("twister.fcgi: params", err)
+			c.endRequest(r)
+			return true
+		}
+		r.started = true
+		go r.serve()
+	case typeStdin:
+		if r != nil {
+			if len(content) == 0 {
+				r.body.close(os.EOF)
+			} else {
+				r.body.write(content)
+			}
+		}
+	case typeAbortRequest:
+		if r != nil {
+			r.abort()
+			if !r.started {
+				// The handler is not running. End the request here.
+				c.endRequest(r)
+			}
+		}
+	case typeData:
+		// Only used by the filter role.
+	default:
+		var b [8]byte
+		b[0] = h.Type
+		c.writeRecord(typeUnknownType, 0, b[:])
+	}
+	return true
+}
+
+func (c *conn) handleManagementRecord(h *recordHeader, content []byte) bool {
+	switch h.Type {
+	case typeGetValues:
+		names, err := readPairs(content)
+		if err != nil {
+			return false
+		}
+		values := map[string]string{
+			"FCGI_MPXS_CONNS": "1",
+		}
+		var p []byte
+		for name := range names {
+			if value, ok := values[name]; ok {
+				p = appendPair(p, name, value)
+			}
+		}
+		c.writeRecord(typeGetValuesResult, 0, p)
+	default:
+		var b [8]byte
+		b[0] = h.Type
+		c.writeRecord(typeUnknownType, 0, b[:])
+	}
+	return true
+}
+
+// endRequest removes the request from the connection and writes the end
+// request record.
+func (c *conn) endRequest(r *request) {
+	r.body.discard()
+	c.mu.Lock()
+	c.requests[r.id] = nil, false
+	if !r.keepConn {
+		c.closeWhenIdle = true
+	}
+	closeConn := c.closeWhenIdle && len(c.requests) == 0
+	c.mu.Unlock()
+
+	c.writeRecord(typeStdout, r.id, nil)
+	c.writeEndRequest(r.id, 0, statusRequestComplete)
+	if closeConn {
+		c.rwc.Close()
+	}
+}
+
+func (c *conn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.requests {
+		r.body.close(io.ErrUnexpectedEOF)
+	}
+	c.rwc.Close()
+}
+
+// request represents a request multiplexed on a connection.
+type request struct {
+	c         *conn
+	id        uint16
+	keepConn  bool
+	rawParams []byte
+	params    map[string]string
+	body      *bodyReader
+
+	// Set by the connection's read loop when the handler is started.
+	started bool
+
+	// Protects aborted.
+	mu      sync.Mutex
+	aborted bool
+}
+
+func newRequest(c *conn, id uint16, keepConn bool) *request {
+	return &request{c: c, id: id, keepConn: keepConn, body: newBodyReader()}
+}
+
+func (r *request) parseParams() (err os.Error) {
+	r.params, err = readPairs(r.rawParams)
+	r.rawParams = nil
+	return err
+}
+
+func (r *request) abort() {
+	r.mu.Lock()
+	r.aborted = true
+	r.mu.Unlock()
+	r.body.close(errAborted)
+}
+
+func (r *request) isAborted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.aborted
+}
+
+func (r *request) serve() {
+	defer r.c.endRequest(r)
+
+	w := &streamWriter{r: r, recType: typeStdout}
+	if err := cgi.ServeRequest(r.params, r.body, w, r.c.handler); err != nil && err != errAborted {
+		log.Println("twister.fcgi: write response", err)
+	}
+}
+
+var (
+	errAborted       = os.NewError("twister.fcgi: request aborted by web server")
+	errBodyDiscarded = os.NewError("twister.fcgi: request body read after handler returned")
+)
+
+// readPairs decodes FastCGI name-value pairs.
+func readPairs(p []byte) (map[string]string, os.Error) {
+	m := make(map[string]string)
+	for len(p) > 0 {
+		var nameLen, valueLen int
+		var ok bool
+		if nameLen, p, ok = readPairLen(p); !ok {
+			return nil, ErrBadRecord
+		}
+		if valueLen, p, ok = readPairLen(p); !ok {
+			return nil, ErrBadRecord
+		}
+		if nameLen+valueLen > len(p) {
+			return nil, ErrBadRecord
+		}
+		m[string(p[:nameLen])] = string(p[nameLen : nameLen+valueLen])
+		p = p[nameLen+valueLen:]
+	}
+	return m, nil
+}
+
+// readPairLen decodes a one or four byte name-value pair length.
+func readPairLen(p []byte) (int, []byte, bool) {
+	if len(p) < 1 {
+		return 0, p, false
+	}
+	if p[0]&0x80 == 0 {
+		return int(p[0]), p[1:], true
+	}
+	if len(p) < 4 {
+		return 0, p, false
+	}
+	return int(binary.BigEndian.Uint32(p) & 0x7fffffff), p[4:], true
+}
+
+// appendPair appends an encoded name-value pair to p.
+func appendPair(p []byte, name, value string) []byte {
+	p = appendPairLen(p, len(name))
+	p = appendPairLen(p, len(value))
+	p = append(p, name...)
+	return append(p, value...)
+}
+
+func appendPairLen(p []byte, n int) []byte {
+	if n < 0x80 {
+		return append(p, byte(n))
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n)|0x80000000)
+	return append(p, b[:]...)
+}
+
+// streamWriter writes data to the STDOUT or STDERR stream of a request.
+type streamWriter struct {
+	r       *request
+	recType uint8
+}
+
+func (w *streamWriter) Write(p []byte) (int, os.Error) {
+	if w.r.isAborted() {
+		return 0, errAborted
+	}
+	n := 0
+	for len(p) > 0 {
+		m := len(p)
+		if m > maxContentLen {
+			m = maxContentLen
+		}
+		if err := w.r.c.writeRecord(w.recType, w.r.id, p[:m]); err != nil {
+			return n, err
+		}
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// bodyReader is the request body. The connection's read loop appends data
+// to the body as STDIN records arrive. Data is buffered so that a handler
+// that does not read the body does not block other requests multiplexed on
+// the connection.
+type bodyReader struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	err  os.Error
+}
+
+func newBodyReader() *bodyReader {
+	b := &bodyReader{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// write appends p to the buffer. If the buffer is full, then write waits for
+// the handler to read from the body or for the body to be closed.
+func (b *bodyReader) write(p []byte) {
+	b.mu.Lock()
+	for b.err == nil && len(b.buf) > 0 && len(b.buf)+len(p) > MaxBufferedBodyLen {
+		b.cond.Wait()
+	}
+	if b.err == nil {
+		b.buf = append(b.buf, p...)
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *bodyReader) close(err os.Error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// discard closes the body and drops the buffered data. The connection calls
+// discard when the handler returns so that a full buffer does not stop the
+// connection.
+func (b *bodyReader) discard() {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = errBodyDiscarded
+	}
+	b.buf = nil
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *bodyReader) Read(p []byte) (int, os.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.buf) == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if len(b.buf) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	b.cond.Broadcast()
+	return n, nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package fcgi
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPairs(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	p := appendPair(nil, "SHORT", "value")
+	p = appendPair(p, "LONG", long)
+	m, err := readPairs(p)
+	if err != nil {
+		t.Fatal("readPairs", err)
+	}
+	if m["SHORT"] != "value" || m["LONG"] != long || len(m) != 2 {
+		t.Errorf("readPairs returned %v", m)
+	}
+	if _, err := readPairs(p[:len(p)-1]); err == nil {
+		t.Error("readPairs of truncated data did not return error")
+	}
+}
+
+func echoHandler(req *web.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain")
+	io.WriteString(w, req.Param.Get("a")+":")
+	w.(web.Flusher).Flush()
+	w.Write(body)
+}
+
+func TestServeRequest(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	go newConn(serverConn, web.HandlerFunc(echoHandler)).serve()
+
+	// Use a conn for the client to write and read records.
+	client := newConn(clientConn, nil)
+	go func() {
+		begin := []byte{0, roleResponder, 0, 0, 0, 0, 0, 0}
+		client.writeRecord(typeBeginRequest, 1, begin)
+		client.writeRecord(typeParams, 1, appendPair(appendPair(nil,
+			"REQUEST_METHOD", "POST"), "REQUEST_URI", "/?a=b"))
+		client.writeRecord(typeParams, 1, nil)
+		client.writeRecord(typeStdin, 1, []byte("hel"))
+		client.writeRecord(typeStdin, 1, []byte("lo"))
+		client.writeRecord(typeStdin, 1, nil)
+	}()
+
+	var stdout bytes.Buffer
+	stdoutRecords := 0
+	for {
+		h, content, err := client.readRecord()
+		if err != nil {
+			t.Fatal("readRecord", err)
+		}
+		if h.Id != 1 {
+			t.Fatalf("id = %d, want 1", h.Id)
+		}
+		if h.Type == typeEndRequest {
+			if content[4] != statusRequestComplete {
+				t.Errorf("protocol status = %d", content[4])
+			}
+			break
+		}
+		if h.Type != typeStdout {
+			t.Fatalf("type = %d, want %d", h.Type, typeStdout)
+		}
+		stdout.Write(content)
+		stdoutRecords += 1
+	}
+	clientConn.Close()
+
+	expected := "Status: 200 OK\r\nContent-Type: text/plain\r\n\r\nb:hello"
+	if stdout.String() != expected {
+		t.Errorf("stdout = %q, want %q", stdout.String(), expected)
+	}
+	// Two records for the flushed data and one empty record to end the stream.
+	if stdoutRecords != 3 {
+		t.Errorf("stdout records = %d, want 3", stdoutRecords)
+	}
+}
+
+// readResponses reads records until an end request record is received for
+// each of the ids. It returns the stdout for each id.
+func readResponses(t *testing.T, client *conn, ids ...uint16) map[uint16]string {
+	stdout := make(map[uint16]*bytes.Buffer)
+	for _, id := range ids {
+		stdout[id] = new(bytes.Buffer)
+	}
+	for pending := len(ids); pending > 0; {
+		h, content, err := client.readRecord()
+		if err != nil {
+			t.Fatal("readRecord", err)
+		}
+		buf := stdout[h.Id]
+		if buf == nil {
+			t.Fatalf("unexpected id %d", h.Id)
+		}
+		switch h.Type {
+		case typeStdout:
+			buf.Write(content)
+		case typeEndRequest:
+			if content[4] != statusRequestComplete {
+				t.Errorf("id %d, protocol status = %d", h.Id, content[4])
+			}
+			pending -= 1
+		default:
+			t.Fatalf("id %d, type = %d", h.Id, h.Type)
+		}
+	}
+	result := make(map[uint16]string)
+	for id, buf := range stdout {
+		result[id] = buf.String()
+	}
+	return result
+}
+
+func beginRequest(client *conn, id uint16, query string) {
+	begin := []byte{0, roleResponder, flagKeepConn, 0, 0, 0, 0, 0}
+	client.writeRecord(typeBeginRequest, id, begin)
+	client.writeRecord(typeParams, id, appendPair(appendPair(nil,
+		"REQUEST_METHOD", "POST"), "REQUEST_URI", "/?"+query))
+}
+
+func TestServeMultiplexed(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	go newConn(serverConn, web.HandlerFunc(echoHandler)).serve()
+	defer clientConn.Close()
+	client := newConn(clientConn, nil)
+
+	go func() {
+		// Interleave the records of two requests.
+		beginRequest(client, 1, "a=one")
+		beginRequest(client, 2, "a=two")
+		client.writeRecord(typeParams, 2, nil)
+		client.writeRecord(typeParams, 1, nil)
+		client.writeRecord(typeStdin, 1, []byte("hel"))
+		client.writeRecord(typeStdin, 2, []byte("wor"))
+		client.writeRecord(typeStdin, 1, []byte("lo"))
+		client.writeRecord(typeStdin, 2, []byte("ld"))
+		client.writeRecord(typeStdin, 2, nil)
+		client.writeRecord(typeStdin, 1, nil)
+	}()
+
+	got := readResponses(t, client, 1, 2)
+	for id, want := range map[uint16]string{1: "one:hello", 2: "two:world"} {
+		if want = "Status: 200 OK\r\nContent-Type: text/plain\r\n\r\n" + want; got[id] != want {
+			t.Errorf("id %d, stdout = %q, want %q", id, got[id], want)
+		}
+	}
+}
+
+func TestServeAbortAndBadParams(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	c := newConn(serverConn, web.HandlerFunc(echoHandler))
+	go c.serve()
+	defer clientConn.Close()
+	client := newConn(clientConn, nil)
+
+	go func() {
+		// Abort before the params are complete.
+		beginRequest(client, 1, "a=b")
+		client.writeRecord(typeAbortRequest, 1, nil)
+		// Malformed params.
+		client.writeRecord(typeBeginRequest, 2, []byte{0, roleResponder, flagKeepConn, 0, 0, 0, 0, 0})
+		client.writeRecord(typeParams, 2, []byte{0x85})
+		client.writeRecord(typeParams, 2, nil)
+		// The connection is still usable.
+		beginRequest(client, 3, "a=c")
+		client.writeRecord(typeParams, 3, nil)
+		client.writeRecord(typeStdin, 3, nil)
+	}()
+
+	got := readResponses(t, client, 1, 2, 3)
+	if got[1] != "" || got[2] != "" {
+		t.Errorf("stdout for aborted and bad requests = %q, %q; want empty", got[1], got[2])
+	}
+	if want := "Status: 200 OK\r\nContent-Type: text/plain\r\n\r\nc:"; got[3] != want {
+		t.Errorf("stdout = %q, want %q", got[3], want)
+	}
+	c.mu.Lock()
+	n := len(c.requests)
+	c.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d requests remain on connection, want 0", n)
+	}
+}
+
+func TestBodyReaderFlowControl(t *testing.T) {
+	b := newBodyReader()
+	b.write(make([]byte, MaxBufferedBodyLen))
+
+	// The buffer is full. The next write waits for the reader.
+	done := make(chan bool)
+	go func() {
+		b.write([]byte("xyz"))
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("write to full buffer did not wait")
+	case <-time.After(1e8):
+	}
+	p := make([]byte, 4096)
+	if n, err := b.Read(p); n != len(p) || err != nil {
+		t.Fatalf("Read returned %d, %v", n, err)
+	}
+	<-done
+	b.close(os.EOF)
+	n, err := io.Copy(ioutil.Discard, b)
+	if n != MaxBufferedBodyLen-int64(len(p))+3 || err != nil {
+		t.Errorf("Copy returned %d, %v; want all data", n, err)
+	}
+
+	// Discard releases a waiting writer.
+	b = newBodyReader()
+	b.write(make([]byte, MaxBufferedBodyLen))
+	go func() {
+		b.write([]byte("xyz"))
+		done <- true
+	}()
+	b.discard()
+	<-done
+	if _, err := b.Read(p); err != errBodyDiscarded {
+		t.Errorf("Read after discard returned %v, want errBodyDiscarded", err)
+	}
+}
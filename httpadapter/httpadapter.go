@@ -0,0 +1,270 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The httpadapter package adapts Twister handlers to the standard library
+// http package and standard library handlers to Twister.
+//
+// Use HTTPHandler to serve a Twister application with the standard library
+// server:
+//
+//  http.Handle("/", httpadapter.HTTPHandler(router))
+//  http.ListenAndServe(":8080", nil)
+//
+// Use WebHandler to mount a standard library handler in a Twister
+// application:
+//
+//  router.Register("/debug/<:.*>", "*", httpadapter.WebHandler(http.DefaultServeMux))
+package httpadapter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/garyburd/twister/web"
+	"http"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+var ErrHijackNotSupported = os.NewError("twister.httpadapter: hijack not supported by response writer")
+
+// HTTPHandler returns an http.Handler that serves requests with the Twister
+// handler h. The http.Request and http.ResponseWriter are stored in the
+// request Env with the keys "twister.httpadapter.request" and
+// "twister.httpadapter.responseWriter".
+//
+// The response body returned from the request Respond method implements the
+// web.Flusher interface. Flush calls through to the response writer if the
+// response writer implements http.Flusher. Hijack calls through to the
+// response writer if the response writer implements http.Hijacker.
+func HTTPHandler(h web.Handler) http.Handler {
+	return httpHandler{h}
+}
+
+type httpHandler struct {
+	h web.Handler
+}
+
+func (h httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := NewWebRequest(w, r)
+	if err != nil {
+		http.Error(w, web.StatusText(web.StatusBadRequest), web.StatusBadRequest)
+		return
+	}
+	h.h.ServeWeb(req)
+}
+
+// NewWebRequest creates a Twister request from a standard library request.
+// The Responder of the returned request writes the response to w.
+func NewWebRequest(w http.ResponseWriter, r *http.Request) (*web.Request, os.Error) {
+	url := *r.URL
+	if r.TLS != nil {
+		url.Scheme = "https"
+	} else {
+		url.Scheme = "http"
+	}
+	if url.Host == "" {
+		url.Host = r.Host
+	}
+
+	header := make(web.Header, len(r.Header))
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	if r.Host != "" && header.Get(web.HeaderHost) == "" {
+		header.Set(web.HeaderHost, r.Host)
+	}
+
+	req, err := web.NewRequest(r.RemoteAddr, r.Method, &url,
+		web.ProtocolVersion(r.ProtoMajor, r.ProtoMinor), header)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = r.Body
+	req.ContentLength = int(r.ContentLength)
+	req.TLS = r.TLS
+	req.Responder = &responder{w: w}
+	req.Env["twister.httpadapter.request"] = r
+	req.Env["twister.httpadapter.responseWriter"] = w
+	return req, nil
+}
+
+// responder implements web.Responder using an http.ResponseWriter.
+type responder struct {
+	w http.ResponseWriter
+}
+
+func (r *responder) Respond(status int, header web.Header) io.Writer {
+	h := r.w.Header()
+	for k, v := range header {
+		h[k] = v
+	}
+	r.w.WriteHeader(status)
+	return responseBody{r.w}
+}
+
+func (r *responder) Hijack() (net.Conn, *bufio.Reader, os.Error) {
+	hj, ok := r.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, ErrHijackNotSupported
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, rw.Reader, nil
+}
+
+// responseBody adds the web.Flusher interface to an http.ResponseWriter.
+type responseBody struct {
+	w http.ResponseWriter
+}
+
+func (b responseBody) Write(p []byte) (int, os.Error) {
+	return b.w.Write(p)
+}
+
+func (b responseBody) Flush() os.Error {
+	if f, ok := b.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// WebHandler returns a Twister handler that serves requests with the
+// standard library handler h.
+//
+// The response writer passed to h implements the http.Flusher and
+// http.Hijacker interfaces. If the request form was parsed by Twister
+// middleware, then the http.Request Form field is set from the request
+// parameters.
+func WebHandler(h http.Handler) web.Handler {
+	return webHandler{h}
+}
+
+type webHandler struct {
+	h http.Handler
+}
+
+func (h webHandler) ServeWeb(req *web.Request) {
+	r := NewHTTPRequest(req)
+	w := &responseWriter{req: req, header: make(http.Header)}
+	h.h.ServeHTTP(w, r)
+	if !w.wroteHeader && !w.hijacked {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// NewHTTPRequest creates a standard library request from a Twister request.
+func NewHTTPRequest(req *web.Request) *http.Request {
+	major := req.ProtocolVersion / 1000
+	minor := req.ProtocolVersion % 1000
+
+	header := make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		header[k] = v
+	}
+
+	var body io.ReadCloser
+	if req.Body == nil {
+		body = ioutil.NopCloser(bytes.NewBuffer(nil))
+	} else if rc, ok := req.Body.(io.ReadCloser); ok {
+		body = rc
+	} else {
+		body = ioutil.NopCloser(req.Body)
+	}
+
+	r := &http.Request{
+		Method:        req.Method,
+		URL:           req.URL,
+		Proto:         fmt.Sprintf("HTTP/%d.%d", major, minor),
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        header,
+		Body:          body,
+		ContentLength: int64(req.ContentLength),
+		Host:          req.URL.Host,
+		RemoteAddr:    req.RemoteAddr,
+		TLS:           req.TLS,
+	}
+
+	if req.Env["twister.web.formparsed"] != nil {
+		r.Form = make(http.Values, len(req.Param))
+		for k, v := range req.Param {
+			r.Form[k] = v
+		}
+	}
+	return r
+}
+
+// responseWriter implements http.ResponseWriter using a web.Responder.
+type responseWriter struct {
+	req         *web.Request
+	header      http.Header
+	wroteHeader bool
+	hijacked    bool
+	body        io.Writer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+	w.wroteHeader = true
+	header := make(web.Header, len(w.header))
+	for k, v := range w.header {
+		header[k] = v
+	}
+	w.body = w.req.Responder.Respond(status, header)
+}
+
+func (w *responseWriter) Write(p []byte) (int, os.Error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(p)
+}
+
+func (w *responseWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.body.(web.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, os.Error) {
+	if w.wroteHeader {
+		return nil, nil, os.NewError("twister.httpadapter: Hijack called after WriteHeader")
+	}
+	conn, br, err := w.req.Responder.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return conn, bufio.NewReadWriter(br, bufio.NewWriter(conn)), nil
+}
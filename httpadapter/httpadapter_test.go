@@ -0,0 +1,168 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package httpadapter
+
+import (
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// webEcho responds with the request cookie, header and body.
+func webEcho(req *web.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		req.Error(web.StatusInternalServerError, err)
+		return
+	}
+	w := req.Respond(web.StatusOK,
+		web.HeaderContentType, "text/plain",
+		"X-Echo", req.Header.Get("X-Test"),
+		web.HeaderSetCookie, "out=2")
+	io.WriteString(w, req.Cookie.Get("in")+":")
+	if f, ok := w.(web.Flusher); ok {
+		f.Flush()
+	}
+	w.Write(body)
+}
+
+// httpEcho responds with the request cookie, header and body.
+func httpEcho(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.String(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Echo", r.Header.Get("X-Test"))
+	http.SetCookie(w, &http.Cookie{Name: "out", Value: "2"})
+	in := ""
+	if c, err := r.Cookie("in"); err == nil {
+		in = c.Value
+	}
+	io.WriteString(w, in+":")
+	w.(http.Flusher).Flush()
+	w.Write(body)
+}
+
+func newTestRequest(t *testing.T) *http.Request {
+	r, err := http.NewRequest("POST", "http://example.com/echo", bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal("NewRequest", err)
+	}
+	r.Header.Set("Cookie", "in=1")
+	r.Header.Set("X-Test", "test")
+	r.ContentLength = 5
+	return r
+}
+
+func checkRecorder(t *testing.T, name string, w *httptest.ResponseRecorder) {
+	if w.Code != http.StatusOK {
+		t.Errorf("%s: status = %d, want %d", name, w.Code, http.StatusOK)
+	}
+	if s := w.HeaderMap.Get("X-Echo"); s != "test" {
+		t.Errorf("%s: X-Echo = %q, want %q", name, s, "test")
+	}
+	if s := w.HeaderMap.Get("Set-Cookie"); s != "out=2" {
+		t.Errorf("%s: Set-Cookie = %q, want %q", name, s, "out=2")
+	}
+	if s := w.Body.String(); s != "1:hello" {
+		t.Errorf("%s: body = %q, want %q", name, s, "1:hello")
+	}
+	if !w.Flushed {
+		t.Errorf("%s: response not flushed", name)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	HTTPHandler(web.HandlerFunc(webEcho)).ServeHTTP(w, newTestRequest(t))
+	checkRecorder(t, "HTTPHandler", w)
+}
+
+func TestWebHandler(t *testing.T) {
+	status, header, body := web.RunHandler("http://example.com/echo", "POST",
+		web.NewHeader("Cookie", "in=1", "X-Test", "test", web.HeaderContentLength, "5"),
+		[]byte("hello"), WebHandler(http.HandlerFunc(httpEcho)))
+	if status != web.StatusOK {
+		t.Errorf("status = %d, want %d", status, web.StatusOK)
+	}
+	if s := header.Get("X-Echo"); s != "test" {
+		t.Errorf("X-Echo = %q, want %q", s, "test")
+	}
+	if s := header.Get(web.HeaderSetCookie); s != "out=2" {
+		t.Errorf("Set-Cookie = %q, want %q", s, "out=2")
+	}
+	if s := string(body); s != "1:hello" {
+		t.Errorf("body = %q, want %q", s, "1:hello")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	w := httptest.NewRecorder()
+	HTTPHandler(WebHandler(http.HandlerFunc(httpEcho))).ServeHTTP(w, newTestRequest(t))
+	checkRecorder(t, "http->web->http", w)
+
+	status, header, body := web.RunHandler("http://example.com/echo", "POST",
+		web.NewHeader("Cookie", "in=1", "X-Test", "test", web.HeaderContentLength, "5"),
+		[]byte("hello"), WebHandler(HTTPHandler(web.HandlerFunc(webEcho))))
+	if status != web.StatusOK || header.Get("X-Echo") != "test" ||
+		header.Get(web.HeaderSetCookie) != "out=2" || string(body) != "1:hello" {
+		t.Errorf("web->http->web = %d %v %q", status, header, body)
+	}
+}
+
+func TestWebHandlerForm(t *testing.T) {
+	var form http.Values
+	h := web.FormHandler(1000, false, WebHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.Form
+	})))
+	web.RunHandler("http://example.com/", "POST",
+		web.NewHeader(web.HeaderContentType, "application/x-www-form-urlencoded"),
+		[]byte("a=1"), h)
+	if form.Get("a") != "1" {
+		t.Errorf("form = %v, want a=1", form)
+	}
+}
+
+func TestWebHandlerHijack(t *testing.T) {
+	var writeErr os.Error
+	status, _, body := web.RunHandler("http://example.com/ws", "GET", nil, nil,
+		WebHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatal("Hijack", err)
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+			rw.Flush()
+			_, writeErr = w.Write([]byte("x"))
+		})))
+	if status != 0 {
+		t.Errorf("status = %d, want no response after hijack", status)
+	}
+	if s := string(body); s != "HTTP/1.1 101 Switching Protocols\r\n\r\n" {
+		t.Errorf("body = %q", s)
+	}
+	if writeErr != http.ErrHijacked {
+		t.Errorf("Write after Hijack returned %v, want ErrHijacked", writeErr)
+	}
+}
@@ -0,0 +1,413 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxy
+
+import (
+	"github.com/garyburd/twister/expvar"
+	"github.com/garyburd/twister/web"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrNoBackend = os.NewError("twister.proxy: no backend available")
+
+// Strategy specifies how a pool chooses a backend for a request.
+type Strategy int
+
+const (
+	// Choose the backends in turn.
+	RoundRobin Strategy = iota
+
+	// Choose the backend with the fewest requests in progress.
+	LeastConnections
+
+	// Choose the backend by consistent hashing of the key returned from the
+	// pool's HashKey function. Requests with the same key are sent to the
+	// same backend while the set of available backends does not change.
+	ConsistentHash
+)
+
+const (
+	// DefaultMaxFails is the default value of Pool.MaxFails.
+	DefaultMaxFails = 3
+
+	// DefaultEjectTime is the default value of Pool.EjectTime.
+	DefaultEjectTime = 30e9
+)
+
+// Number of points on the hash ring for each backend.
+const ringPointsPerBackend = 100
+
+// Backend is an upstream server in a pool.
+type Backend struct {
+	// Address of the server in host:port format.
+	Addr string
+
+	mu           sync.Mutex
+	unhealthy    bool
+	ejectedUntil int64
+	fails        int
+	active       int
+	requests     int64
+	failures     int64
+	ejections    int64
+}
+
+func (b *Backend) available(now int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.unhealthy && now >= b.ejectedUntil
+}
+
+func (b *Backend) activeCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
+func (b *Backend) begin() {
+	b.mu.Lock()
+	b.active += 1
+	b.requests += 1
+	b.mu.Unlock()
+}
+
+func (b *Backend) end() {
+	b.mu.Lock()
+	b.active -= 1
+	b.mu.Unlock()
+}
+
+// recordResult updates the count of consecutive failures. The backend is
+// ejected for ejectTime nanoseconds when the count reaches maxFails.
+func (b *Backend) recordResult(ok bool, maxFails int, ejectTime int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.fails = 0
+		return
+	}
+	b.failures += 1
+	b.fails += 1
+	if b.fails >= maxFails {
+		b.fails = 0
+		b.ejections += 1
+		b.ejectedUntil = time.Nanoseconds() + ejectTime
+	}
+}
+
+func (b *Backend) setHealthy(healthy bool) {
+	b.mu.Lock()
+	b.unhealthy = !healthy
+	b.mu.Unlock()
+}
+
+// BackendStatus is a snapshot of the state of a backend.
+type BackendStatus struct {
+	Addr      string
+	Healthy   bool
+	Ejected   bool
+	Active    int
+	Requests  int64
+	Failures  int64
+	Ejections int64
+}
+
+type ringEntry struct {
+	hash    uint32
+	backend *Backend
+}
+
+type byHash []ringEntry
+
+func (p byHash) Len() int           { return len(p) }
+func (p byHash) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byHash) Less(i, j int) bool { return p[i].hash < p[j].hash }
+
+// Pool is a set of backends for a ReverseProxy.
+//
+// A backend is ejected from the pool after MaxFails consecutive failures to
+// connect or to receive a response header. The backend is returned to the
+// pool after EjectTime. Active health checks are started by calling the
+// CheckHealth method.
+//
+// Idempotent requests without a body are retried on another backend up to
+// MaxRetries times if the request fails before the response header is
+// received.
+//
+//  pool := proxy.NewPool([]string{"10.0.0.1:8080", "10.0.0.2:8080"})
+//  pool.Strategy = proxy.LeastConnections
+//  pool.MaxRetries = 1
+//  pool.CheckHealth("/health", 5e9, 1e9)
+//  pool.Publish("backends")
+//  h := &proxy.ReverseProxy{Pool: pool}
+type Pool struct {
+	// Strategy for choosing a backend.
+	Strategy Strategy
+
+	// HashKey returns the key for the ConsistentHash strategy. If nil, then
+	// web.RemoteAddrKey is used.
+	HashKey func(req *web.Request) string
+
+	// Number of consecutive failures before a backend is ejected. If zero,
+	// then DefaultMaxFails is used.
+	MaxFails int
+
+	// Time in nanoseconds that an ejected backend is excluded from the pool.
+	// If zero, then DefaultEjectTime is used.
+	EjectTime int64
+
+	// Maximum number of times an idempotent request is retried on another
+	// backend. Zero means no retries.
+	MaxRetries int
+
+	backends []*Backend
+	ring     []ringEntry
+
+	mu   sync.Mutex
+	next int
+	quit chan bool
+}
+
+// NewPool returns a pool for the backends with the given addresses. The
+// addresses are in host:port format.
+func NewPool(addrs []string) *Pool {
+	p := &Pool{}
+	for _, addr := range addrs {
+		b := &Backend{Addr: addr}
+		p.backends = append(p.backends, b)
+		for i := 0; i < ringPointsPerBackend; i++ {
+			h := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i)))
+			p.ring = append(p.ring, ringEntry{h, b})
+		}
+	}
+	sort.Sort(byHash(p.ring))
+	return p
+}
+
+// Backends returns the backends in the pool.
+func (p *Pool) Backends() []*Backend {
+	return p.backends
+}
+
+// pick chooses an available backend that is not in exclude. It returns nil
+// if there is no such backend.
+func (p *Pool) pick(req *web.Request, exclude map[*Backend]bool) *Backend {
+	now := time.Nanoseconds()
+	ok := func(b *Backend) bool { return !exclude[b] && b.available(now) }
+	n := len(p.backends)
+	if n == 0 {
+		return nil
+	}
+
+	switch p.Strategy {
+	case LeastConnections:
+		var best *Backend
+		bestActive := 0
+		for _, b := range p.backends {
+			if !ok(b) {
+				continue
+			}
+			if active := b.activeCount(); best == nil || active < bestActive {
+				best = b
+				bestActive = active
+			}
+		}
+		return best
+	case ConsistentHash:
+		hashKey := p.HashKey
+		if hashKey == nil {
+			hashKey = web.RemoteAddrKey
+		}
+		h := crc32.ChecksumIEEE([]byte(hashKey(req)))
+		i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		for j := 0; j < len(p.ring); j++ {
+			if b := p.ring[(i+j)%len(p.ring)].backend; ok(b) {
+				return b
+			}
+		}
+		return nil
+	}
+
+	p.mu.Lock()
+	start := p.next
+	p.next = (p.next + 1) % n
+	p.mu.Unlock()
+	for j := 0; j < n; j++ {
+		if b := p.backends[(start+j)%n]; ok(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (p *Pool) recordResult(b *Backend, ok bool) {
+	maxFails := p.MaxFails
+	if maxFails == 0 {
+		maxFails = DefaultMaxFails
+	}
+	ejectTime := p.EjectTime
+	if ejectTime == 0 {
+		ejectTime = DefaultEjectTime
+	}
+	b.recordResult(ok, maxFails, ejectTime)
+}
+
+// Status returns a snapshot of the state of the backends.
+func (p *Pool) Status() []BackendStatus {
+	now := time.Nanoseconds()
+	result := make([]BackendStatus, len(p.backends))
+	for i, b := range p.backends {
+		b.mu.Lock()
+		result[i] = BackendStatus{
+			Addr:      b.Addr,
+			Healthy:   !b.unhealthy,
+			Ejected:   now < b.ejectedUntil,
+			Active:    b.active,
+			Requests:  b.requests,
+			Failures:  b.failures,
+			Ejections: b.ejections,
+		}
+		b.mu.Unlock()
+	}
+	return result
+}
+
+// Publish publishes the status of the pool's backends with the expvar
+// package.
+func (p *Pool) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return p.Status() }))
+}
+
+// CheckHealth starts a goroutine that sends a GET request for path to each
+// backend every interval nanoseconds. A backend is marked unhealthy if the
+// request fails, the response is not received within timeout nanoseconds or
+// the response status is not 2xx or 3xx. An unhealthy backend is marked
+// healthy when a check succeeds. Call Close to stop the health checks.
+func (p *Pool) CheckHealth(path string, interval, timeout int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.quit != nil {
+		panic("twister: pool health checks already started")
+	}
+	p.quit = make(chan bool)
+	t := &Transport{DialTimeout: timeout, WriteTimeout: timeout, ResponseTimeout: timeout, ReadTimeout: timeout}
+	go func(quit chan bool) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer t.CloseIdleConnections()
+		for {
+			for _, b := range p.backends {
+				b.setHealthy(checkBackend(t, b, path))
+			}
+			select {
+			case <-ticker.C:
+			case <-quit:
+				return
+			}
+		}
+	}(p.quit)
+}
+
+func checkBackend(t *Transport, b *Backend, path string) bool {
+	out := &Request{
+		Method: "GET",
+		Addr:   b.Addr,
+		URI:    path,
+		Header: web.NewHeader(web.HeaderHost, b.Addr),
+	}
+	res, err := t.roundTrip(out, nil, 0)
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(ioutil.Discard, res.body)
+	res.finish(t, err == nil)
+	return res.status >= 200 && res.status < 400
+}
+
+// Close stops the health checks.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.quit != nil {
+		close(p.quit)
+		p.quit = nil
+	}
+}
+
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+// servePool forwards the request to a backend in the proxy's pool.
+func (p *ReverseProxy) servePool(req *web.Request) {
+	pool := p.Pool
+	pathPrefix := ""
+	if p.Target != nil {
+		pathPrefix = p.Target.RawPath
+	}
+	t := p.transport()
+	contentLength := requestContentLength(req)
+
+	attempts := 1
+	if contentLength == 0 && idempotentMethods[req.Method] {
+		attempts += pool.MaxRetries
+	}
+
+	tried := make(map[*Backend]bool)
+	var out *Request
+	var err os.Error
+	for i := 0; i < attempts; i++ {
+		b := pool.pick(req, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		out = newRequest(req, b.Addr, pathPrefix)
+		if p.RewriteRequest != nil {
+			p.RewriteRequest(req, out)
+		}
+
+		b.begin()
+		var res *response
+		res, err = t.roundTrip(out, req.Body, contentLength)
+		pool.recordResult(b, err == nil)
+		if err != nil {
+			b.end()
+			continue
+		}
+		copyResponse(req, out, res, t, p.RewriteResponse)
+		b.end()
+		return
+	}
+
+	if err == nil {
+		req.Error(web.StatusServiceUnavailable, ErrNoBackend)
+		return
+	}
+	upstreamError(req, out, err)
+}
@@ -0,0 +1,165 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxy
+
+import (
+	"github.com/garyburd/twister/web"
+	"http"
+	"net"
+	"testing"
+)
+
+func newTestRequest(t *testing.T, remoteAddr string) *web.Request {
+	url, err := http.ParseURL("http://example.com/")
+	if err != nil {
+		t.Fatal("ParseURL", err)
+	}
+	req, err := web.NewRequest(remoteAddr, "GET", url, web.ProtocolVersion11, web.Header{})
+	if err != nil {
+		t.Fatal("NewRequest", err)
+	}
+	return req
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	p := NewPool([]string{"a:80", "b:80", "c:80"})
+	req := newTestRequest(t, "1.2.3.4:5")
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, p.pick(req, nil).Addr)
+	}
+	want := []string{"a:80", "b:80", "c:80", "a:80"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("picks = %v, want %v", got, want)
+		}
+	}
+
+	p.backends[1].setHealthy(false)
+	if b := p.pick(req, nil); b.Addr != "c:80" {
+		t.Errorf("pick with unhealthy b = %s, want c:80", b.Addr)
+	}
+	if b := p.pick(req, map[*Backend]bool{p.backends[2]: true}); b.Addr != "a:80" {
+		t.Errorf("pick excluding c = %s, want a:80", b.Addr)
+	}
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	p := NewPool([]string{"a:80", "b:80", "c:80"})
+	p.Strategy = LeastConnections
+	req := newTestRequest(t, "1.2.3.4:5")
+	p.backends[0].begin()
+	p.backends[1].begin()
+	p.backends[1].begin()
+	if b := p.pick(req, nil); b.Addr != "c:80" {
+		t.Errorf("pick = %s, want c:80", b.Addr)
+	}
+	p.backends[2].begin()
+	p.backends[2].begin()
+	if b := p.pick(req, nil); b.Addr != "a:80" {
+		t.Errorf("pick = %s, want a:80", b.Addr)
+	}
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	p := NewPool([]string{"a:80", "b:80", "c:80"})
+	p.Strategy = ConsistentHash
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		req := newTestRequest(t, net.JoinHostPort("10.0.0."+string('0'+i%10), "1234"))
+		b := p.pick(req, nil)
+		if b2 := p.pick(req, nil); b2 != b {
+			t.Fatalf("pick not stable for %s", req.RemoteAddr)
+		}
+		counts[b.Addr] += 1
+	}
+	if len(counts) < 2 {
+		t.Errorf("keys mapped to %d backends, want at least 2", len(counts))
+	}
+
+	// Keys for an ejected backend move to another backend.
+	req := newTestRequest(t, "10.0.0.1:1234")
+	b := p.pick(req, nil)
+	b.setHealthy(false)
+	if b2 := p.pick(req, nil); b2 == nil || b2 == b {
+		t.Errorf("pick after unhealthy = %v, want other backend", b2)
+	}
+}
+
+func TestPoolEjection(t *testing.T) {
+	p := NewPool([]string{"a:80"})
+	p.MaxFails = 2
+	req := newTestRequest(t, "1.2.3.4:5")
+	b := p.backends[0]
+	p.recordResult(b, false)
+	p.recordResult(b, true)
+	p.recordResult(b, false)
+	if p.pick(req, nil) == nil {
+		t.Fatal("backend ejected before consecutive failures")
+	}
+	p.recordResult(b, false)
+	if p.pick(req, nil) != nil {
+		t.Fatal("backend not ejected after consecutive failures")
+	}
+	s := p.Status()[0]
+	if !s.Ejected || s.Failures != 3 || s.Ejections != 1 {
+		t.Errorf("status = %+v", s)
+	}
+}
+
+func TestPoolRetry(t *testing.T) {
+	// Find an address with no listener.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	l = startServer(t, web.HandlerFunc(upstreamHandler))
+	defer l.Close()
+
+	pool := NewPool([]string{dead, l.Addr().String()})
+	pool.MaxRetries = 1
+	p := &ReverseProxy{Pool: pool, Transport: &Transport{}}
+
+	// Round robin sends the first request to the dead backend. The request
+	// has a body and is not retried.
+	status, _, _ := web.RunHandler("http://example.com/", "POST",
+		web.NewHeader(web.HeaderContentLength, "5"), []byte("hello"), p)
+	if status != web.StatusBadGateway {
+		t.Errorf("POST status = %d, want %d", status, web.StatusBadGateway)
+	}
+
+	// The second request is sent to the live backend. The third request is
+	// sent to the dead backend and retried on the live backend.
+	for i := 0; i < 2; i++ {
+		status, _, _ = web.RunHandler("http://example.com/", "GET", nil, nil, p)
+		if status != web.StatusOK {
+			t.Errorf("GET %d status = %d, want %d", i, status, web.StatusOK)
+		}
+	}
+
+	// The third failure ejects the dead backend.
+	pool.backends[1].setHealthy(false)
+	status, _, _ = web.RunHandler("http://example.com/", "GET", nil, nil, p)
+	if status != web.StatusBadGateway {
+		t.Errorf("GET status = %d, want %d", status, web.StatusBadGateway)
+	}
+	status, _, _ = web.RunHandler("http://example.com/", "GET", nil, nil, p)
+	if status != web.StatusServiceUnavailable {
+		t.Errorf("no backend status = %d, want %d", status, web.StatusServiceUnavailable)
+	}
+}
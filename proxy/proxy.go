@@ -0,0 +1,347 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The proxy package implements a reverse proxy handler.
+//
+//  router := web.NewRouter().
+//      Register("/api/<path:.*>", "*", proxy.NewReverseProxy("http://127.0.0.1:9000/v1"))
+package proxy
+
+import (
+	"github.com/garyburd/twister/web"
+	"http"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// Request is the request sent to the upstream server.
+type Request struct {
+	// Request method.
+	Method string
+
+	// Address of the upstream server in host:port format.
+	Addr string
+
+	// Request URI sent in the request line. The URI includes the path and
+	// query.
+	URI string
+
+	// Request header. The hop-by-hop headers from the client request are
+	// removed.
+	Header web.Header
+}
+
+// Response is the response received from the upstream server.
+type Response struct {
+	Status int
+
+	// Response header. The hop-by-hop headers from the upstream response
+	// are removed.
+	Header web.Header
+}
+
+// ReverseProxy is a handler that forwards requests to an upstream server
+// and copies the response back to the client.
+//
+// The proxy removes hop-by-hop headers from the request and response and
+// appends the client to the X-Forwarded-For and Forwarded request headers.
+// The X-Forwarded-Proto and X-Forwarded-Host request headers are set from
+// the request URL. The Host header is passed through unchanged.
+//
+// Request and response bodies are streamed. The response body is flushed to
+// the client after each read from the upstream server. Requests with the
+// Upgrade header are tunneled to the upstream server using the responder's
+// Hijack method if the upstream server responds with status 101.
+//
+// If the upstream server cannot be reached or returns an invalid response,
+// then the proxy responds with status 502. If a timeout expires before the
+// response header is received, then the proxy responds with status 504.
+type ReverseProxy struct {
+	// The upstream URL. The scheme must be http. The path of the request URL
+	// is appended to the path of the upstream URL. If Pool is not nil, then
+	// the host in the upstream URL is ignored and Target can be nil.
+	Target *http.URL
+
+	// If not nil, requests are sent to the backends in the pool.
+	Pool *Pool
+
+	// Transport used to send requests to the upstream server. If nil, then
+	// DefaultTransport is used.
+	Transport *Transport
+
+	// If not nil, RewriteRequest is called to modify the request before it
+	// is sent to the upstream server.
+	RewriteRequest func(req *web.Request, out *Request)
+
+	// If not nil, RewriteResponse is called to modify the response before it
+	// is sent to the client.
+	RewriteResponse func(req *web.Request, res *Response)
+}
+
+// NewReverseProxy returns a reverse proxy for the upstream URL.
+// NewReverseProxy panics if the URL cannot be parsed or if the scheme is not
+// http.
+func NewReverseProxy(target string) *ReverseProxy {
+	return &ReverseProxy{Target: parseTarget(target)}
+}
+
+func parseTarget(target string) *http.URL {
+	u, err := http.ParseURL(target)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		panic("twister: bad proxy target " + target)
+	}
+	return u
+}
+
+func (p *ReverseProxy) transport() *Transport {
+	if p.Transport != nil {
+		return p.Transport
+	}
+	return DefaultTransport
+}
+
+// ServeWeb forwards the request to the upstream server.
+func (p *ReverseProxy) ServeWeb(req *web.Request) {
+	if p.Pool != nil {
+		p.servePool(req)
+		return
+	}
+	addr := p.Target.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = addr + ":80"
+	}
+	out := newRequest(req, addr, p.Target.RawPath)
+	if p.RewriteRequest != nil {
+		p.RewriteRequest(req, out)
+	}
+	t := p.transport()
+	res, err := t.roundTrip(out, req.Body, requestContentLength(req))
+	if err != nil {
+		upstreamError(req, out, err)
+		return
+	}
+	copyResponse(req, out, res, t, p.RewriteResponse)
+}
+
+// requestContentLength returns the length of the request body or -1 if the
+// body is chunked.
+func requestContentLength(req *web.Request) int {
+	if req.ContentLength < 0 && !hasToken(req.Header, web.HeaderTransferEncoding, "chunked") {
+		// A request without a Content-Length or Transfer-Encoding header does
+		// not have a body.
+		return 0
+	}
+	return req.ContentLength
+}
+
+// upstreamError responds to the client with status 504 if the error is a
+// timeout and status 502 otherwise.
+func upstreamError(req *web.Request, out *Request, err os.Error) {
+	log.Println("twister: proxy to", out.Addr, "failed:", err)
+	status := web.StatusBadGateway
+	if isTimeout(err) {
+		status = web.StatusGatewayTimeout
+	}
+	req.Error(status, err)
+}
+
+// hopHeaders are the headers that apply to a single transport-level
+// connection.
+var hopHeaders = []string{
+	web.HeaderConnection,
+	"Keep-Alive",
+	web.HeaderProxyAuthenticate,
+	web.HeaderProxyAuthorization,
+	web.HeaderTE,
+	web.HeaderTrailer,
+	web.HeaderTransferEncoding,
+	web.HeaderUpgrade,
+}
+
+// hasToken returns true if the comma separated list in the header contains
+// token.
+func hasToken(header web.Header, name, token string) bool {
+	for _, s := range header.GetList(name) {
+		if strings.ToLower(s) == token {
+			return true
+		}
+	}
+	return false
+}
+
+// removeHopHeaders removes the hop-by-hop headers and the headers listed in
+// the Connection header.
+func removeHopHeaders(header web.Header) {
+	for _, name := range header.GetList(web.HeaderConnection) {
+		header[web.HeaderName(name)] = nil, false
+	}
+	for _, name := range hopHeaders {
+		header[name] = nil, false
+	}
+}
+
+// joinPath joins the upstream path and the request path with a single slash.
+func joinPath(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// newRequest creates the upstream request for the client request. The
+// request path is appended to pathPrefix.
+func newRequest(req *web.Request, addr string, pathPrefix string) *Request {
+	header := make(web.Header, len(req.Header))
+	for k, v := range req.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	upgrade := header.Get(web.HeaderUpgrade)
+	if !hasToken(header, web.HeaderConnection, "upgrade") {
+		upgrade = ""
+	}
+	removeHopHeaders(header)
+	if upgrade != "" {
+		header.Set(web.HeaderConnection, "Upgrade")
+		header.Set(web.HeaderUpgrade, upgrade)
+	}
+	addForwardedHeaders(req, header)
+
+	return &Request{
+		Method: req.Method,
+		Addr:   addr,
+		URI:    joinPath(pathPrefix, req.URL.RawPath),
+		Header: header,
+	}
+}
+
+// addForwardedHeaders appends the client to the X-Forwarded-For and
+// Forwarded headers and sets the X-Forwarded-Proto and X-Forwarded-Host
+// headers.
+func addForwardedHeaders(req *web.Request, header web.Header) {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	if prior := header[web.HeaderXForwardedFor]; len(prior) > 0 {
+		header.Set(web.HeaderXForwardedFor, strings.Join(prior, ", ")+", "+ip)
+	} else {
+		header.Set(web.HeaderXForwardedFor, ip)
+	}
+	header.Set(web.HeaderXForwardedProto, req.URL.Scheme)
+	if req.URL.Host != "" {
+		header.Set(web.HeaderXForwardedHost, req.URL.Host)
+	}
+
+	node := "unknown"
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if strings.IndexRune(ip, ':') >= 0 {
+			node = `"[` + ip + `]"`
+		} else {
+			node = ip
+		}
+	}
+	element := "for=" + node + ";proto=" + req.URL.Scheme
+	if req.URL.Host != "" {
+		element += ";host=" + web.QuoteHeaderValueOrToken(req.URL.Host)
+	}
+	if prior := header[web.HeaderForwarded]; len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	header.Set(web.HeaderForwarded, element)
+}
+
+// copyResponse copies the upstream response to the client.
+func copyResponse(req *web.Request, out *Request, res *response, t *Transport, rewrite func(*web.Request, *Response)) {
+	if res.status == web.StatusSwitchingProtocols {
+		tunnel(req, out, res)
+		return
+	}
+
+	removeHopHeaders(res.header)
+	r := &Response{Status: res.status, Header: res.header}
+	if rewrite != nil {
+		rewrite(req, r)
+	}
+
+	w := req.Responder.Respond(r.Status, r.Header)
+	f, _ := w.(web.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				res.finish(t, false)
+				return
+			}
+			if f != nil {
+				f.Flush()
+			}
+		}
+		if err == os.EOF {
+			res.finish(t, true)
+			return
+		}
+		if err != nil {
+			log.Println("twister: proxy read from", out.Addr, "failed:", err)
+			res.finish(t, false)
+			return
+		}
+	}
+}
+
+// tunnel copies data between the client and upstream connections after the
+// upstream server switches protocols.
+func tunnel(req *web.Request, out *Request, res *response) {
+	defer res.c.Close()
+	if out.Header.Get(web.HeaderUpgrade) == "" {
+		// The upstream server switched protocols without a request to do so.
+		req.Error(web.StatusBadGateway, ErrBadResponse)
+		return
+	}
+	conn, br, err := req.Responder.Hijack()
+	if err != nil {
+		req.Error(web.StatusBadGateway, err)
+		return
+	}
+	defer conn.Close()
+	res.c.SetReadTimeout(0)
+	res.c.SetWriteTimeout(0)
+
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n")
+	if err := res.header.WriteHttpHeader(conn); err != nil {
+		return
+	}
+
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(res.c, br)
+		done <- true
+	}()
+	go func() {
+		io.Copy(conn, res.c.br)
+		done <- true
+	}()
+	// Return when either side is done. The deferred calls to Close stop the
+	// copy in the other direction.
+	<-done
+}
@@ -0,0 +1,183 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"github.com/garyburd/twister/server"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer starts a server on a loopback address and returns the
+// listener.
+func startServer(t *testing.T, h web.Handler) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	go (&server.Server{Listener: l, Handler: h}).Serve()
+	return l
+}
+
+// upstreamHandler echoes the request in the response headers and body.
+func upstreamHandler(req *web.Request) {
+	switch req.URL.Path {
+	case "/v1/slow":
+		time.Sleep(1e9)
+	case "/v1/upgrade":
+		conn, br, err := req.Responder.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		io.Copy(conn, br)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	w := req.Respond(web.StatusOK,
+		"Keep-Alive", "timeout=5",
+		"X-Uri", req.URL.RawPath,
+		"X-Connection", req.Header.Get(web.HeaderConnection),
+		"X-Forwarded-For", req.Header.Get(web.HeaderXForwardedFor),
+		"X-Forwarded", req.Header.Get(web.HeaderForwarded),
+		"X-Host", req.Header.Get(web.HeaderHost))
+	w.Write(body)
+}
+
+func TestReverseProxy(t *testing.T) {
+	l := startServer(t, web.HandlerFunc(upstreamHandler))
+	defer l.Close()
+	p := NewReverseProxy("http://" + l.Addr().String() + "/v1")
+	p.Transport = &Transport{}
+	p.RewriteResponse = func(req *web.Request, res *Response) {
+		res.Header.Set("X-Rewritten", "yes")
+	}
+
+	for _, contentLength := range []string{"5", ""} {
+		header := web.NewHeader(
+			web.HeaderHost, "example.com",
+			web.HeaderConnection, "X-Hop",
+			"X-Hop", "1",
+			web.HeaderXForwardedFor, "5.6.7.8")
+		if contentLength != "" {
+			header.Set(web.HeaderContentLength, contentLength)
+		} else {
+			header.Set(web.HeaderTransferEncoding, "chunked")
+		}
+		status, header, body := web.RunHandler("http://example.com/a?b=c", "POST", header, []byte("hello"), p)
+		if status != web.StatusOK {
+			t.Fatalf("status = %d, want %d", status, web.StatusOK)
+		}
+		if s := string(body); s != "hello" {
+			t.Errorf("body = %q, want %q", s, "hello")
+		}
+		expected := map[string]string{
+			"X-Uri":             "/v1/a?b=c",
+			"X-Connection":      "",
+			"X-Forwarded-For":   "5.6.7.8, 1.2.3.4",
+			"X-Forwarded":       "for=1.2.3.4;proto=http;host=example.com",
+			"X-Host":            "example.com",
+			"X-Rewritten":       "yes",
+			"Keep-Alive":        "",
+			"Transfer-Encoding": "",
+		}
+		for k, v := range expected {
+			if s := header.Get(k); s != v {
+				t.Errorf("%s = %q, want %q", k, s, v)
+			}
+		}
+	}
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	// Find an address with no listener.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	p := NewReverseProxy("http://" + addr)
+	status, _, _ := web.RunHandler("http://example.com/", "GET", nil, nil, p)
+	if status != web.StatusBadGateway {
+		t.Errorf("closed port status = %d, want %d", status, web.StatusBadGateway)
+	}
+
+	l = startServer(t, web.HandlerFunc(upstreamHandler))
+	defer l.Close()
+	p = NewReverseProxy("http://" + l.Addr().String() + "/v1")
+	p.Transport = &Transport{ResponseTimeout: 1e8}
+	status, _, _ = web.RunHandler("http://example.com/slow", "GET", nil, nil, p)
+	if status != web.StatusGatewayTimeout {
+		t.Errorf("slow upstream status = %d, want %d", status, web.StatusGatewayTimeout)
+	}
+}
+
+func TestReverseProxyUpgrade(t *testing.T) {
+	upstream := startServer(t, web.HandlerFunc(upstreamHandler))
+	defer upstream.Close()
+	p := NewReverseProxy("http://" + upstream.Addr().String() + "/v1")
+	front := startServer(t, p)
+	defer front.Close()
+
+	c, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal("Dial", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET /upgrade HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nping")
+	br := bufio.NewReader(c)
+	line, _, err := br.ReadLine()
+	if err != nil {
+		t.Fatal("ReadLine", err)
+	}
+	if s := string(line); s != "HTTP/1.1 101 Switching Protocols" {
+		t.Fatalf("status line = %q", s)
+	}
+	header := web.Header{}
+	if err := header.ParseHttpHeader(br); err != nil {
+		t.Fatal("ParseHttpHeader", err)
+	}
+	if s := header.Get(web.HeaderUpgrade); s != "echo" {
+		t.Errorf("upgrade = %q, want %q", s, "echo")
+	}
+	p4 := make([]byte, 4)
+	if _, err := io.ReadFull(br, p4); err != nil {
+		t.Fatal("ReadFull", err)
+	}
+	if s := string(p4); s != "ping" {
+		t.Errorf("echo = %q, want %q", s, "ping")
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	tests := []struct{ a, b, want string }{
+		{"", "/x", "/x"},
+		{"/v1", "/x", "/v1/x"},
+		{"/v1/", "/x", "/v1/x"},
+		{"/v1", "x", "/v1/x"},
+	}
+	for _, tt := range tests {
+		if s := joinPath(tt.a, tt.b); s != tt.want {
+			t.Errorf("joinPath(%q, %q) = %q, want %q", tt.a, tt.b, s, tt.want)
+		}
+	}
+}
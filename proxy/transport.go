@@ -0,0 +1,402 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/garyburd/twister/web"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxIdleConnsPerAddr is the default value of
+// Transport.MaxIdleConnsPerAddr.
+const DefaultMaxIdleConnsPerAddr = 2
+
+var ErrBadResponse = os.NewError("twister.proxy: bad response from upstream")
+
+// timeoutError is returned when a dial or read times out.
+type timeoutError string
+
+func (e timeoutError) String() string  { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+var errDialTimeout = timeoutError("twister.proxy: dial timeout")
+
+func isTimeout(err os.Error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// Transport sends requests to upstream servers over HTTP/1.1. The transport
+// keeps idle connections for reuse by later requests. A Transport is safe
+// for use by multiple goroutines.
+type Transport struct {
+	// Maximum time in nanoseconds to wait for a connection to be
+	// established. Zero means no limit.
+	DialTimeout int64
+
+	// Maximum time in nanoseconds for each write of the request to the
+	// upstream server. Zero means no limit.
+	WriteTimeout int64
+
+	// Maximum time in nanoseconds to wait for the response header after the
+	// request is sent. Zero means no limit.
+	ResponseTimeout int64
+
+	// Maximum time in nanoseconds for each read of the response body. Zero
+	// means no limit.
+	ReadTimeout int64
+
+	// Maximum number of idle connections kept for each upstream address. If
+	// zero, then DefaultMaxIdleConnsPerAddr is used.
+	MaxIdleConnsPerAddr int
+
+	mu   sync.Mutex
+	idle map[string][]*conn
+}
+
+// DefaultTransport is used by proxies that do not specify a transport.
+var DefaultTransport = &Transport{DialTimeout: 10e9, ResponseTimeout: 60e9}
+
+// conn is a connection to an upstream server.
+type conn struct {
+	net.Conn
+	addr   string
+	br     *bufio.Reader
+	reused bool
+}
+
+func dial(addr string, timeout int64) (net.Conn, os.Error) {
+	if timeout == 0 {
+		return net.Dial("tcp", addr)
+	}
+	type result struct {
+		c   net.Conn
+		err os.Error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := net.Dial("tcp", addr)
+		ch <- result{c, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.c, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-ch; r.c != nil {
+				r.c.Close()
+			}
+		}()
+	}
+	return nil, errDialTimeout
+}
+
+func (t *Transport) getConn(addr string) (*conn, os.Error) {
+	t.mu.Lock()
+	if cs := t.idle[addr]; len(cs) > 0 {
+		c := cs[len(cs)-1]
+		t.idle[addr] = cs[:len(cs)-1]
+		t.mu.Unlock()
+		c.reused = true
+		return c, nil
+	}
+	t.mu.Unlock()
+	nc, err := dial(addr, t.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: nc, addr: addr, br: bufio.NewReader(nc)}, nil
+}
+
+func (t *Transport) putConn(c *conn) {
+	max := t.MaxIdleConnsPerAddr
+	if max == 0 {
+		max = DefaultMaxIdleConnsPerAddr
+	}
+	c.SetReadTimeout(0)
+	c.SetWriteTimeout(0)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.idle == nil {
+		t.idle = make(map[string][]*conn)
+	}
+	if len(t.idle[c.addr]) >= max {
+		c.Close()
+		return
+	}
+	t.idle[c.addr] = append(t.idle[c.addr], c)
+}
+
+// CloseIdleConnections closes the idle connections kept by the transport.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, cs := range t.idle {
+		for _, c := range cs {
+			c.Close()
+		}
+	}
+	t.idle = nil
+}
+
+// response is a response from an upstream server.
+type response struct {
+	status    int
+	header    web.Header
+	body      io.Reader
+	c         *conn
+	closeConn bool
+}
+
+// finish releases the connection after the response body is read. If the
+// body was read to EOF and the connection can be reused, then the
+// connection is returned to the transport.
+func (res *response) finish(t *Transport, bodyComplete bool) {
+	if bodyComplete && !res.closeConn {
+		t.putConn(res.c)
+	} else {
+		res.c.Close()
+	}
+}
+
+// roundTrip sends the request to the upstream server and reads the response
+// header. If an idempotent request without a body fails on a reused
+// connection, then the request is retried once on a new connection because
+// the upstream server may have closed the idle connection. Other requests are
+// not retried because the upstream server may have acted on the request.
+func (t *Transport) roundTrip(out *Request, body io.Reader, contentLength int) (*response, os.Error) {
+	for attempt := 0; ; attempt++ {
+		c, err := t.getConn(out.Addr)
+		if err != nil {
+			return nil, err
+		}
+		res, err := t.send(c, out, body, contentLength)
+		if err == nil {
+			return res, nil
+		}
+		c.Close()
+		if attempt == 0 && c.reused && contentLength == 0 && idempotentMethods[out.Method] && !isTimeout(err) {
+			continue
+		}
+		return nil, err
+	}
+	panic("not reached")
+}
+
+func (t *Transport) send(c *conn, out *Request, body io.Reader, contentLength int) (*response, os.Error) {
+	header := out.Header
+	if header == nil {
+		header = web.Header{}
+	}
+	switch {
+	case contentLength > 0:
+		header.Set(web.HeaderContentLength, strconv.Itoa(contentLength))
+	case contentLength < 0:
+		header.Set(web.HeaderTransferEncoding, "chunked")
+	}
+
+	c.SetWriteTimeout(t.WriteTimeout)
+	bw := bufio.NewWriter(c)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", out.Method, out.URI)
+	if err := header.WriteHttpHeader(bw); err != nil {
+		return nil, err
+	}
+	switch {
+	case contentLength > 0:
+		n, err := io.Copy(bw, io.LimitReader(body, int64(contentLength)))
+		if err != nil {
+			return nil, err
+		}
+		if n != int64(contentLength) {
+			return nil, io.ErrUnexpectedEOF
+		}
+	case contentLength < 0:
+		cw := chunkedWriter{bw}
+		if _, err := io.Copy(cw, body); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(bw, "0\r\n\r\n"); err != nil {
+			return nil, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	c.SetReadTimeout(t.ResponseTimeout)
+	var res *response
+	for {
+		var err os.Error
+		res, err = readResponseHeader(c.br)
+		if err != nil {
+			return nil, err
+		}
+		// Skip interim responses other than 101 Switching Protocols.
+		if res.status >= 200 || res.status == web.StatusSwitchingProtocols {
+			break
+		}
+	}
+	c.SetReadTimeout(t.ReadTimeout)
+	res.c = c
+
+	te := res.header.Get(web.HeaderTransferEncoding)
+	switch {
+	case res.status == web.StatusSwitchingProtocols:
+		res.closeConn = true
+	case out.Method == "HEAD" || res.status == web.StatusNoContent || res.status == web.StatusNotModified:
+		res.body = eofReader{}
+	case te != "" && strings.ToLower(te) != "identity":
+		res.body = &chunkedReader{br: c.br}
+	case res.header.Get(web.HeaderContentLength) != "":
+		n, err := strconv.Atoi64(res.header.Get(web.HeaderContentLength))
+		if err != nil || n < 0 {
+			return nil, ErrBadResponse
+		}
+		res.body = io.LimitReader(c.br, n)
+	default:
+		// The body is terminated by closing the connection.
+		res.body = c.br
+		res.closeConn = true
+	}
+	return res, nil
+}
+
+// readResponseHeader reads the status line and header of a response.
+func readResponseHeader(br *bufio.Reader) (*response, os.Error) {
+	line, isPrefix, err := br.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if isPrefix {
+		return nil, ErrBadResponse
+	}
+	f := strings.Split(string(line), " ", 3)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "HTTP/1.") {
+		return nil, ErrBadResponse
+	}
+	status, err := strconv.Atoi(f[1])
+	if err != nil || status < 100 || status > 999 {
+		return nil, ErrBadResponse
+	}
+	res := &response{status: status, header: web.Header{}}
+	if err := res.header.ParseHttpHeader(br); err != nil {
+		return nil, err
+	}
+	if f[0] == "HTTP/1.0" || hasToken(res.header, web.HeaderConnection, "close") {
+		res.closeConn = true
+	}
+	return res, nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read(p []byte) (int, os.Error) { return 0, os.EOF }
+
+// chunkedWriter writes each call to Write as a chunk.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (cw chunkedWriter) Write(p []byte) (int, os.Error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(cw.w, "\r\n")
+	return n, err
+}
+
+// chunkedReader decodes a chunked response body. Trailers are discarded.
+type chunkedReader struct {
+	br  *bufio.Reader
+	n   int64
+	err os.Error
+}
+
+func (r *chunkedReader) readLine() (string, os.Error) {
+	line, isPrefix, err := r.br.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if isPrefix {
+		return "", ErrBadResponse
+	}
+	return string(line), nil
+}
+
+func (r *chunkedReader) Read(p []byte) (int, os.Error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.n == 0 {
+		line, err := r.readLine()
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		if i := strings.IndexRune(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		n, err := strconv.Btoui64(strings.TrimSpace(line), 16)
+		if err != nil {
+			r.err = ErrBadResponse
+			return 0, r.err
+		}
+		if n == 0 {
+			for {
+				line, err := r.readLine()
+				if err != nil {
+					r.err = err
+					return 0, err
+				}
+				if line == "" {
+					break
+				}
+			}
+			r.err = os.EOF
+			return 0, r.err
+		}
+		r.n = int64(n)
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.br.Read(p)
+	r.n -= int64(n)
+	if err == nil && r.n == 0 {
+		var line string
+		line, err = r.readLine()
+		if err == nil && line != "" {
+			err = ErrBadResponse
+		}
+	}
+	r.err = err
+	return n, err
+}
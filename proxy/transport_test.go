@@ -0,0 +1,108 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// startOneShotServer starts an upstream server that responds to the first
+// request on each connection and closes the connection after reading the
+// second request. The server sends to the returned channel for each request
+// it reads.
+func startOneShotServer(t *testing.T) (net.Listener, chan bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	requests := make(chan bool, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for i := 0; i < 2; i++ {
+					if _, _, err := br.ReadLine(); err != nil {
+						return
+					}
+					if err := (web.Header{}).ParseHttpHeader(br); err != nil {
+						return
+					}
+					requests <- true
+					if i == 0 {
+						io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+					}
+				}
+			}(c)
+		}
+	}()
+	return l, requests
+}
+
+func TestRoundTripRetry(t *testing.T) {
+	var tests = []struct {
+		method string
+		retry  bool
+	}{
+		{"GET", true},
+		{"DELETE", true},
+		{"POST", false},
+		{"PATCH", false},
+	}
+	for _, tt := range tests {
+		l, requests := startOneShotServer(t)
+		tr := &Transport{}
+		out := &Request{Method: tt.method, Addr: l.Addr().String(), URI: "/", Header: web.Header{}}
+
+		res, err := tr.roundTrip(out, nil, 0)
+		if err != nil {
+			t.Fatalf("%s: first roundTrip returned %v", tt.method, err)
+		}
+		_, err = io.Copy(ioutil.Discard, res.body)
+		res.finish(tr, err == nil)
+
+		// The second request is sent on the idle connection. The upstream
+		// server closes the connection without a response.
+		res, err = tr.roundTrip(out, nil, 0)
+		if tt.retry {
+			if err != nil {
+				t.Errorf("%s: second roundTrip returned %v, want retry", tt.method, err)
+			} else {
+				res.finish(tr, false)
+			}
+		} else if err == nil {
+			t.Errorf("%s: second roundTrip succeeded, want error without retry", tt.method)
+			res.finish(tr, false)
+		}
+		l.Close()
+
+		want := 2
+		if tt.retry {
+			want = 3
+		}
+		if n := len(requests); n != want {
+			t.Errorf("%s: upstream read %d requests, want %d", tt.method, n, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// The scgi package serves Twister applications using the SCGI protocol
+// (http://python.ca/scgi/protocol.txt).
+//
+//  listener, err := net.Listen("tcp", "127.0.0.1:4000")
+//  if err != nil {
+//      log.Fatal("Listen", err)
+//  }
+//  err = scgi.Serve(listener, handler)
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/cgi"
+	"github.com/garyburd/twister/web"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+var ErrBadHeader = os.NewError("twister.scgi: bad request header")
+
+// Maximum length of the request header netstring.
+const maxHeaderLen = 1 << 20
+
+// Serve accepts SCGI connections on l and serves the requests with handler.
+// The meta-variables received from the web server are stored in the request
+// Env with the key "twister.cgi.env".
+func Serve(l net.Listener, handler web.Handler) os.Error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				log.Printf("twister.scgi: accept error %v", e)
+				continue
+			}
+			return err
+		}
+		go serveConn(c, handler)
+	}
+	return nil
+}
+
+func serveConn(c net.Conn, handler web.Handler) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	env, err := readHeader(br)
+	if err != nil {
+		log.Println("twister.scgi: read header", err)
+		return
+	}
+	if err := cgi.ServeRequest(env, br, c, handler); err != nil {
+		log.Println("twister.scgi: write response", err)
+	}
+}
+
+// readHeader reads the request header netstring. The netstring contains
+// NUL terminated names and values.
+func readHeader(br *bufio.Reader) (map[string]string, os.Error) {
+	s, err := br.ReadString(':')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 || n > maxHeaderLen {
+		return nil, ErrBadHeader
+	}
+	p := make([]byte, n+1)
+	if _, err := io.ReadFull(br, p); err != nil {
+		return nil, err
+	}
+	if p[n] != ',' {
+		return nil, ErrBadHeader
+	}
+	fields := bytes.Split(p[:n], []byte{0}, -1)
+	// The header ends with a NUL, so the last field is empty.
+	if len(fields)%2 != 1 || len(fields[len(fields)-1]) != 0 {
+		return nil, ErrBadHeader
+	}
+	env := make(map[string]string)
+	for i := 0; i < len(fields)-1; i += 2 {
+		env[string(fields[i])] = string(fields[i+1])
+	}
+	if env["SCGI"] != "1" {
+		return nil, ErrBadHeader
+	}
+	return env, nil
+}
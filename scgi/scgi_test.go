@@ -0,0 +1,97 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+)
+
+var readHeaderTests = []struct {
+	in  string
+	env map[string]string
+}{
+	{
+		in:  "24:CONTENT_LENGTH\x000\x00SCGI\x001\x00,",
+		env: map[string]string{"CONTENT_LENGTH": "0", "SCGI": "1"},
+	},
+	{
+		// Missing SCGI variable.
+		in: "17:CONTENT_LENGTH\x000\x00,",
+	},
+	{
+		// Missing trailing comma.
+		in: "24:CONTENT_LENGTH\x000\x00SCGI\x001\x00;",
+	},
+	{
+		// Bad length.
+		in: "x:",
+	},
+}
+
+func TestReadHeader(t *testing.T) {
+	for _, tt := range readHeaderTests {
+		env, err := readHeader(bufio.NewReader(bytes.NewBufferString(tt.in)))
+		if tt.env == nil {
+			if err == nil {
+				t.Errorf("readHeader(%q) did not return error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readHeader(%q) returned error %v", tt.in, err)
+			continue
+		}
+		if len(env) != len(tt.env) {
+			t.Errorf("readHeader(%q) = %v, want %v", tt.in, env, tt.env)
+			continue
+		}
+		for k, v := range tt.env {
+			if env[k] != v {
+				t.Errorf("readHeader(%q) = %v, want %v", tt.in, env, tt.env)
+				break
+			}
+		}
+	}
+}
+
+func echoHandler(req *web.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	w := req.Respond(web.StatusOK, web.HeaderContentType, "text/plain")
+	io.WriteString(w, req.URL.String()+":")
+	w.Write(body)
+}
+
+func TestServeConn(t *testing.T) {
+	header := "CONTENT_LENGTH\x005\x00SCGI\x001\x00REQUEST_METHOD\x00POST\x00" +
+		"REQUEST_URI\x00/a\x00HTTP_HOST\x00example.com\x00"
+	serverConn, clientConn := net.Pipe()
+	go serveConn(serverConn, web.HandlerFunc(echoHandler))
+	go io.WriteString(clientConn, strconv.Itoa(len(header))+":"+header+",hello")
+	out, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal("ReadAll", err)
+	}
+	expected := "Status: 200 OK\r\nContent-Type: text/plain\r\n\r\nhttp://example.com/a:hello"
+	if string(out) != expected {
+		t.Errorf("response\ngot:  %q\nwant: %q", out, expected)
+	}
+}
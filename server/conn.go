@@ -0,0 +1,123 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// timeoutError is returned from deadlineConn when a deadline expires.
+type timeoutError struct{}
+
+func (e timeoutError) String() string  { return "twister.server: i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+var errTimeout os.Error = timeoutError{}
+
+// isTimeout returns true if err is a network timeout.
+func isTimeout(err os.Error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// deadlineConn limits the total time spent in a sequence of reads or writes
+// on a connection. The underlying net.Conn only supports timeouts on
+// individual operations. A slow client can defeat a per-operation timeout by
+// trickling data to the server. The deadlineConn converts an absolute
+// deadline to a per-operation timeout before each read and write.
+type deadlineConn struct {
+	net.Conn
+
+	// Per-operation timeouts in nanoseconds. Zero means no timeout.
+	readTimeout  int64
+	writeTimeout int64
+
+	// Absolute deadlines in nanoseconds since the epoch. Zero means no
+	// deadline.
+	readDeadline  int64
+	writeDeadline int64
+}
+
+// timeout returns the per-operation timeout given the timeout and deadline.
+func timeout(timeout, deadline int64) (int64, os.Error) {
+	if deadline == 0 {
+		return timeout, nil
+	}
+	remaining := deadline - time.Nanoseconds()
+	if remaining <= 0 {
+		return 0, errTimeout
+	}
+	if timeout != 0 && timeout < remaining {
+		return timeout, nil
+	}
+	return remaining, nil
+}
+
+// setReadDeadline sets the read deadline to d nanoseconds from now. If d is
+// zero, then the read deadline is cleared.
+func (c *deadlineConn) setReadDeadline(d int64) {
+	if d == 0 {
+		c.readDeadline = 0
+	} else {
+		c.readDeadline = time.Nanoseconds() + d
+	}
+}
+
+// setWriteDeadline sets the write deadline to d nanoseconds from now. If d is
+// zero, then the write deadline is cleared.
+func (c *deadlineConn) setWriteDeadline(d int64) {
+	if d == 0 {
+		c.writeDeadline = 0
+	} else {
+		c.writeDeadline = time.Nanoseconds() + d
+	}
+}
+
+func (c *deadlineConn) Read(p []byte) (int, os.Error) {
+	t, err := timeout(c.readTimeout, c.readDeadline)
+	if err != nil {
+		return 0, err
+	}
+	c.Conn.SetReadTimeout(t)
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, os.Error) {
+	t, err := timeout(c.writeTimeout, c.writeDeadline)
+	if err != nil {
+		return 0, err
+	}
+	c.Conn.SetWriteTimeout(t)
+	return c.Conn.Write(p)
+}
+
+// ReadFrom passes through to the underlying connection's ReadFrom method if
+// available. This allows the connection to use sendfile.
+func (c *deadlineConn) ReadFrom(r io.Reader) (int64, os.Error) {
+	rf, ok := c.Conn.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{c}, r)
+	}
+	t, err := timeout(c.writeTimeout, c.writeDeadline)
+	if err != nil {
+		return 0, err
+	}
+	c.Conn.SetWriteTimeout(t)
+	return rf.ReadFrom(r)
+}
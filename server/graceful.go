@@ -0,0 +1,94 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// connState tracks the connections served by a server so that the server
+// can be shut down gracefully.
+type connState struct {
+	mu           sync.Mutex
+	wg           sync.WaitGroup
+	shuttingDown bool
+
+	// Map from connection to true if the connection is waiting for a
+	// request.
+	conns map[net.Conn]bool
+}
+
+// add starts tracking conn. It returns false if the server is shutting down.
+func (cs *connState) add(conn net.Conn) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.shuttingDown {
+		return false
+	}
+	if cs.conns == nil {
+		cs.conns = make(map[net.Conn]bool)
+	}
+	cs.conns[conn] = true
+	cs.wg.Add(1)
+	return true
+}
+
+// remove stops tracking conn.
+func (cs *connState) remove(conn net.Conn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.conns[conn] = false, false
+	cs.wg.Done()
+}
+
+// setIdle records whether conn is waiting for a request. It returns true if
+// the server is shutting down.
+func (cs *connState) setIdle(conn net.Conn, idle bool) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.conns[conn] = idle
+	return cs.shuttingDown
+}
+
+// isShuttingDown returns true if Shutdown was called.
+func (cs *connState) isShuttingDown() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.shuttingDown
+}
+
+// Shutdown gracefully shuts down the server. Shutdown closes the server's
+// listeners, closes connections waiting for a request and waits for the
+// requests in progress to complete. Connections are closed after the
+// current request. Serve returns nil after Shutdown is called.
+func (s *Server) Shutdown() {
+	cs := &s.connState
+	cs.mu.Lock()
+	cs.shuttingDown = true
+	if s.Listener != nil {
+		s.Listener.Close()
+	}
+	for _, lc := range s.Listeners {
+		lc.Listener.Close()
+	}
+	for conn, idle := range cs.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	cs.mu.Unlock()
+	cs.wg.Wait()
+}
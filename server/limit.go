@@ -0,0 +1,118 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"github.com/garyburd/twister/web"
+	"log"
+	"net"
+	"sync"
+)
+
+// Keys for counters in Server.Stats.
+const (
+	StatAcceptedConnections = "acceptedConnections"
+	StatActiveConnections   = "activeConnections"
+	StatRejectedConnections = "rejectedConnections"
+	StatRequests            = "requests"
+)
+
+// ipCounter counts the number of connections from each remote IP address.
+type ipCounter struct {
+	mu sync.Mutex
+	m  map[string]int
+}
+
+func newIPCounter() *ipCounter {
+	return &ipCounter{m: make(map[string]int)}
+}
+
+// acquire increments the count for ip and returns true if the count is less
+// than or equal to max.
+func (c *ipCounter) acquire(ip string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.m[ip]
+	if n >= max {
+		return false
+	}
+	c.m[ip] = n + 1
+	return true
+}
+
+// release decrements the count for ip.
+func (c *ipCounter) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.m[ip] - 1
+	if n <= 0 {
+		c.m[ip] = 0, false
+	} else {
+		c.m[ip] = n
+	}
+}
+
+// remoteIP returns the IP address portion of the connection's remote address
+// or "" if the connection is not an IP connection.
+func remoteIP(conn net.Conn) string {
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); ok {
+		return ""
+	}
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// addStat adds delta to the server counter with the given key.
+func (s *Server) addStat(key string, delta int64) {
+	if s.Stats != nil {
+		s.Stats.AddInt(key, delta)
+	}
+}
+
+// maxRejecters is the maximum number of goroutines writing responses to
+// connections over a limit. Connections over a limit are closed without a
+// response when all rejecters are busy so that a connection flood does not
+// become a goroutine flood.
+const maxRejecters = 64
+
+// rejectTimeout is the timeout in nanoseconds for responding to a rejected
+// connection.
+const rejectTimeout = 1e9
+
+// rejectConnection responds to the connection with status 503 and closes the
+// connection. If too many connections are being rejected, then the
+// connection is closed without a response.
+func (s *Server) rejectConnection(conn net.Conn, reason string) {
+	s.addStat(StatRejectedConnections, 1)
+	select {
+	case s.rejecters <- true:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() {
+			conn.Close()
+			<-s.rejecters
+		}()
+		log.Println("twister: rejected connection from", conn.RemoteAddr(), reason)
+		conn.SetTimeout(rejectTimeout)
+		writeErrorResponse(conn, web.StatusServiceUnavailable)
+	}()
+}
@@ -0,0 +1,57 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func init() {
+	peerCredentials = linuxPeerCredentials
+}
+
+// linuxPeerCredentials gets the peer credentials using the SO_PEERCRED
+// socket option. The net package does not expose the connection's file
+// descriptor, so the option is read from the duplicate returned by File.
+// File puts the shared file description in blocking mode. Non-blocking mode
+// is restored before returning so that reads and writes on the connection
+// continue to use the network poller and honor timeouts.
+func linuxPeerCredentials(conn net.Conn) (*PeerCredentials, os.Error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil
+	}
+	// File returns a duplicate of the connection's file descriptor.
+	f, err := uc.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if e := syscall.SetNonblock(f.Fd(), true); e != 0 {
+		return nil, os.NewSyscallError("setnonblock", e)
+	}
+	var cred syscall.Ucred
+	n := uint32(syscall.SizeofUcred)
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(f.Fd()),
+		syscall.SOL_SOCKET, syscall.SO_PEERCRED,
+		uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&n)), 0)
+	if e != 0 {
+		return nil, os.NewSyscallError("getsockopt", int(e))
+	}
+	return &PeerCredentials{Pid: int(cred.Pid), Uid: int(cred.Uid), Gid: int(cred.Gid)}, nil
+}
@@ -0,0 +1,351 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrBadProxyHeader = os.NewError("twister.server: bad PROXY protocol header")
+
+// DefaultProxyHeaderTimeout is the header timeout in nanoseconds used by
+// NewProxyListener when the timeout is not positive.
+const DefaultProxyHeaderTimeout = 10e9
+
+// ProxyListener is a listener that reads the HAProxy PROXY protocol header
+// (http://haproxy.1wt.eu/download/1.5/doc/proxy-protocol.txt) from accepted
+// connections. The RemoteAddr and LocalAddr methods of the accepted
+// connections return the client and destination addresses from the header.
+// Versions 1 and 2 of the protocol are supported.
+//
+// The header is read in a separate goroutine for each connection so that a
+// slow client does not block the accept loop. Connections from addresses not
+// in the trusted networks and connections with a missing or malformed header
+// are closed.
+//
+// Example:
+//
+//  listener, err := net.Listen("tcp", ":8080")
+//  if err != nil {
+//      log.Fatal("Listen", err)
+//  }
+//  listener, err = server.NewProxyListener(listener, []string{"10.0.0.0/8"}, 5e9)
+//  if err != nil {
+//      log.Fatal("Listen", err)
+//  }
+//  err = (&server.Server{Listener: listener, Handler: handler}).Serve()
+type ProxyListener struct {
+	net.Listener
+	trusted       []*net.IPNet
+	headerTimeout int64
+	c             chan proxyAcceptResult
+	done          chan bool
+	closeOnce     sync.Once
+
+	// Protects pending and closed.
+	mu      sync.Mutex
+	pending map[net.Conn]bool
+	closed  bool
+}
+
+type proxyAcceptResult struct {
+	conn net.Conn
+	err  os.Error
+}
+
+// NewProxyListener returns a listener that reads the PROXY protocol header
+// from connections accepted on l. Connections are only accepted from the
+// networks in trustedCIDRs. If trustedCIDRs is empty, then connections are
+// accepted from all addresses. The header must be received within
+// headerTimeout nanoseconds. If headerTimeout is not positive, then
+// DefaultProxyHeaderTimeout is used.
+func NewProxyListener(l net.Listener, trustedCIDRs []string, headerTimeout int64) (*ProxyListener, os.Error) {
+	if headerTimeout <= 0 {
+		headerTimeout = DefaultProxyHeaderTimeout
+	}
+	pl := &ProxyListener{
+		Listener:      l,
+		headerTimeout: headerTimeout,
+		c:             make(chan proxyAcceptResult),
+		done:          make(chan bool),
+		pending:       make(map[net.Conn]bool),
+	}
+	for _, s := range trustedCIDRs {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		pl.trusted = append(pl.trusted, ipnet)
+	}
+	go pl.acceptLoop()
+	return pl, nil
+}
+
+// Accept waits for and returns the next connection with a valid PROXY
+// protocol header.
+func (l *ProxyListener) Accept() (net.Conn, os.Error) {
+	select {
+	case r := <-l.c:
+		return r.conn, r.err
+	case <-l.done:
+	}
+	return nil, os.EINVAL
+}
+
+// Close closes the underlying listener. Connections with a header read in
+// progress or waiting for a call to Accept are closed.
+func (l *ProxyListener) Close() os.Error {
+	var err os.Error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+		l.mu.Lock()
+		l.closed = true
+		for conn := range l.pending {
+			conn.Close()
+		}
+		l.pending = nil
+		l.mu.Unlock()
+	})
+	return err
+}
+
+// addPending records a connection with a header read in progress. It returns
+// false if the listener is closed.
+func (l *ProxyListener) addPending(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.pending[conn] = true
+	return true
+}
+
+func (l *ProxyListener) removePending(conn net.Conn) {
+	l.mu.Lock()
+	if !l.closed {
+		l.pending[conn] = false, false
+	}
+	l.mu.Unlock()
+}
+
+// send sends the result to Accept. The send is abandoned when the listener
+// is closed. The channel l.c is never closed because handshake goroutines may
+// send at any time.
+func (l *ProxyListener) send(r proxyAcceptResult) bool {
+	select {
+	case l.c <- r:
+		return true
+	case <-l.done:
+	}
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	return false
+}
+
+func (l *ProxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				if !l.send(proxyAcceptResult{nil, err}) {
+					return
+				}
+				continue
+			}
+			// Return the permanent error from all calls to Accept until
+			// the listener is closed.
+			for l.send(proxyAcceptResult{nil, err}) {
+			}
+			return
+		}
+		if !l.isTrusted(conn.RemoteAddr()) {
+			log.Println("twister: PROXY connection from untrusted address", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if !l.addPending(conn) {
+			conn.Close()
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *ProxyListener) isTrusted(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range l.trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *ProxyListener) handshake(conn net.Conn) {
+	conn.SetReadTimeout(l.headerTimeout)
+	br := bufio.NewReader(conn)
+	remoteAddr, localAddr, err := readProxyHeader(br)
+	l.removePending(conn)
+	if err != nil {
+		log.Println("twister: PROXY header from", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadTimeout(0)
+	pc := &proxyConn{Conn: conn, br: br, remoteAddr: conn.RemoteAddr(), localAddr: conn.LocalAddr()}
+	if remoteAddr != nil {
+		pc.remoteAddr = remoteAddr
+		pc.localAddr = localAddr
+	}
+	l.send(proxyAcceptResult{pc, nil})
+}
+
+// proxyConn is a connection with addresses from the PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	br         *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, os.Error) { return c.br.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr         { return c.remoteAddr }
+func (c *proxyConn) LocalAddr() net.Addr          { return c.localAddr }
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a version 1 or version 2 PROXY protocol header. Nil
+// addresses are returned if the header does not specify addresses.
+func readProxyHeader(br *bufio.Reader) (remoteAddr, localAddr net.Addr, err os.Error) {
+	// Peek enough bytes to check for the version 2 signature. The version
+	// 1 header is longer than the signature.
+	p, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.Equal(p, proxyV2Signature):
+		return readProxyHeaderV2(br)
+	case bytes.HasPrefix(p, []byte("PROXY ")):
+		return readProxyHeaderV1(br)
+	}
+	return nil, nil, ErrBadProxyHeader
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (remoteAddr, localAddr net.Addr, err os.Error) {
+	// The maximum line length is 107 bytes including the CRLF.
+	var line []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, nil, ErrBadProxyHeader
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, nil, ErrBadProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ", -1)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrBadProxyHeader
+	}
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	srcPort, err1 := strconv.Atoui(fields[4])
+	dstPort, err2 := strconv.Atoui(fields[5])
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil || srcPort > 65535 || dstPort > 65535 {
+		return nil, nil, ErrBadProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (remoteAddr, localAddr net.Addr, err os.Error) {
+	// signature, version and command, family and protocol, length
+	var fixed [16]byte
+	if _, err := io.ReadFull(br, fixed[:]); err != nil {
+		return nil, nil, err
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, nil, ErrBadProxyHeader
+	}
+	command := fixed[12] & 0xf
+	family := fixed[13]
+	p := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(br, p); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0:
+		// LOCAL: connection established by the proxy for health checks.
+		return nil, nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, nil, ErrBadProxyHeader
+	}
+
+	var n int
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		n = net.IPv4len
+	case 0x21:
+		// TCP over IPv6
+		n = net.IPv6len
+	default:
+		// Unspecified or unsupported family. Use the connection addresses.
+		return nil, nil, nil
+	}
+	if len(p) < 2*n+4 {
+		return nil, nil, ErrBadProxyHeader
+	}
+	srcIP := net.IP(p[:n])
+	dstIP := net.IP(p[n : 2*n])
+	srcPort := int(binary.BigEndian.Uint16(p[2*n:]))
+	dstPort := int(binary.BigEndian.Uint16(p[2*n+2:]))
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
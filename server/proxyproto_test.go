@@ -0,0 +1,213 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var proxyHeaderTests = []struct {
+	in     string
+	remote string
+	local  string
+	rest   string
+	err    bool
+}{
+	{
+		in:     "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET /",
+		remote: "192.168.0.1:56324",
+		local:  "192.168.0.11:443",
+		rest:   "GET /",
+	},
+	{
+		in:     "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET /",
+		remote: "[2001:db8::1]:56324",
+		local:  "[2001:db8::2]:443",
+		rest:   "GET /",
+	},
+	{
+		in:   "PROXY UNKNOWN\r\nGET /",
+		rest: "GET /",
+	},
+	{
+		in:  "PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\nGET /",
+		err: true,
+	},
+	{
+		in:  "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\nGET /",
+		err: true,
+	},
+	{
+		in:  "GET / HTTP/1.1\r\n\r\n",
+		err: true,
+	},
+	{
+		in: "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+			"\xc0\xa8\x00\x01\xc0\xa8\x00\x0b\xdc\x04\x01\xbbGET /",
+		remote: "192.168.0.1:56324",
+		local:  "192.168.0.11:443",
+		rest:   "GET /",
+	},
+	{
+		// LOCAL command
+		in:   "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00GET /",
+		rest: "GET /",
+	},
+	{
+		// Bad version
+		in:  "\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x0c" + "\xc0\xa8\x00\x01\xc0\xa8\x00\x0b\xdc\x04\x01\xbbGET /",
+		err: true,
+	},
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tt := range proxyHeaderTests {
+		br := bufio.NewReader(bytes.NewBufferString(tt.in))
+		remote, local, err := readProxyHeader(br)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q, expected error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q, unexpected error %v", tt.in, err)
+			continue
+		}
+		if tt.remote == "" {
+			if remote != nil || local != nil {
+				t.Errorf("%q, got addresses %v %v, want none", tt.in, remote, local)
+			}
+		} else {
+			if remote == nil || remote.String() != tt.remote {
+				t.Errorf("%q, remote = %v, want %s", tt.in, remote, tt.remote)
+			}
+			if local == nil || local.String() != tt.local {
+				t.Errorf("%q, local = %v, want %s", tt.in, local, tt.local)
+			}
+		}
+		rest, _ := ioutil.ReadAll(br)
+		if string(rest) != tt.rest {
+			t.Errorf("%q, rest = %q, want %q", tt.in, rest, tt.rest)
+		}
+	}
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	l, err := NewProxyListener(&testListener{errs: []os.Error{os.EINVAL}}, []string{"10.0.0.0/8", "2001:db8::/32"}, 0)
+	if err != nil {
+		t.Fatal("NewProxyListener", err)
+	}
+	defer l.Close()
+	tests := []struct {
+		addr    net.Addr
+		trusted bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1234}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db9::1"), Port: 1234}, false},
+		{testAddr("bad"), false},
+	}
+	for _, tt := range tests {
+		if trusted := l.isTrusted(tt.addr); trusted != tt.trusted {
+			t.Errorf("isTrusted(%v) = %v, want %v", tt.addr, trusted, tt.trusted)
+		}
+	}
+
+	// Connections from untrusted addresses are closed without reading the
+	// header.
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	l, err = NewProxyListener(nl, []string{"10.0.0.0/8"}, 0)
+	if err != nil {
+		t.Fatal("NewProxyListener", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", nl.Addr().String())
+	if err != nil {
+		t.Fatal("Dial", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")
+	c.SetReadTimeout(5e9)
+	if _, err := c.Read(make([]byte, 1)); err != os.EOF {
+		t.Errorf("read from untrusted connection returned %v, want EOF", err)
+	}
+}
+
+func TestProxyListenerClose(t *testing.T) {
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	l, err := NewProxyListener(nl, nil, 0)
+	if err != nil {
+		t.Fatal("NewProxyListener", err)
+	}
+	if l.headerTimeout != DefaultProxyHeaderTimeout {
+		t.Errorf("headerTimeout = %d, want %d", l.headerTimeout, DefaultProxyHeaderTimeout)
+	}
+
+	// The client stalls in the middle of the header and never finishes.
+	partial, err := net.Dial("tcp", nl.Addr().String())
+	if err != nil {
+		t.Fatal("Dial", err)
+	}
+	defer partial.Close()
+	io.WriteString(partial, "PROXY TCP4")
+	for i := 0; ; i++ {
+		l.mu.Lock()
+		n := len(l.pending)
+		l.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if i > 500 {
+			t.Fatal("header read not started")
+		}
+		time.Sleep(1e7)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal("Close", err)
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("Accept after Close succeeded")
+	}
+	l.Close()
+
+	// Close interrupts the header read. The read deadline is shorter than
+	// the header timeout, so a timeout here means the connection was not
+	// closed.
+	partial.SetReadTimeout(5e9)
+	if _, err := partial.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("read after Close returned %v, want closed connection", err)
+	}
+	l.mu.Lock()
+	if l.pending != nil {
+		t.Errorf("pending = %v after Close, want nil", l.pending)
+	}
+	l.mu.Unlock()
+}
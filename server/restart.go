@@ -0,0 +1,232 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"exec"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The first inherited file descriptor. Descriptors 0, 1 and 2 are stdin,
+// stdout and stderr.
+const listenFdsStart = 3
+
+// Environment variables used to pass state from a parent process to a child
+// process started by Restart.
+const (
+	envListenFds = "TWISTER_LISTEN_FDS"
+	envReadyFd   = "TWISTER_READY_FD"
+)
+
+var ErrRestartTimeout = os.NewError("twister.server: timeout waiting for restarted process")
+
+// InheritedListeners returns the listeners passed to the process by systemd
+// socket activation (the LISTEN_FDS and LISTEN_PID environment variables) or
+// by a parent process calling Restart. The listeners are returned in the
+// order of the file descriptors. InheritedListeners returns an empty slice if
+// no listeners were passed to the process.
+//
+// The environment variables are cleared so that the listeners are not
+// inherited by child processes.
+func InheritedListeners() ([]net.Listener, os.Error) {
+	var n int
+	if s := os.Getenv("LISTEN_FDS"); s != "" {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			// The descriptors are intended for another process.
+			return nil, nil
+		}
+		n, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, os.NewError("twister.server: bad LISTEN_FDS " + s)
+		}
+		os.Setenv("LISTEN_FDS", "")
+		os.Setenv("LISTEN_PID", "")
+	} else if s := os.Getenv(envListenFds); s != "" {
+		var err os.Error
+		n, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, os.NewError("twister.server: bad " + envListenFds + " " + s)
+		}
+		os.Setenv(envListenFds, "")
+	}
+
+	listeners := make([]net.Listener, n)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		f := os.NewFile(fd, "listener"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners[:i] {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners[i] = l
+	}
+	return listeners, nil
+}
+
+// Ready notifies the parent process that the process is ready to accept
+// connections on the inherited listeners. Ready does nothing if the process
+// was not started by Restart.
+func Ready() os.Error {
+	s := os.Getenv(envReadyFd)
+	if s == "" {
+		return nil
+	}
+	os.Setenv(envReadyFd, "")
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return os.NewError("twister.server: bad " + envReadyFd + " " + s)
+	}
+	f := os.NewFile(fd, "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{0})
+	return err
+}
+
+// fileListener is implemented by listeners that can return a copy of the
+// underlying file descriptor.
+type fileListener interface {
+	File() (*os.File, os.Error)
+}
+
+// Restart starts a new copy of the current executable with the same arguments
+// and passes the listeners to the new process. The new process obtains the
+// listeners by calling InheritedListeners and calls Ready when it is serving
+// requests. Restart waits up to timeout nanoseconds for the new process to
+// call Ready.
+//
+// After Restart returns successfully, the current process should stop
+// accepting connections and drain the connections in progress by calling the
+// Shutdown method on its servers. Because the listening sockets are shared by
+// the processes, no connections are refused during the restart.
+//
+// Example:
+//
+//  func main() {
+//      listeners, err := server.InheritedListeners()
+//      if err != nil {
+//          log.Fatal("InheritedListeners", err)
+//      }
+//      var listener net.Listener
+//      if len(listeners) > 0 {
+//          listener = listeners[0]
+//      } else if listener, err = net.Listen("tcp", ":8080"); err != nil {
+//          log.Fatal("Listen", err)
+//      }
+//      s := &server.Server{Listener: listener, Handler: handler}
+//      go func() {
+//          for sig := range signal.Incoming {
+//              if sig.(os.UnixSignal) == os.SIGHUP {
+//                  if _, err := server.Restart([]net.Listener{listener}, 10e9); err != nil {
+//                      log.Println("Restart", err)
+//                      continue
+//                  }
+//                  s.Shutdown()
+//              }
+//          }
+//      }()
+//      server.Ready()
+//      if err := s.Serve(); err != nil {
+//          log.Fatal("Serve", err)
+//      }
+//  }
+func Restart(listeners []net.Listener, timeout int64) (*os.Process, os.Error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	defer func() {
+		for _, f := range files[listenFdsStart:] {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(fileListener)
+		if !ok {
+			return nil, os.NewError("twister.server: cannot get file for listener")
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	var env []string
+	for _, kv := range os.Environ() {
+		switch {
+		case hasEnvPrefix(kv, "LISTEN_FDS"), hasEnvPrefix(kv, "LISTEN_PID"),
+			hasEnvPrefix(kv, envListenFds), hasEnvPrefix(kv, envReadyFd):
+			// skip
+		default:
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		envListenFds+"="+strconv.Itoa(len(listeners)),
+		envReadyFd+"="+strconv.Itoa(len(files)-1))
+
+	p, err := os.StartProcess(path, os.Args, &os.ProcAttr{Dir: dir, Env: env, Files: files})
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the parent's copy of the write end of the pipe so that the read
+	// below returns if the child exits without calling Ready.
+	w.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan os.Error, 1)
+	go func() {
+		var b [1]byte
+		_, err := r.Read(b[:])
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = ErrRestartTimeout
+	}
+	if err != nil {
+		p.Kill()
+		return nil, err
+	}
+	return p, nil
+}
+
+func hasEnvPrefix(kv, name string) bool {
+	return len(kv) > len(name) && kv[:len(name)] == name && kv[len(name)] == '='
+}
@@ -0,0 +1,180 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The tests for Restart run a copy of the test binary. The environment
+// variable envRestartTest selects the behavior of the copy.
+const envRestartTest = "TWISTER_RESTART_TEST"
+
+func init() {
+	switch os.Getenv(envRestartTest) {
+	case "":
+		return
+	case "serve":
+		// Serve one connection on the inherited listener.
+		listeners, err := InheritedListeners()
+		if err != nil || len(listeners) != 1 {
+			os.Exit(1)
+		}
+		if err := Ready(); err != nil {
+			os.Exit(1)
+		}
+		if c, err := listeners[0].Accept(); err == nil {
+			io.WriteString(c, "child")
+			c.Close()
+		}
+	case "hang":
+		// Never call Ready.
+		time.Sleep(60e9)
+	}
+	os.Exit(0)
+}
+
+func TestInheritedListenersEnv(t *testing.T) {
+	defer func() {
+		os.Setenv("LISTEN_FDS", "")
+		os.Setenv("LISTEN_PID", "")
+		os.Setenv(envListenFds, "")
+	}()
+
+	// Descriptors for another process are ignored and left in the
+	// environment.
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	if l, err := InheritedListeners(); l != nil || err != nil {
+		t.Errorf("wrong pid: InheritedListeners() = %v, %v; want nil, nil", l, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Error("wrong pid: LISTEN_FDS cleared")
+	}
+
+	os.Setenv("LISTEN_PID", "x")
+	if l, err := InheritedListeners(); l != nil || err != nil {
+		t.Errorf("bad pid: InheritedListeners() = %v, %v; want nil, nil", l, err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "x")
+	if _, err := InheritedListeners(); err == nil {
+		t.Error("bad LISTEN_FDS: no error")
+	}
+
+	os.Setenv("LISTEN_FDS", "0")
+	if l, err := InheritedListeners(); len(l) != 0 || err != nil {
+		t.Errorf("zero LISTEN_FDS: InheritedListeners() = %v, %v; want empty", l, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" || os.Getenv("LISTEN_PID") != "" {
+		t.Error("LISTEN_FDS and LISTEN_PID not cleared")
+	}
+
+	os.Setenv(envListenFds, "x")
+	if _, err := InheritedListeners(); err == nil {
+		t.Errorf("bad %s: no error", envListenFds)
+	}
+
+	if l, err := InheritedListeners(); len(l) != 0 || err != nil {
+		t.Errorf("no environment: InheritedListeners() = %v, %v; want empty", l, err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	defer os.Setenv(envReadyFd, "")
+
+	if err := Ready(); err != nil {
+		t.Errorf("Ready() without parent = %v", err)
+	}
+
+	os.Setenv(envReadyFd, "x")
+	if err := Ready(); err == nil {
+		t.Error("Ready() with bad descriptor did not return error")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("Pipe", err)
+	}
+	defer r.Close()
+	os.Setenv(envReadyFd, strconv.Itoa(w.Fd()))
+	// Ready closes the descriptor.
+	if err := Ready(); err != nil {
+		t.Fatal("Ready", err)
+	}
+	p, err := ioutil.ReadAll(r)
+	if err != nil || len(p) != 1 {
+		t.Errorf("read from ready pipe returned %q, %v; want one byte", p, err)
+	}
+	if os.Getenv(envReadyFd) != "" {
+		t.Errorf("%s not cleared", envReadyFd)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	addr := l.Addr().String()
+
+	os.Setenv(envRestartTest, "serve")
+	p, err := Restart([]net.Listener{l}, 10e9)
+	os.Setenv(envRestartTest, "")
+	if err != nil {
+		l.Close()
+		t.Fatal("Restart", err)
+	}
+
+	// Stop accepting in the parent. The child accepts on the shared socket.
+	l.Close()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		p.Kill()
+		t.Fatal("Dial", err)
+	}
+	c.SetReadTimeout(10e9)
+	b, err := ioutil.ReadAll(c)
+	c.Close()
+	if string(b) != "child" {
+		t.Errorf("response = %q, %v; want child", b, err)
+	}
+	p.Wait(0)
+}
+
+func TestRestartTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	defer l.Close()
+
+	os.Setenv(envRestartTest, "hang")
+	p, err := Restart([]net.Listener{l}, 5e8)
+	os.Setenv(envRestartTest, "")
+	if err != ErrRestartTimeout {
+		t.Errorf("Restart() = %v, %v; want ErrRestartTimeout", p, err)
+	}
+	if p != nil {
+		p.Kill()
+	}
+}
@@ -18,6 +18,8 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"github.com/garyburd/twister/expvar"
 	"github.com/garyburd/twister/web"
 	"http"
 	"io"
@@ -37,14 +39,19 @@ var (
 // Server defines parameters for running an HTTP server.
 type Server struct {
 	// The server accepts incoming connections on this listener. The
-	// application is required to set this field.
+	// application is required to set this field or the Listeners field.
 	Listener net.Listener
 
+	// Additional listeners with per-listener settings. The server accepts
+	// connections on these listeners and on Listener if Listener is not nil.
+	Listeners []*ListenerConfig
+
 	// The server dispatches requests to this handler. The application is
 	// required to set this field.
 	Handler web.Handler
 
-	// If true, then set the request URL protocol to HTTPS.
+	// If true, then set the request URL protocol to HTTPS. The protocol is
+	// also set to HTTPS for connections from a TLSListener.
 	Secure bool
 
 	// Set request URL host to this string if host is not specified in the
@@ -57,11 +64,78 @@ type Server struct {
 	// The net.Conn.SetWriteTimeout value for new connections.
 	WriteTimeout int64
 
+	// Maximum time in nanoseconds to read the request line and headers. The
+	// time is measured from the arrival of the first byte of the request or
+	// from the time the connection is accepted for the first request on a
+	// connection. If the time is exceeded, then the server responds with
+	// status 408 and closes the connection. Zero means no limit.
+	HeaderReadTimeout int64
+
+	// Maximum time in nanoseconds to read the request body. The time is
+	// measured from the end of the request headers. Zero means no limit.
+	BodyReadTimeout int64
+
+	// Maximum time in nanoseconds to wait for the next request on a
+	// keep-alive connection. Zero means no limit.
+	IdleTimeout int64
+
+	// Maximum time in nanoseconds to write the response. The time is
+	// measured from the call to Respond. Zero means no limit.
+	ResponseWriteTimeout int64
+
+	// Maximum size in bytes of the request line and headers. If the size is
+	// exceeded, then the server responds with status 431 and closes the
+	// connection. If zero, then web.DefaultMaxHeaderBytes is used.
+	MaxHeaderBytes int
+
+	// Maximum number of concurrent connections. If the limit is reached,
+	// then the server stops accepting connections until a connection is
+	// closed or, if RejectOverLimit is true, responds to new connections with
+	// status 503. Zero means no limit.
+	MaxConnections int
+
+	// If true, then respond to connections over the MaxConnections limit with
+	// status 503 instead of waiting for a connection to close.
+	RejectOverLimit bool
+
+	// Maximum number of concurrent connections from a single remote IP
+	// address. Connections over the limit are sent a response with status 503.
+	// Zero means no limit.
+	MaxConnectionsPerIP int
+
+	// Maximum number of requests served on a keep-alive connection. Zero
+	// means no limit.
+	MaxRequestsPerConnection int
+
+	// If not nil, then the server updates the counters with the Stat* keys in
+	// this map. Use expvar.NewMap to create a published map.
+	Stats *expvar.Map
+
 	// Log the request.
 	Logger Logger
 
 	// If true, do not recover from handler panics.
 	NoRecoverHandlers bool
+
+	connState connState
+	rejecters chan bool
+}
+
+// ListenerConfig specifies a listener and the settings for connections
+// accepted on the listener.
+type ListenerConfig struct {
+	// The server accepts incoming connections on this listener.
+	Listener net.Listener
+
+	// If true, then set the request URL protocol to HTTPS. Requests are also
+	// secure if Server.Secure is true.
+	Secure bool
+
+	// If not "", then override Server.DefaultHost for this listener.
+	DefaultHost string
+
+	// If not nil, then override Server.Handler for this listener.
+	Handler web.Handler
 }
 
 // Logger defines an interface for logging a request.
@@ -78,7 +152,10 @@ func (f LoggerFunc) Log(lr *LogRecord) { f(lr) }
 // transaction represents a single request-response transaction.
 type transaction struct {
 	server             *Server
-	conn               net.Conn
+	listener           *ListenerConfig
+	peerCred           *peerCredState
+	conn               *deadlineConn
+	tlsState           *tls.ConnectionState
 	br                 *bufio.Reader
 	responseBody       responseBody
 	chunkedResponse    bool
@@ -99,7 +176,7 @@ type transaction struct {
 
 var requestLineRegexp = regexp.MustCompile("^([_A-Za-z0-9]+) ([^ ]+) HTTP/([0-9]+)\\.([0-9]+)[\r\n ]+$")
 
-func readRequestLine(b *bufio.Reader) (method string, url string, version int, err os.Error) {
+func readRequestLine(b *bufio.Reader) (method string, url string, version int, n int, err os.Error) {
 
 	p, err := b.ReadSlice('\n')
 	if err != nil {
@@ -108,6 +185,7 @@ func readRequestLine(b *bufio.Reader) (method string, url string, version int, e
 		}
 		return
 	}
+	n = len(p)
 
 	m := requestLineRegexp.FindSubmatch(p)
 	if m == nil {
@@ -135,13 +213,21 @@ func readRequestLine(b *bufio.Reader) (method string, url string, version int, e
 }
 
 func (t *transaction) prepare() (err os.Error) {
-	method, rawURL, version, err := readRequestLine(t.br)
+	method, rawURL, version, n, err := readRequestLine(t.br)
 	if err != nil {
 		return err
 	}
 
+	maxHeaderBytes := t.server.MaxHeaderBytes
+	if maxHeaderBytes == 0 {
+		maxHeaderBytes = web.DefaultMaxHeaderBytes
+	}
+	if n > maxHeaderBytes {
+		return web.ErrHeaderTooLarge
+	}
+
 	header := web.Header{}
-	err = header.ParseHttpHeader(t.br)
+	err = header.ParseHttpHeaderLimit(t.br, maxHeaderBytes-n)
 	if err != nil {
 		return err
 	}
@@ -153,22 +239,29 @@ func (t *transaction) prepare() (err os.Error) {
 
 	if url.Host == "" {
 		url.Host = header.Get(web.HeaderHost)
+		if url.Host == "" {
+			url.Host = t.listener.DefaultHost
+		}
 		if url.Host == "" {
 			url.Host = t.server.DefaultHost
 		}
 	}
 
-	if t.server.Secure {
+	if t.server.Secure || t.listener.Secure || t.tlsState != nil {
 		url.Scheme = "https"
 	} else {
 		url.Scheme = "http"
 	}
 
-	req, err := web.NewRequest(t.conn.RemoteAddr().String(), method, url, version, header)
+	req, err := web.NewRequest(remoteAddrString(t.conn), method, url, version, header)
 	if err != nil {
 		return
 	}
 	t.req = req
+	req.TLS = t.tlsState
+	if cred := t.peerCred; cred != nil {
+		req.Env["twister.server.PeerCredentials"] = PeerCredentialsFunc(func() (*PeerCredentials, os.Error) { return cred.get() })
+	}
 
 	if s := req.Header.Get(web.HeaderExpect); s != "" {
 		t.write100Continue = strings.ToLower(s) == "100-continue"
@@ -239,6 +332,9 @@ func (t identityReader) Read(p []byte) (int, os.Error) {
 	if t.requestAvail == 0 {
 		t.requestConsumed = true
 	}
+	if isTimeout(t.requestErr) {
+		t.logTimeout("request body read")
+	}
 	return n, t.requestErr
 }
 
@@ -253,6 +349,9 @@ func (t chunkedReader) Read(p []byte) (n int, err os.Error) {
 		// we don't read the body until 100-continue is send (if needed).
 		t.requestAvail, t.requestErr = readChunkFraming(t.br, true)
 		if t.requestErr != nil {
+			if isTimeout(t.requestErr) {
+				t.logTimeout("request body read")
+			}
 			return 0, t.requestErr
 			if t.requestErr == os.EOF {
 				t.requestConsumed = true
@@ -274,6 +373,9 @@ func (t chunkedReader) Read(p []byte) (n int, err os.Error) {
 			t.requestConsumed = true
 		}
 	}
+	if isTimeout(err) {
+		t.logTimeout("request body read")
+	}
 	return n, err
 }
 
@@ -331,6 +433,7 @@ func (t *transaction) Respond(status int, header web.Header) (body io.Writer) {
 	t.requestErr = web.ErrInvalidState
 	t.status = status
 	t.header = header
+	t.conn.setWriteDeadline(t.server.ResponseWriteTimeout)
 
 	if te := header.Get(web.HeaderTransferEncoding); te != "" {
 		log.Println("twister: transfer encoding not allowed")
@@ -402,7 +505,12 @@ func (t *transaction) Hijack() (conn net.Conn, br *bufio.Reader, err os.Error) {
 		return nil, nil, web.ErrInvalidState
 	}
 
-	conn = t.conn
+	// Restore the timeouts set on connections by the server.
+	t.conn.setReadDeadline(0)
+	t.conn.setWriteDeadline(0)
+	t.conn.Conn.SetReadTimeout(t.server.ReadTimeout)
+	t.conn.Conn.SetWriteTimeout(t.server.WriteTimeout)
+	conn = t.conn.Conn
 	br = t.br
 
 	if t.server.Logger != nil {
@@ -437,7 +545,11 @@ func (t *transaction) invokeHandler() {
 			}
 		}()
 	}
-	t.server.Handler.ServeWeb(t.req)
+	if t.listener.Handler != nil {
+		t.listener.Handler.ServeWeb(t.req)
+	} else {
+		t.server.Handler.ServeWeb(t.req)
+	}
 }
 
 // Finish the HTTP request
@@ -455,6 +567,9 @@ func (t *transaction) finish() os.Error {
 	}
 	if t.responseErr != nil {
 		t.closeAfterResponse = true
+		if isTimeout(t.responseErr) {
+			t.logTimeout("response write")
+		}
 	} else {
 		t.responseErr = web.ErrInvalidState
 	}
@@ -474,32 +589,119 @@ func (t *transaction) finish() os.Error {
 			Status:     t.status,
 			Error:      err})
 	}
+	t.conn.setWriteDeadline(0)
 	t.conn = nil
 	t.br = nil
 	t.responseBody = nil
 	return nil
 }
 
-func (s *Server) serveConnection(conn net.Conn) {
-	defer conn.Close()
-	if s.ReadTimeout != 0 {
-		conn.SetReadTimeout(s.ReadTimeout)
+// logTimeout logs the expiration of a deadline while serving the request.
+func (t *transaction) logTimeout(what string) {
+	url := "unknown"
+	if t.req != nil && t.req.URL != nil {
+		url = t.req.URL.String()
+	}
+	log.Printf("twister: %s timeout from %s while serving %s", what, t.conn.RemoteAddr(), url)
+}
+
+// writeErrorResponse writes a minimal response with the given status to a
+// connection that the server is about to close.
+func writeErrorResponse(w io.Writer, status int) {
+	text := web.StatusText(status)
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 ")
+	b.WriteString(strconv.Itoa(status))
+	b.WriteString(" ")
+	b.WriteString(text)
+	b.WriteString("\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: ")
+	b.WriteString(strconv.Itoa(len(text)))
+	b.WriteString("\r\n\r\n")
+	b.WriteString(text)
+	w.Write(b.Bytes())
+}
+
+// prepareFailed handles an error reading the request line and headers.
+func (s *Server) prepareFailed(conn net.Conn, err os.Error) {
+	switch {
+	case err == os.EOF:
+		// Client closed the connection.
+	case isTimeout(err):
+		log.Println("twister: request header read timeout from", conn.RemoteAddr())
+		writeErrorResponse(conn, web.StatusRequestTimeout)
+	case err == web.ErrHeaderTooLarge ||
+		err == web.ErrLineTooLong ||
+		err == web.ErrHeaderTooLong ||
+		err == web.ErrHeadersTooLong:
+		log.Println("twister: request header too large from", conn.RemoteAddr(), err)
+		writeErrorResponse(conn, web.StatusRequestHeaderFieldsTooLarge)
+	default:
+		log.Println("twister: prepare failed", err)
+	}
+}
+
+func (s *Server) serveConnection(rawConn net.Conn, lc *ListenerConfig) {
+	defer rawConn.Close()
+	conn := &deadlineConn{
+		Conn:         rawConn,
+		readTimeout:  s.ReadTimeout,
+		writeTimeout: s.WriteTimeout,
 	}
-	if s.WriteTimeout != 0 {
-		conn.SetWriteTimeout(s.WriteTimeout)
+	var peerCred *peerCredState
+	if _, ok := rawConn.(*net.UnixConn); ok {
+		peerCred = &peerCredState{conn: rawConn}
 	}
 	br := bufio.NewReader(conn)
-	for {
+	var tlsState *tls.ConnectionState
+	for n := 1; ; n++ {
+		first := n == 1
+
+		// Wait for the first byte of the request. The header read timeout
+		// for the first request on the connection includes the wait.
+		if s.connState.setIdle(rawConn, true) {
+			break
+		}
+		if first {
+			conn.setReadDeadline(s.HeaderReadTimeout)
+		} else {
+			conn.setReadDeadline(s.IdleTimeout)
+		}
+		if _, err := br.Peek(1); err != nil {
+			if isTimeout(err) {
+				if first {
+					s.prepareFailed(conn, err)
+				} else {
+					log.Println("twister: idle timeout from", conn.RemoteAddr())
+				}
+			}
+			break
+		}
+		shuttingDown := s.connState.setIdle(rawConn, false)
+		if !first {
+			conn.setReadDeadline(s.HeaderReadTimeout)
+		} else if tc, ok := rawConn.(*tls.Conn); ok {
+			// The handshake is complete after the first read.
+			state := tc.ConnectionState()
+			tlsState = &state
+		}
+
 		t := &transaction{
-			server: s,
-			conn:   conn,
-			br:     br}
+			server:   s,
+			listener: lc,
+			peerCred: peerCred,
+			conn:     conn,
+			tlsState: tlsState,
+			br:       br}
 		if err := t.prepare(); err != nil {
-			if err != os.EOF {
-				log.Println("twister: prepare failed", err)
-			}
+			s.prepareFailed(conn, err)
 			break
 		}
+		conn.setReadDeadline(s.BodyReadTimeout)
+		s.addStat(StatRequests, 1)
+
+		if shuttingDown || (s.MaxRequestsPerConnection > 0 && n >= s.MaxRequestsPerConnection) {
+			t.closeAfterResponse = true
+		}
 
 		t.invokeHandler()
 		if t.hijacked {
@@ -515,9 +717,11 @@ func (s *Server) serveConnection(conn net.Conn) {
 	}
 }
 
-// Serve accepts incoming HTTP connections on s.Listener, creating a new
-// goroutine for each. The goroutines read requests and then call s.Handler to
-// respond to the request.
+// Serve accepts incoming HTTP connections on s.Listener and s.Listeners,
+// creating a new goroutine for each. The goroutines read requests and then
+// call s.Handler or the listener's handler to respond to the request. If
+// accept fails on any listener, then Serve closes all of the listeners and
+// returns the error.
 //
 // The "Hello World" server using Serve() is:
 //
@@ -549,24 +753,121 @@ func (s *Server) serveConnection(conn net.Conn) {
 //      }
 //  }
 func (s *Server) Serve() os.Error {
+	listeners := s.Listeners
+	if s.Listener != nil {
+		listeners = append([]*ListenerConfig{&ListenerConfig{Listener: s.Listener}}, listeners...)
+	}
+	if len(listeners) == 0 {
+		return os.NewError("twister.server: no listeners")
+	}
+
+	var sem chan bool
+	if s.MaxConnections > 0 {
+		sem = make(chan bool, s.MaxConnections)
+	}
+	var ipc *ipCounter
+	if s.MaxConnectionsPerIP > 0 {
+		ipc = newIPCounter()
+	}
+	s.rejecters = make(chan bool, maxRejecters)
+
+	if len(listeners) == 1 {
+		return s.serveListener(listeners[0], sem, ipc)
+	}
+
+	// Serve each listener in a separate goroutine. If accept fails on one
+	// listener, then close the other listeners and return the first error.
+	errs := make(chan os.Error, len(listeners))
+	for _, lc := range listeners {
+		go func(lc *ListenerConfig) {
+			errs <- s.serveListener(lc, sem, ipc)
+		}(lc)
+	}
+	var err os.Error
+	for i := 0; i < len(listeners); i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			for _, lc := range listeners {
+				lc.Listener.Close()
+			}
+		}
+	}
+	return err
+}
+
+// serveListener accepts connections on a single listener. The connection
+// limits are shared by all of the server's listeners.
+func (s *Server) serveListener(lc *ListenerConfig, sem chan bool, ipc *ipCounter) os.Error {
 	for {
-		conn, e := s.Listener.Accept()
+		if sem != nil && !s.RejectOverLimit {
+			// Wait for a slot before accepting the connection.
+			sem <- true
+		}
+		conn, e := lc.Listener.Accept()
 		if e != nil {
+			if s.connState.isShuttingDown() {
+				return nil
+			}
+			if sem != nil && !s.RejectOverLimit {
+				<-sem
+			}
 			if e, ok := e.(net.Error); ok && e.Temporary() {
 				log.Printf("twister.server: accept error %v", e)
 				continue
 			}
 			return e
 		}
-		go s.serveConnection(conn)
+		s.addStat(StatAcceptedConnections, 1)
+		if sem != nil && s.RejectOverLimit {
+			select {
+			case sem <- true:
+			default:
+				s.rejectConnection(conn, "over connection limit")
+				continue
+			}
+		}
+		ip := ""
+		if ipc != nil {
+			ip = remoteIP(conn)
+			if ip != "" && !ipc.acquire(ip, s.MaxConnectionsPerIP) {
+				if sem != nil {
+					<-sem
+				}
+				s.rejectConnection(conn, "over per-IP connection limit")
+				continue
+			}
+		}
+		if !s.connState.add(conn) {
+			conn.Close()
+			return nil
+		}
+		go func(conn net.Conn, ip string) {
+			s.addStat(StatActiveConnections, 1)
+			defer func() {
+				s.connState.remove(conn)
+				s.addStat(StatActiveConnections, -1)
+				if ip != "" {
+					ipc.release(ip)
+				}
+				if sem != nil {
+					<-sem
+				}
+			}()
+			s.serveConnection(conn, lc)
+		}(conn, ip)
 	}
 	return nil
 }
 
 // Run is a convenience function for running an HTTP server. Run listens on the
-// TCP address addr, initializes a server object and calls the server's Serve()
-// method to handle HTTP requests. Run logs a fatal error if it encounters an
-// error.
+// TCP address addr or, if addr has the prefix "unix:", on the Unix domain
+// socket with the path following the prefix. Run then initializes a server
+// object and calls the server's Serve() method to handle HTTP requests. Run
+// logs a fatal error if it encounters an error.
+//
+// If the process inherited listeners from systemd socket activation or from a
+// parent process calling Restart, then Run serves the first inherited
+// listener instead of listening on addr.
 //
 // The Server object is initialized with the handler argument and listener. If
 // the application needs to set any other Server fields or if the application
@@ -593,12 +894,29 @@ func (s *Server) Serve() os.Error {
 //  }
 //
 func Run(addr string, handler web.Handler) {
-	listener, err := net.Listen("tcp", addr)
+	listeners, err := InheritedListeners()
 	if err != nil {
-		log.Fatal("Listen", err)
+		log.Fatal("InheritedListeners", err)
 		return
 	}
+	var listener net.Listener
+	if len(listeners) > 0 {
+		listener = listeners[0]
+	} else {
+		if strings.HasPrefix(addr, "unix:") {
+			listener, err = ListenUnix(addr[len("unix:"):], 0666)
+		} else {
+			listener, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			log.Fatal("Listen", err)
+			return
+		}
+	}
 	defer listener.Close()
+	if err := Ready(); err != nil {
+		log.Println("twister: ready notification failed", err)
+	}
 	err = (&Server{Logger: LoggerFunc(ShortLogger), Listener: listener, Handler: handler}).Serve()
 	if err != nil {
 		log.Fatal("Server", err)
@@ -16,11 +16,24 @@ package server
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/garyburd/twister/expvar"
 	"github.com/garyburd/twister/web"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 )
 
 type testAddr string
@@ -261,3 +274,445 @@ func TestServer(t *testing.T) {
 		}
 	}
 }
+
+var serverLimitTests = []struct {
+	server Server
+	in     string
+	out    string
+}{
+	{
+		// Header larger than limit.
+		server: Server{MaxHeaderBytes: 40},
+		in:     "GET / HTTP/1.1\r\nUser-Agent: 0123456789abcdef\r\n\r\n",
+		out:    "HTTP/1.1 431 Request Header Fields Too Large\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 31\r\n\r\nRequest Header Fields Too Large",
+	},
+	{
+		// Header within limit.
+		server: Server{MaxHeaderBytes: 64},
+		in:     "GET /?cl=5&w=Hello HTTP/1.1\r\nUser-Agent: 0123456789abcdef\r\n\r\n",
+		out:    "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHello",
+	},
+	{
+		// Header read timeout expires before the request is read.
+		server: Server{HeaderReadTimeout: 1},
+		in:     "GET / HTTP/1.1\r\n\r\n",
+		out:    "HTTP/1.1 408 Request Timeout\r\nConnection: close\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: 15\r\n\r\nRequest Timeout",
+	},
+	{
+		// Connection closed after maximum number of requests.
+		server: Server{MaxRequestsPerConnection: 1},
+		in: "GET /?cl=5&w=Hello HTTP/1.1\r\n\r\n" +
+			"GET /?cl=5&w=Hello HTTP/1.1\r\n\r\n",
+		out: "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 5\r\n\r\nHello",
+	},
+}
+
+func TestServerLimits(t *testing.T) {
+	for _, st := range serverLimitTests {
+		l := &testListener{done: make(chan bool), errs: defaultErrs}
+		l.in.WriteString(st.in)
+		s := st.server
+		s.Listener = l
+		s.Handler = web.HandlerFunc(testHandler)
+		err := s.Serve()
+		if err != os.EOF {
+			t.Errorf("Server() = %v", err)
+		}
+		<-l.done
+		out := l.out.String()
+		if out != st.out {
+			t.Errorf("in=%q\ngot:  %q\nwant: %q", st.in, out, st.out)
+		}
+	}
+}
+
+func TestIPCounter(t *testing.T) {
+	c := newIPCounter()
+	if !c.acquire("1.2.3.4", 2) || !c.acquire("1.2.3.4", 2) {
+		t.Fatal("acquire under limit failed")
+	}
+	if c.acquire("1.2.3.4", 2) {
+		t.Error("acquire over limit succeeded")
+	}
+	if !c.acquire("5.6.7.8", 2) {
+		t.Error("acquire for other address failed")
+	}
+	c.release("1.2.3.4")
+	if !c.acquire("1.2.3.4", 2) {
+		t.Error("acquire after release failed")
+	}
+	c.release("5.6.7.8")
+	if _, found := c.m["5.6.7.8"]; found {
+		t.Error("count not deleted after last release")
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	l := &testListener{done: make(chan bool), errs: defaultErrs}
+	l.in.WriteString("GET / HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\n\r\n")
+	stats := new(expvar.Map).Init()
+	s := &Server{Listener: l, Handler: web.HandlerFunc(testHandler), Stats: stats}
+	if err := s.Serve(); err != os.EOF {
+		t.Errorf("Server() = %v", err)
+	}
+	<-l.done
+	if b, _ := stats.Get(StatRequests).(*expvar.Int).MarshalJSON(); string(b) != "2" {
+		t.Errorf("requests = %s, want 2", b)
+	}
+	if b, _ := stats.Get(StatAcceptedConnections).(*expvar.Int).MarshalJSON(); string(b) != "1" {
+		t.Errorf("accepted connections = %s, want 1", b)
+	}
+}
+
+func TestRejectConnection(t *testing.T) {
+	s := &Server{rejecters: make(chan bool, 1)}
+	l := &testListener{done: make(chan bool, 1)}
+
+	// All rejecters are busy. The connection is closed without a response.
+	s.rejecters <- true
+	s.rejectConnection(testConn{l}, "test")
+	<-l.done
+	if out := l.out.String(); out != "" {
+		t.Errorf("busy rejecters wrote %q, want no response", out)
+	}
+
+	<-s.rejecters
+	s.rejectConnection(testConn{l}, "test")
+	<-l.done
+	if out := l.out.String(); !strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n") {
+		t.Errorf("rejected connection got %q, want 503 response", out)
+	}
+}
+
+func TestConnStateShutdown(t *testing.T) {
+	l := &testListener{done: make(chan bool), errs: defaultErrs}
+	s := &Server{Listener: l}
+	conn := testConn{l}
+	if !s.connState.add(conn) {
+		t.Fatal("add before shutdown failed")
+	}
+	if s.connState.setIdle(conn, false) {
+		t.Error("setIdle reported shutdown before shutdown")
+	}
+	done := make(chan bool)
+	go func() {
+		s.Shutdown()
+		done <- true
+	}()
+	for !s.connState.isShuttingDown() {
+		runtime.Gosched()
+	}
+	if !s.connState.setIdle(conn, true) {
+		t.Error("setIdle did not report shutdown")
+	}
+	if s.connState.add(testConn{l}) {
+		t.Error("add after shutdown succeeded")
+	}
+	s.connState.remove(conn)
+	<-done
+}
+
+func urlHandler(req *web.Request) {
+	w := req.Respond(web.StatusOK)
+	io.WriteString(w, req.URL.Scheme+"://"+req.URL.Host)
+}
+
+func TestServerListeners(t *testing.T) {
+	l1 := &testListener{done: make(chan bool), errs: defaultErrs}
+	l1.in.WriteString("GET / HTTP/1.0\r\n\r\n")
+	l2 := &testListener{done: make(chan bool), errs: defaultErrs}
+	l2.in.WriteString("GET / HTTP/1.0\r\n\r\n")
+	s := &Server{
+		Listener:    l1,
+		Handler:     web.HandlerFunc(urlHandler),
+		DefaultHost: "example.com",
+		Listeners: []*ListenerConfig{
+			&ListenerConfig{
+				Listener:    l2,
+				Secure:      true,
+				DefaultHost: "admin.example.com",
+			},
+		},
+	}
+	if err := s.Serve(); err != os.EOF {
+		t.Errorf("Server() = %v", err)
+	}
+	<-l1.done
+	<-l2.done
+	if out, want := l1.out.String(), "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nhttp://example.com"; out != want {
+		t.Errorf("listener 1 got %q, want %q", out, want)
+	}
+	if out, want := l2.out.String(), "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nhttps://admin.example.com"; out != want {
+		t.Errorf("listener 2 got %q, want %q", out, want)
+	}
+}
+
+func TestRemoteAddrString(t *testing.T) {
+	conn := &proxyConn{
+		remoteAddr: &net.UnixAddr{Name: "", Net: "unix"},
+		localAddr:  &net.UnixAddr{Name: "/tmp/app.sock", Net: "unix"},
+	}
+	if s := remoteAddrString(conn); s != "unix:/tmp/app.sock" {
+		t.Errorf("remoteAddrString(unnamed unix peer) = %q, want %q", s, "unix:/tmp/app.sock")
+	}
+	conn.remoteAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	if s := remoteAddrString(conn); s != "10.0.0.1:1234" {
+		t.Errorf("remoteAddrString(tcp) = %q, want %q", s, "10.0.0.1:1234")
+	}
+}
+
+// writeTestKeyPair writes a self-signed certificate and key for name to dir.
+func writeTestKeyPair(t *testing.T, dir, name string, serial byte) KeyPair {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("GenerateKey", err)
+	}
+	now := time.Seconds()
+	template := &x509.Certificate{
+		SerialNumber:          []byte{serial},
+		Subject:               x509.Name{CommonName: name},
+		NotBefore:             time.SecondsToUTC(now - 3600),
+		NotAfter:              time.SecondsToUTC(now + 3600),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal("CreateCertificate", err)
+	}
+	kp := KeyPair{CertFile: path.Join(dir, name+".crt"), KeyFile: path.Join(dir, name+".key")}
+	var cert, key bytes.Buffer
+	pem.Encode(&cert, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&key, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	if err := ioutil.WriteFile(kp.CertFile, cert.Bytes(), 0600); err != nil {
+		t.Fatal("WriteFile", err)
+	}
+	if err := ioutil.WriteFile(kp.KeyFile, key.Bytes(), 0600); err != nil {
+		t.Fatal("WriteFile", err)
+	}
+	return kp
+}
+
+func tlsHandler(req *web.Request) {
+	w := req.Respond(web.StatusOK)
+	io.WriteString(w, req.URL.Scheme)
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		io.WriteString(w, " "+req.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+}
+
+// tlsGet sends a request to addr using config and returns the common name of
+// the server certificate and the response. The server certificate is not
+// verified.
+func tlsGet(addr string, config *tls.Config) (string, string, os.Error) {
+	config.InsecureSkipVerify = true
+	c, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", "", err
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "GET / HTTP/1.0\r\n\r\n"); err != nil {
+		return "", "", err
+	}
+	p, err := ioutil.ReadAll(c)
+	if err != nil {
+		return "", "", err
+	}
+	state := c.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", "", os.NewError("no server certificate")
+	}
+	return state.PeerCertificates[0].Subject.CommonName, string(p), nil
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := path.Join(os.TempDir(), "twister-tls-test-"+strconv.Itoa64(time.Nanoseconds()))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal("MkdirAll", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := writeTestKeyPair(t, dir, "a.example.com", 1)
+	b := writeTestKeyPair(t, dir, "b.example.com", 2)
+	client := writeTestKeyPair(t, dir, "client", 3)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	tl, err := NewTLSListener(l, &TLSOptions{
+		KeyPairs:     []KeyPair{a, b},
+		ClientCAFile: client.CertFile,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatal("NewTLSListener", err)
+	}
+	defer tl.Close()
+	go (&Server{Listener: tl, Handler: web.HandlerFunc(tlsHandler)}).Serve()
+	addr := l.Addr().String()
+
+	clientCert := mustLoadKeyPair(t, client)
+
+	tests := []struct {
+		serverName string
+		certs      []tls.Certificate
+		cn         string
+		body       string
+	}{
+		// SNI selects the certificate.
+		{"a.example.com", nil, "a.example.com", "https"},
+		{"b.example.com", nil, "b.example.com", "https"},
+		// The first certificate is the default.
+		{"", nil, "a.example.com", "https"},
+		// Verified client certificates are available to the handler.
+		{"b.example.com", []tls.Certificate{clientCert}, "b.example.com", "https client"},
+	}
+	for _, tt := range tests {
+		cn, body, err := tlsGet(addr, &tls.Config{ServerName: tt.serverName, Certificates: tt.certs})
+		if err != nil {
+			t.Errorf("%q: %v", tt.serverName, err)
+			continue
+		}
+		if cn != tt.cn {
+			t.Errorf("%q: certificate = %q, want %q", tt.serverName, cn, tt.cn)
+		}
+		if want := "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\n" + tt.body; body != want {
+			t.Errorf("%q: response = %q, want %q", tt.serverName, body, want)
+		}
+	}
+
+	// A client certificate not signed by the client CA is rejected.
+	// The handshake fails.
+	if _, body, err := tlsGet(addr, &tls.Config{Certificates: []tls.Certificate{mustLoadKeyPair(t, a)}}); err == nil {
+		t.Errorf("unverified client certificate accepted, response = %q", body)
+	}
+
+	// Reload picks up new files. A failed reload keeps the current
+	// configuration.
+	if tl.changed() {
+		t.Error("changed() = true before files were modified")
+	}
+	a2 := writeTestKeyPair(t, dir, "a2.example.com", 4)
+	if err := os.Rename(a2.CertFile, a.CertFile); err != nil {
+		t.Fatal("Rename", err)
+	}
+	if err := os.Rename(a2.KeyFile, a.KeyFile); err != nil {
+		t.Fatal("Rename", err)
+	}
+	mtime := time.Nanoseconds() + 10e9
+	os.Chtimes(a.CertFile, mtime, mtime)
+	if !tl.changed() {
+		t.Error("changed() = false after files were modified")
+	}
+	if err := tl.Reload(); err != nil {
+		t.Fatal("Reload", err)
+	}
+	if cn, _, err := tlsGet(addr, &tls.Config{}); err != nil || cn != "a2.example.com" {
+		t.Errorf("after reload, certificate = %q, %v; want a2.example.com", cn, err)
+	}
+	if err := ioutil.WriteFile(b.KeyFile, []byte("bad"), 0600); err != nil {
+		t.Fatal("WriteFile", err)
+	}
+	if err := tl.Reload(); err == nil {
+		t.Error("Reload with bad key succeeded")
+	}
+	if cn, _, err := tlsGet(addr, &tls.Config{ServerName: "b.example.com"}); err != nil || cn != "b.example.com" {
+		t.Errorf("after failed reload, certificate = %q, %v; want b.example.com", cn, err)
+	}
+}
+
+func mustLoadKeyPair(t *testing.T, kp KeyPair) tls.Certificate {
+	cert, err := tls.LoadX509KeyPair(kp.CertFile, kp.KeyFile)
+	if err != nil {
+		t.Fatal("LoadX509KeyPair", err)
+	}
+	return cert
+}
+
+func peerCredHandler(req *web.Request) {
+	if _, ok := req.Env["twister.server.PeerCredentials"].(PeerCredentialsFunc); !ok {
+		req.Error(web.StatusInternalServerError, os.NewError("PeerCredentialsFunc not in Env"))
+		return
+	}
+	cred, err := GetPeerCredentials(req)
+	w := req.Respond(web.StatusOK, web.HeaderContentLength, "1")
+	if err != nil || (cred != nil && cred.Pid != os.Getpid()) {
+		io.WriteString(w, "E")
+	} else {
+		io.WriteString(w, "K")
+	}
+}
+
+func TestUnixListenerTimeouts(t *testing.T) {
+	name := path.Join(os.TempDir(), "twister-unix-test-"+strconv.Itoa64(time.Nanoseconds())+".sock")
+	l, err := ListenUnix(name, 0600)
+	if err != nil {
+		t.Fatal("ListenUnix", err)
+	}
+	defer os.Remove(name)
+	defer l.Close()
+	go (&Server{Listener: l, Handler: web.HandlerFunc(peerCredHandler), IdleTimeout: 1e8}).Serve()
+
+	c, err := net.Dial("unix", name)
+	if err != nil {
+		t.Fatal("Dial", err)
+	}
+	defer c.Close()
+	c.SetReadTimeout(5e9)
+
+	// Fetching the peer credentials must not stop the idle timeout from
+	// closing the connection.
+	if _, err := io.WriteString(c, "GET / HTTP/1.1\r\n\r\n"); err != nil {
+		t.Fatal("Write", err)
+	}
+	p, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll returned %v, want connection closed by idle timeout", err)
+	}
+	if want := "HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\nK"; string(p) != want {
+		t.Errorf("response = %q, want %q", p, want)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	name := path.Join(os.TempDir(), "twister-unix-test-"+strconv.Itoa64(time.Nanoseconds())+".sock")
+	defer os.Remove(name)
+
+	// Create a stale socket file without a listener.
+	fd, e := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if e != 0 {
+		t.Fatal("Socket", os.Errno(e))
+	}
+	e = syscall.Bind(fd, &syscall.SockaddrUnix{Name: name})
+	syscall.Close(fd)
+	if e != 0 {
+		t.Fatal("Bind", os.Errno(e))
+	}
+
+	l, err := ListenUnix(name, 0600)
+	if err != nil {
+		t.Fatal("ListenUnix with stale socket", err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal("Stat", err)
+	}
+	if mode := fi.Mode & 0777; mode != 0600 {
+		t.Errorf("mode = %o, want 600", mode)
+	}
+
+	// The socket of a live listener is not removed.
+	if l2, err := ListenUnix(name, 0600); err == nil {
+		l2.Close()
+		t.Error("ListenUnix on socket in use succeeded")
+	}
+	if c, err := net.Dial("unix", name); err != nil {
+		t.Error("Dial after failed ListenUnix", err)
+	} else {
+		c.Close()
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/garyburd/twister/web"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// KeyPair specifies the names of PEM encoded certificate and private key
+// files.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// TLSOptions specifies options for a TLS listener.
+type TLSOptions struct {
+	// Certificates and keys. The listener selects a certificate using the
+	// server name sent by the client (SNI). If the client does not send a
+	// server name or there is no matching certificate, then the listener uses
+	// the first certificate.
+	KeyPairs []KeyPair
+
+	// Name of a file containing PEM encoded certificates for the authorities
+	// used to verify client certificates.
+	ClientCAFile string
+
+	// Client certificate policy. The verified chains are available to
+	// handlers through the web.Request TLS field.
+	ClientAuth tls.ClientAuthType
+
+	// Configuration for fields not set by the listener. The listener sets
+	// the Certificates, NameToCertificate, ClientCAs and ClientAuth fields in
+	// a copy of this configuration.
+	Config *tls.Config
+}
+
+// TLSListener is a listener that accepts TLS connections. The certificates
+// can be reloaded without restarting the server. Connections accepted after a
+// reload use the new certificates.
+type TLSListener struct {
+	net.Listener
+	options TLSOptions
+
+	mu     sync.Mutex
+	config *tls.Config
+	mtimes []int64
+}
+
+// NewTLSListener returns a listener that accepts TLS connections from the
+// underlying listener l.
+func NewTLSListener(l net.Listener, options *TLSOptions) (*TLSListener, os.Error) {
+	if len(options.KeyPairs) == 0 {
+		return nil, os.NewError("twister.server: no certificates")
+	}
+	tl := &TLSListener{Listener: l, options: *options}
+	if err := tl.Reload(); err != nil {
+		return nil, err
+	}
+	return tl, nil
+}
+
+// files returns the names of the files used by the listener.
+func (l *TLSListener) files() []string {
+	var names []string
+	for _, kp := range l.options.KeyPairs {
+		names = append(names, kp.CertFile, kp.KeyFile)
+	}
+	if l.options.ClientCAFile != "" {
+		names = append(names, l.options.ClientCAFile)
+	}
+	return names
+}
+
+// modTimes returns the modification times of the files used by the listener.
+func (l *TLSListener) modTimes() []int64 {
+	names := l.files()
+	mtimes := make([]int64, len(names))
+	for i, name := range names {
+		if info, err := os.Stat(name); err == nil {
+			mtimes[i] = info.Mtime_ns
+		}
+	}
+	return mtimes
+}
+
+// Reload loads the certificate, key and client CA files. The current
+// configuration is not changed if there is an error loading the files.
+func (l *TLSListener) Reload() os.Error {
+	mtimes := l.modTimes()
+
+	config := &tls.Config{}
+	if l.options.Config != nil {
+		*config = *l.options.Config
+	}
+
+	config.Certificates = make([]tls.Certificate, len(l.options.KeyPairs))
+	for i, kp := range l.options.KeyPairs {
+		cert, err := tls.LoadX509KeyPair(kp.CertFile, kp.KeyFile)
+		if err != nil {
+			return err
+		}
+		config.Certificates[i] = cert
+	}
+	config.BuildNameToCertificate()
+
+	config.ClientAuth = l.options.ClientAuth
+	if l.options.ClientCAFile != "" {
+		p, err := ioutil.ReadFile(l.options.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(p) {
+			return os.NewError("twister.server: no certificates in " + l.options.ClientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	l.mu.Lock()
+	l.config = config
+	l.mtimes = mtimes
+	l.mu.Unlock()
+	return nil
+}
+
+// Accept waits for and returns the next TLS connection to the listener. The
+// TLS handshake is performed on the first read or write to the connection.
+func (l *TLSListener) Accept() (net.Conn, os.Error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	config := l.config
+	l.mu.Unlock()
+	return tls.Server(c, config), nil
+}
+
+// changed returns true if the files used by the listener have been modified
+// since the last reload.
+func (l *TLSListener) changed() bool {
+	mtimes := l.modTimes()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range mtimes {
+		if mtimes[i] != l.mtimes[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchFiles starts a goroutine that checks the files used by the listener
+// for modification every interval nanoseconds. The listener is reloaded when
+// a change is detected.
+func (l *TLSListener) WatchFiles(interval int64) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			if l.changed() {
+				if err := l.Reload(); err != nil {
+					log.Println("twister: TLS reload failed", err)
+				} else {
+					log.Println("twister: TLS certificates reloaded")
+				}
+			}
+		}
+	}()
+}
+
+// ReloadOnSIGHUP starts a goroutine that reloads the listener when the
+// process receives SIGHUP. The goroutine receives from signal.Incoming. Do not
+// use this function if the application also receives from signal.Incoming.
+func (l *TLSListener) ReloadOnSIGHUP() {
+	go func() {
+		for sig := range signal.Incoming {
+			if usig, ok := sig.(os.UnixSignal); ok && usig == syscall.SIGHUP {
+				if err := l.Reload(); err != nil {
+					log.Println("twister: TLS reload failed", err)
+				} else {
+					log.Println("twister: TLS certificates reloaded")
+				}
+			}
+		}
+	}()
+}
+
+// RunTLS is a convenience function for running an HTTPS server. RunTLS
+// listens on the TCP address addr, creates a TLS listener with the given
+// options and serves requests with handler. The certificates are reloaded
+// on SIGHUP. RunTLS logs a fatal error if it encounters an error.
+func RunTLS(addr string, options *TLSOptions, handler web.Handler) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("Listen", err)
+		return
+	}
+	defer listener.Close()
+	tlsListener, err := NewTLSListener(listener, options)
+	if err != nil {
+		log.Fatal("TLS", err)
+		return
+	}
+	tlsListener.ReloadOnSIGHUP()
+	err = (&Server{Logger: LoggerFunc(ShortLogger), Listener: tlsListener, Handler: handler}).Serve()
+	if err != nil {
+		log.Fatal("Server", err)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"github.com/garyburd/twister/web"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// PeerCredentials is the identity of the process on the other end of a Unix
+// domain socket connection. Use GetPeerCredentials to get the credentials for
+// a request. Peer credentials are only available on Linux.
+type PeerCredentials struct {
+	Pid int
+	Uid int
+	Gid int
+}
+
+// PeerCredentialsFunc returns the credentials of the peer process. The server
+// stores a PeerCredentialsFunc in the request Env with the key
+// "twister.server.PeerCredentials" for requests received on a Unix domain
+// socket. Middleware can call the function directly or use
+// GetPeerCredentials.
+type PeerCredentialsFunc func() (*PeerCredentials, os.Error)
+
+// peerCredState fetches the credentials for a connection on first use.
+type peerCredState struct {
+	conn net.Conn
+	once sync.Once
+	cred *PeerCredentials
+	err  os.Error
+}
+
+func (s *peerCredState) get() (*PeerCredentials, os.Error) {
+	s.once.Do(func() { s.cred, s.err = peerCredentials(s.conn) })
+	return s.cred, s.err
+}
+
+// GetPeerCredentials returns the credentials of the process on the other end
+// of the request's Unix domain socket connection. GetPeerCredentials returns
+// nil if the request was not received on a Unix domain socket or if
+// credentials are not supported on the platform.
+//
+// The credentials are fetched on the first call for a connection. On Linux,
+// the SO_PEERCRED socket option is read from a duplicate of the connection's
+// file descriptor. Duplicating the descriptor switches the socket to blocking
+// mode; GetPeerCredentials restores non-blocking mode before returning so
+// that server timeouts continue to work. Do not call GetPeerCredentials
+// concurrently with reads or writes on the connection.
+func GetPeerCredentials(req *web.Request) (*PeerCredentials, os.Error) {
+	f, _ := req.Env["twister.server.PeerCredentials"].(PeerCredentialsFunc)
+	if f == nil {
+		return nil, nil
+	}
+	return f()
+}
+
+// peerCredentials returns the credentials of the peer process or nil if the
+// connection is not a Unix domain socket connection or if credentials are not
+// supported on the platform.
+var peerCredentials = func(conn net.Conn) (*PeerCredentials, os.Error) {
+	return nil, nil
+}
+
+// umaskMutex serializes changes to the process umask by ListenUnix.
+var umaskMutex sync.Mutex
+
+// ListenUnix listens on the Unix domain socket at path and sets the
+// permissions of the socket file to mode. The process umask is set while the
+// socket is created so that the socket is never accessible with permissions
+// broader than mode. Because the umask is shared by the process, files
+// created by other goroutines during the call may get narrower permissions.
+//
+// A stale socket file left by a previous process is removed before
+// listening. The socket file is stale if connecting to it is refused.
+// ListenUnix returns an error if another process is listening on the socket.
+//
+// Example:
+//
+//  admin, err := server.ListenUnix("/var/run/app/admin.sock", 0600)
+//  if err != nil {
+//      log.Fatal("ListenUnix", err)
+//  }
+func ListenUnix(path string, mode uint32) (net.Listener, os.Error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if !fi.IsSocket() {
+			return nil, os.NewError("twister.server: " + path + " exists and is not a socket")
+		}
+		c, err := net.Dial("unix", path)
+		if err == nil {
+			c.Close()
+			return nil, os.NewError("twister.server: " + path + " is in use")
+		}
+		if e, ok := err.(*net.OpError); !ok || e.Error != os.ECONNREFUSED {
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	umaskMutex.Lock()
+	umask := syscall.Umask(int(0777 &^ mode))
+	l, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	umaskMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// remoteAddrString returns the remote address of the connection formatted for
+// the request RemoteAddr field. Clients connecting to a Unix domain socket
+// are usually unnamed. These clients are identified by the path of the
+// server's socket prefixed with "unix:".
+func remoteAddrString(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	ua, ok := addr.(*net.UnixAddr)
+	if !ok {
+		return addr.String()
+	}
+	name := ""
+	if ua != nil {
+		name = ua.Name
+	}
+	if name == "" || name == "@" {
+		if la, ok := conn.LocalAddr().(*net.UnixAddr); ok && la != nil {
+			name = la.Name
+		}
+	}
+	return "unix:" + name
+}
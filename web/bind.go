@@ -0,0 +1,434 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"json"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxBindBodyLen is the maximum length of form and JSON request
+// bodies read by Bind.
+const DefaultMaxBindBodyLen = 1 << 20
+
+// ParamUnmarshaler is implemented by types that can set themselves from a
+// request parameter, cookie or header value.
+type ParamUnmarshaler interface {
+	UnmarshalParam(s string) os.Error
+}
+
+// FieldError describes a value that could not be bound to a field or that
+// failed validation.
+type FieldError struct {
+	// Name of the field in the request, for example "address.city" or
+	// "items[0].count". The name is "" for errors that apply to the request
+	// body as a whole.
+	Field string
+
+	// Value that could not be converted. The value is "" for validation
+	// errors.
+	Value string
+
+	Err os.Error
+}
+
+func (e *FieldError) String() string {
+	if e.Field == "" {
+		return e.Err.String()
+	}
+	return e.Field + ": " + e.Err.String()
+}
+
+// FieldErrors is a list of field errors. Bind and Validate return a
+// FieldErrors value when one or more fields are in error.
+type FieldErrors []*FieldError
+
+func (e FieldErrors) String() string {
+	var buf bytes.Buffer
+	for i, fe := range e {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(fe.String())
+	}
+	return buf.String()
+}
+
+var (
+	errBindSyntax = os.NewError("invalid value")
+	errBindRange  = os.NewError("value out of range")
+)
+
+// Bind sets the fields of the struct pointed to by dst from the request.
+//
+// If the request content type is application/json, then the request body is
+// decoded to dst using the json package. Form bodies are parsed with
+// ParseForm if not already parsed. Use MultipartHandler to parse
+// multipart/form-data bodies before calling Bind.
+//
+// Fields are then set from the request parameters, cookies and headers. The
+// request parameters include the path parameters set by the router, the
+// query and the form body. The source and name are specified with field
+// tags:
+//
+//  type Search struct {
+//      Query   string        `param:"q"`
+//      Page    int           // parameter "Page"
+//      Tags    []string      `param:"tag"` // repeated parameter
+//      Since   *time.Time    `param:"since" layout:"2006-01-02"`
+//      Session string        `cookie:"session"`
+//      Agent   string        `header:"User-Agent"`
+//      Owner   struct {
+//          Name string `param:"name"`     // parameter "owner.name"
+//      }   `param:"owner"`
+//      Items   []struct {
+//          Count int `param:"count"`      // parameter "items[0].count"
+//      }   `param:"items"`
+//      Upload  *web.UploadedFile `param:"upload"`
+//      Ignored string        `param:"-"`
+//  }
+//
+// If a field does not have a tag, then the field is bound to the request
+// parameter with the field name. Fields for parameters that are not present
+// in the request are not modified.
+//
+// Supported field types are strings, booleans, integers, floating point
+// numbers, time.Time (parsed with the layout tag or time.RFC3339), types
+// that implement ParamUnmarshaler, *UploadedFile, structs and slices and
+// pointers of these types.
+//
+// Bind returns FieldErrors listing every value that could not be bound.
+func Bind(req *Request, dst interface{}) os.Error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic("twister: Bind destination must be a pointer to a struct")
+	}
+
+	var errs FieldErrors
+	switch {
+	case isJSONContentType(req.ContentType):
+		p, err := req.BodyBytes(DefaultMaxBindBodyLen)
+		if err != nil {
+			return err
+		}
+		if len(p) > 0 {
+			if err := json.Unmarshal(p, dst); err != nil {
+				errs = append(errs, &FieldError{Err: err})
+			}
+		}
+	case req.ContentType == "application/x-www-form-urlencoded":
+		if err := req.ParseForm(DefaultMaxBindBodyLen); err != nil {
+			return err
+		}
+	}
+
+	b := &binder{req: req, files: RequestFiles(req)}
+	b.bindStruct(v.Elem(), "")
+	errs = append(errs, b.errs...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// isJSONContentType returns true for application/json and media types with
+// the +json suffix.
+func isJSONContentType(contentType string) bool {
+	return contentType == "application/json" || strings.HasSuffix(contentType, "+json")
+}
+
+type binder struct {
+	req   *Request
+	files []*UploadedFile
+	errs  FieldErrors
+}
+
+func (b *binder) addError(name, value string, err os.Error) {
+	b.errs = append(b.errs, &FieldError{Field: name, Value: value, Err: err})
+}
+
+var (
+	timeType         = reflect.TypeOf(time.Time{})
+	uploadedFileType = reflect.TypeOf(&UploadedFile{})
+	unmarshalerType  = reflect.TypeOf((*ParamUnmarshaler)(nil)).Elem()
+)
+
+// bindStruct binds the fields of the struct v. Parameter names are prefixed
+// with prefix.
+func (b *binder) bindStruct(v reflect.Value, prefix string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// Unexported field.
+			continue
+		}
+		fv := v.Field(i)
+		layout := f.Tag.Get("layout")
+		switch source, name := fieldSource(f, prefix); source {
+		case "cookie":
+			b.bindValues(fv, name, b.req.Cookie[name], layout)
+		case "header":
+			b.bindValues(fv, name, b.req.Header[HeaderName(name)], layout)
+		case "param":
+			b.bindParam(fv, name, layout)
+		}
+	}
+}
+
+// fieldSource returns the source ("param", "cookie" or "header") and name of
+// the request value for struct field f. The source is "" if the field is
+// skipped.
+func fieldSource(f reflect.StructField, prefix string) (source, name string) {
+	if name := f.Tag.Get("cookie"); name != "" {
+		return "cookie", name
+	}
+	if name := f.Tag.Get("header"); name != "" {
+		return "header", name
+	}
+	name = f.Tag.Get("param")
+	if name == "-" {
+		return "", ""
+	}
+	if name == "" {
+		name = f.Name
+	}
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+	return "param", name
+}
+
+// isScalar returns true if values of type t are set from a single string.
+func isScalar(t reflect.Type) bool {
+	if t == timeType || reflect.PtrTo(t).Implements(unmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Ptr:
+		return false
+	}
+	return true
+}
+
+// bindParam binds v to the request parameter or parameters with name.
+func (b *binder) bindParam(v reflect.Value, name, layout string) {
+	t := v.Type()
+	switch {
+	case t == uploadedFileType:
+		for _, f := range b.files {
+			if f.Name == name {
+				v.Set(reflect.ValueOf(f))
+				return
+			}
+		}
+	case t.Kind() == reflect.Slice && t.Elem() == uploadedFileType:
+		for _, f := range b.files {
+			if f.Name == name {
+				v.Set(reflect.Append(v, reflect.ValueOf(f)))
+			}
+		}
+	case isScalar(t):
+		b.bindValues(v, name, b.req.Param[name], layout)
+	case t.Kind() == reflect.Ptr:
+		if !b.hasParam(name) {
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		b.bindParam(v.Elem(), name, layout)
+	case t.Kind() == reflect.Struct:
+		b.bindStruct(v, name)
+	case t.Kind() == reflect.Slice && isScalar(t.Elem()):
+		if values := b.req.Param[name]; len(values) > 0 {
+			b.bindValues(v, name, values, layout)
+		} else {
+			b.bindIndexed(v, name, layout)
+		}
+	case t.Kind() == reflect.Slice:
+		b.bindIndexed(v, name, layout)
+	}
+}
+
+// hasParam returns true if the request has a parameter with name or a
+// parameter nested under name.
+func (b *binder) hasParam(name string) bool {
+	if _, ok := b.req.Param[name]; ok {
+		return true
+	}
+	for key := range b.req.Param {
+		if strings.HasPrefix(key, name) && len(key) > len(name) && (key[len(name)] == '.' || key[len(name)] == '[') {
+			return true
+		}
+	}
+	for _, f := range b.files {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bindIndexed binds the slice v to parameters with names of the form
+// name[0], name[1].x and so on.
+func (b *binder) bindIndexed(v reflect.Value, name, layout string) {
+	seen := make(map[int]bool)
+	var indexes []int
+	for key := range b.req.Param {
+		if !strings.HasPrefix(key, name+"[") {
+			continue
+		}
+		rest := key[len(name)+1:]
+		i := strings.IndexRune(rest, ']')
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil || n < 0 {
+			continue
+		}
+		if !seen[n] {
+			seen[n] = true
+			indexes = append(indexes, n)
+		}
+	}
+	if len(indexes) == 0 {
+		return
+	}
+	sort.Ints(indexes)
+	if max := indexes[len(indexes)-1]; max >= 1000 {
+		b.addError(name, "", errBindRange)
+		return
+	}
+	n := indexes[len(indexes)-1] + 1
+	if v.Len() < n {
+		s := reflect.MakeSlice(v.Type(), n, n)
+		reflect.Copy(s, v)
+		v.Set(s)
+	}
+	for _, i := range indexes {
+		b.bindParam(v.Index(i), name+"["+strconv.Itoa(i)+"]", layout)
+	}
+}
+
+// bindValues sets v from values. If v is a slice, then v is set to all of
+// the values. Otherwise, v is set from the first value.
+func (b *binder) bindValues(v reflect.Value, name string, values []string, layout string) {
+	if len(values) == 0 {
+		return
+	}
+	t := v.Type()
+	if t.Kind() == reflect.Slice && t != timeType {
+		s := reflect.MakeSlice(t, len(values), len(values))
+		for i, value := range values {
+			if err := setValue(s.Index(i), value, layout); err != nil {
+				b.addError(name, value, err)
+				return
+			}
+		}
+		v.Set(s)
+		return
+	}
+	if err := setValue(v, values[0], layout); err != nil {
+		b.addError(name, values[0], err)
+	}
+}
+
+// setValue sets the scalar v from the string s.
+func setValue(v reflect.Value, s string, layout string) os.Error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(ParamUnmarshaler); ok {
+			return u.UnmarshalParam(s)
+		}
+	}
+
+	if v.Type() == timeType {
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return errBindSyntax
+		}
+		v.Set(reflect.ValueOf(*t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		switch strings.ToLower(s) {
+		case "1", "t", "true", "on", "yes":
+			v.SetBool(true)
+		case "", "0", "f", "false", "off", "no":
+			v.SetBool(false)
+		default:
+			return errBindSyntax
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.Atoi64(s)
+		if err != nil {
+			return convError(err)
+		}
+		if v.OverflowInt(n) {
+			return errBindRange
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.Atoui64(s)
+		if err != nil {
+			return convError(err)
+		}
+		if v.OverflowUint(n) {
+			return errBindRange
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.Atof64(s)
+		if err != nil {
+			return convError(err)
+		}
+		if v.OverflowFloat(n) {
+			return errBindRange
+		}
+		v.SetFloat(n)
+	default:
+		return os.NewError("unsupported field type " + v.Type().String())
+	}
+	return nil
+}
+
+// convError converts a strconv error to a bind error.
+func convError(err os.Error) os.Error {
+	if e, ok := err.(*strconv.NumError); ok && e.Error == os.ERANGE {
+		return errBindRange
+	}
+	return errBindSyntax
+}
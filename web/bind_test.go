@@ -0,0 +1,183 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type upperString string
+
+func (s *upperString) UnmarshalParam(v string) os.Error {
+	*s = upperString(strings.ToUpper(v))
+	return nil
+}
+
+type bindItem struct {
+	Name  string `param:"name"`
+	Count int    `param:"count"`
+}
+
+type bindTarget struct {
+	Query   string `param:"q"`
+	Page    int
+	Tags    []string    `param:"tag"`
+	Since   *time.Time  `param:"since" layout:"2006-01-02"`
+	Enabled bool        `param:"enabled"`
+	Ratio   float64     `param:"ratio"`
+	Code    upperString `param:"code"`
+	Session string      `cookie:"session"`
+	Agent   string      `header:"User-Agent"`
+	Owner   struct {
+		Name string `param:"name"`
+		Age  uint8  `param:"age"`
+	} `param:"owner"`
+	Items   []bindItem `param:"items"`
+	Missing *bindItem  `param:"missing"`
+	Ignored string     `param:"-"`
+}
+
+func TestBindParams(t *testing.T) {
+	var dst bindTarget
+	dst.Ignored = "keep"
+	var err os.Error
+	h := HandlerFunc(func(req *Request) {
+		err = Bind(req, &dst)
+		req.Respond(StatusOK)
+	})
+	RunHandler("/?q=go&Page=3&tag=a&tag=b&since=2011-06-01&enabled=on&ratio=0.5&code=abc"+
+		"&owner.name=bob&owner.age=42&items[1].name=y&items[0].name=x&items[0].count=2&Ignored=x",
+		"GET", NewHeader(HeaderCookie, "session=s1", HeaderUserAgent, "test"), nil, h)
+	if err != nil {
+		t.Fatalf("Bind returned %v", err)
+	}
+	if dst.Query != "go" || dst.Page != 3 || !dst.Enabled || dst.Ratio != 0.5 || dst.Code != "ABC" {
+		t.Errorf("scalars = %+v", dst)
+	}
+	if len(dst.Tags) != 2 || dst.Tags[0] != "a" || dst.Tags[1] != "b" {
+		t.Errorf("Tags = %v", dst.Tags)
+	}
+	if dst.Since == nil || dst.Since.Year != 2011 || dst.Since.Month != 6 || dst.Since.Day != 1 {
+		t.Errorf("Since = %v", dst.Since)
+	}
+	if dst.Session != "s1" || dst.Agent != "test" {
+		t.Errorf("Session = %q, Agent = %q", dst.Session, dst.Agent)
+	}
+	if dst.Owner.Name != "bob" || dst.Owner.Age != 42 {
+		t.Errorf("Owner = %+v", dst.Owner)
+	}
+	if len(dst.Items) != 2 || dst.Items[0].Name != "x" || dst.Items[0].Count != 2 || dst.Items[1].Name != "y" {
+		t.Errorf("Items = %+v", dst.Items)
+	}
+	if dst.Missing != nil {
+		t.Errorf("Missing = %+v, want nil", dst.Missing)
+	}
+	if dst.Ignored != "keep" {
+		t.Errorf("Ignored = %q", dst.Ignored)
+	}
+}
+
+func TestBindErrors(t *testing.T) {
+	var dst bindTarget
+	var err os.Error
+	h := HandlerFunc(func(req *Request) {
+		err = Bind(req, &dst)
+		req.Respond(StatusOK)
+	})
+	RunHandler("/?Page=x&owner.age=300&enabled=maybe&q=ok", "GET", nil, nil, h)
+	errs, ok := err.(FieldErrors)
+	if !ok {
+		t.Fatalf("Bind returned %v, want FieldErrors", err)
+	}
+	fields := make(map[string]bool)
+	for _, fe := range errs {
+		fields[fe.Field] = true
+	}
+	for _, name := range []string{"Page", "owner.age", "enabled"} {
+		if !fields[name] {
+			t.Errorf("no error for %s in %v", name, errs)
+		}
+	}
+	if dst.Query != "ok" {
+		t.Errorf("Query = %q, want ok", dst.Query)
+	}
+}
+
+func TestBindForm(t *testing.T) {
+	var dst bindTarget
+	var err os.Error
+	h := HandlerFunc(func(req *Request) {
+		err = Bind(req, &dst)
+		req.Respond(StatusOK)
+	})
+	RunHandler("/?q=query", "POST", NewHeader(HeaderContentType, "application/x-www-form-urlencoded"),
+		[]byte("tag=x&owner.name=alice"), h)
+	if err != nil {
+		t.Fatalf("Bind returned %v", err)
+	}
+	if dst.Query != "query" || len(dst.Tags) != 1 || dst.Tags[0] != "x" || dst.Owner.Name != "alice" {
+		t.Errorf("dst = %+v", dst)
+	}
+}
+
+func TestBindJSON(t *testing.T) {
+	var dst struct {
+		Name  string
+		Count int
+		ID    string `param:"id"`
+	}
+	var err os.Error
+	h := HandlerFunc(func(req *Request) {
+		req.Param.Set("id", "42")
+		err = Bind(req, &dst)
+		req.Respond(StatusOK)
+	})
+	RunHandler("/", "POST", NewHeader(HeaderContentType, "application/json"),
+		[]byte(`{"Name": "n", "Count": 7}`), h)
+	if err != nil {
+		t.Fatalf("Bind returned %v", err)
+	}
+	if dst.Name != "n" || dst.Count != 7 || dst.ID != "42" {
+		t.Errorf("dst = %+v", dst)
+	}
+
+	RunHandler("/", "POST", NewHeader(HeaderContentType, "application/json"), []byte(`{"Name": `), h)
+	if errs, ok := err.(FieldErrors); !ok || len(errs) != 1 || errs[0].Field != "" {
+		t.Errorf("Bind returned %v, want body error", err)
+	}
+}
+
+func TestBindFiles(t *testing.T) {
+	var dst struct {
+		Title string          `param:"title"`
+		Small *UploadedFile   `param:"small"`
+		All   []*UploadedFile `param:"large"`
+	}
+	var err os.Error
+	h := MultipartHandler(nil, HandlerFunc(func(req *Request) {
+		err = Bind(req, &dst)
+		req.Respond(StatusOK)
+	}))
+	RunHandler("/", "POST", uploadHeader, []byte(uploadBody), h)
+	if err != nil {
+		t.Fatalf("Bind returned %v", err)
+	}
+	if dst.Title != "hello" || dst.Small == nil || dst.Small.Filename != "small.txt" || len(dst.All) != 1 {
+		t.Errorf("dst = %+v", dst)
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values for the SameSite cookie attribute.
+const (
+	SameSiteLax    = "Lax"
+	SameSiteStrict = "Strict"
+	SameSiteNone   = "None"
+)
+
+var (
+	ErrBadCookieName  = os.NewError("twister: bad cookie name")
+	ErrBadCookieValue = os.NewError("twister: bad cookie value")
+	ErrInsecureCookie = os.NewError("twister: cookie attributes require secure attribute")
+	ErrBadHostCookie  = os.NewError("twister: __Host- cookie must have path / and no domain")
+	ErrBadSetCookie   = os.NewError("twister: bad Set-Cookie header")
+)
+
+// isCookieNameByte returns true if c is a valid byte in an RFC 2616 token.
+func isCookieNameByte(c byte) bool {
+	if c <= ' ' || c >= 0x7f {
+		return false
+	}
+	return strings.IndexRune("()<>@,;:\\\"/[]?={}", int(c)) < 0
+}
+
+// isCookieValueByte returns true if c is a valid RFC 6265 cookie-octet.
+func isCookieValueByte(c byte) bool {
+	return c > ' ' && c < 0x7f && c != '"' && c != ',' && c != ';' && c != '\\'
+}
+
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isCookieNameByte(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCookieValue returns the value with surrounding double quotes removed.
+// The boolean result is false if the value is not a valid RFC 6265 cookie
+// value.
+func parseCookieValue(value string) (string, bool) {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		if !isCookieValueByte(value[i]) {
+			return "", false
+		}
+	}
+	return value, true
+}
+
+// parseCookieValues parses cookies from the Cookie header values and adds
+// them to m. The function follows the server requirements in RFC 6265
+// section 4.2. Pairs with an invalid name or value are skipped. If a name
+// appears more than once, then all values are added to m in the order
+// received. Browsers send the cookie with the most specific path first.
+func parseCookieValues(values []string, m Values) os.Error {
+	for _, s := range values {
+		for _, pair := range strings.Split(s, ";", -1) {
+			pair = strings.TrimSpace(pair)
+			i := strings.IndexRune(pair, '=')
+			if i < 0 {
+				continue
+			}
+			name := strings.TrimSpace(pair[:i])
+			if !validCookieName(name) {
+				continue
+			}
+			value, ok := parseCookieValue(strings.TrimSpace(pair[i+1:]))
+			if !ok {
+				continue
+			}
+			m.Add(name, value)
+		}
+	}
+	return nil
+}
+
+// Cookie is a helper for constructing Set-Cookie header values.
+//
+// Cookie supports the attributes in RFC 6265 and the SameSite and
+// Partitioned attributes. Cookies with names starting with the __Secure- or
+// __Host- prefixes must meet the requirements for the prefix. Use the
+// Validate method to check the cookie before rendering it.
+//
+// As a convenience, the NewCookie function returns a cookie with the path
+// attribute set to "/" and the httponly attribute set to true.
+//
+// The following example shows how to set a cookie header using Cookie:
+//
+//  func myHandler(req *web.Request) {
+//      c := web.NewCookie("my-cookie-name", "my-cookie-value").
+//          SameSite(web.SameSiteLax).
+//          String()
+//      w := req.Respond(web.StatusOK, web.HeaderSetCookie, c)
+//      io.WriteString(w, "<html><body>Hello</body></html>")
+//  }
+type Cookie struct {
+	name        string
+	value       string
+	path        string
+	domain      string
+	maxAge      int
+	secure      bool
+	httpOnly    bool
+	sameSite    string
+	partitioned bool
+}
+
+// NewCookie returns a new cookie with the given name and value, the path
+// attribute set to "/" and the httponly attribute set to true. If the name
+// starts with the __Secure- or __Host- prefix, then the secure attribute is
+// set to true.
+func NewCookie(name, value string) *Cookie {
+	secure := strings.HasPrefix(name, "__Secure-") || strings.HasPrefix(name, "__Host-")
+	return &Cookie{name: name, value: value, path: "/", httpOnly: true, secure: secure}
+}
+
+// Path sets the cookie path attribute. The path must either be "" or start with a
+// '/'.  The NewCookie function initializes the path to "/". If the path is "",
+// then the path attribute is not included in the header value.
+func (c *Cookie) Path(path string) *Cookie { c.path = path; return c }
+
+// Domain sets the cookie domain attribute. If the host is "", then the domain
+// attribute is not included in the header value.
+func (c *Cookie) Domain(domain string) *Cookie { c.domain = domain; return c }
+
+// MaxAge specifies the maximum age for a cookie. The cookie is rendered with
+// the Max-Age attribute and, for older browsers, an Expires attribute
+// computed from the current time. If the maximum age is 0, then the
+// attributes are not included in the header value and the browser will
+// handle the cookie as a "session" cookie. If the maximum age is less than
+// zero, then the browser deletes the cookie.
+func (c *Cookie) MaxAge(seconds int) *Cookie { c.maxAge = seconds; return c }
+
+// MaxAgeDays sets the maximum age for the cookie in days.
+func (c *Cookie) MaxAgeDays(days int) *Cookie { return c.MaxAge(days * 60 * 60 * 24) }
+
+// Delete sets the expiration date to a time in the past.
+func (c *Cookie) Delete() *Cookie { return c.MaxAgeDays(-30).HTTPOnly(false) }
+
+// Secure sets the secure attribute.
+func (c *Cookie) Secure(secure bool) *Cookie { c.secure = secure; return c }
+
+// HTTPOnly sets the httponly attribute. The NewCookie function
+// initializes the httponly attribute to true.
+func (c *Cookie) HTTPOnly(httpOnly bool) *Cookie {
+	c.httpOnly = httpOnly
+	return c
+}
+
+// SameSite sets the SameSite attribute to SameSiteLax, SameSiteStrict or
+// SameSiteNone. If the value is "", then the attribute is not included in
+// the header value and browsers use Lax. Cookies with SameSite=None must
+// also have the secure attribute.
+func (c *Cookie) SameSite(sameSite string) *Cookie { c.sameSite = sameSite; return c }
+
+// Partitioned sets the Partitioned attribute. Partitioned cookies are stored
+// separately for each top-level site. Partitioned cookies must also have the
+// secure attribute.
+func (c *Cookie) Partitioned(partitioned bool) *Cookie {
+	c.partitioned = partitioned
+	return c
+}
+
+// Validate returns an error if the cookie name or value is not valid or if
+// the attributes do not meet the requirements of the SameSite and
+// Partitioned attributes or the __Secure- and __Host- name prefixes.
+func (c *Cookie) Validate() os.Error {
+	if !validCookieName(c.name) {
+		return ErrBadCookieName
+	}
+	if _, ok := parseCookieValue(c.value); !ok {
+		return ErrBadCookieValue
+	}
+	switch c.sameSite {
+	case "", SameSiteLax, SameSiteStrict, SameSiteNone:
+	default:
+		return os.NewError("twister: bad SameSite value " + c.sameSite)
+	}
+	needSecure := c.sameSite == SameSiteNone || c.partitioned ||
+		strings.HasPrefix(c.name, "__Secure-") || strings.HasPrefix(c.name, "__Host-")
+	if needSecure && !c.secure {
+		return ErrInsecureCookie
+	}
+	if strings.HasPrefix(c.name, "__Host-") && (c.path != "/" || c.domain != "") {
+		return ErrBadHostCookie
+	}
+	return nil
+}
+
+// String renders the Set-Cookie header value as a string.
+func (c *Cookie) String() string {
+	var buf bytes.Buffer
+
+	buf.WriteString(c.name)
+	buf.WriteByte('=')
+	buf.WriteString(c.value)
+
+	if c.path != "" {
+		buf.WriteString("; Path=")
+		buf.WriteString(c.path)
+	}
+
+	if c.domain != "" {
+		buf.WriteString("; Domain=")
+		buf.WriteString(c.domain)
+	}
+
+	if c.maxAge != 0 {
+		maxAge := c.maxAge
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		buf.WriteString("; Max-Age=")
+		buf.WriteString(strconv.Itoa(maxAge))
+		buf.WriteString("; Expires=")
+		buf.WriteString(FormatDeltaSeconds(c.maxAge))
+	}
+
+	if c.secure {
+		buf.WriteString("; Secure")
+	}
+
+	if c.httpOnly {
+		buf.WriteString("; HttpOnly")
+	}
+
+	if c.sameSite != "" {
+		buf.WriteString("; SameSite=")
+		buf.WriteString(c.sameSite)
+	}
+
+	if c.partitioned {
+		buf.WriteString("; Partitioned")
+	}
+
+	return buf.String()
+}
+
+// SetCookie is a parsed Set-Cookie header value. Use ParseSetCookie or
+// ResponseCookies to parse the header in HTTP clients and tests.
+type SetCookie struct {
+	Name  string
+	Value string
+
+	// Path and Domain attributes. The leading '.' is removed from the domain.
+	Path   string
+	Domain string
+
+	// Max-Age attribute in seconds. Zero means the attribute is not present.
+	// A negative value means that the cookie is deleted.
+	MaxAge int
+
+	// Expires attribute in seconds since the epoch. Zero means the attribute
+	// is not present or could not be parsed.
+	Expires int64
+
+	Secure      bool
+	HTTPOnly    bool
+	SameSite    string
+	Partitioned bool
+}
+
+// expiresLayouts are the date formats accepted for the Expires attribute.
+var expiresLayouts = []string{
+	TimeLayout,
+	"Mon, 02-Jan-2006 15:04:05 MST",
+	"Monday, 02-Jan-06 15:04:05 MST",
+	"Mon Jan _2 15:04:05 2006",
+}
+
+// ParseSetCookie parses a Set-Cookie header value as specified in RFC 6265
+// section 5.2. Unknown attributes are ignored.
+func ParseSetCookie(s string) (*SetCookie, os.Error) {
+	parts := strings.Split(s, ";", -1)
+	i := strings.IndexRune(parts[0], '=')
+	if i < 0 {
+		return nil, ErrBadSetCookie
+	}
+	c := &SetCookie{Name: strings.TrimSpace(parts[0][:i])}
+	if !validCookieName(c.Name) {
+		return nil, ErrBadSetCookie
+	}
+	var ok bool
+	c.Value, ok = parseCookieValue(strings.TrimSpace(parts[0][i+1:]))
+	if !ok {
+		return nil, ErrBadSetCookie
+	}
+
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		name, value := part, ""
+		if i := strings.IndexRune(part, '='); i >= 0 {
+			name, value = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		switch strings.ToLower(name) {
+		case "path":
+			if strings.HasPrefix(value, "/") {
+				c.Path = value
+			}
+		case "domain":
+			c.Domain = strings.ToLower(strings.TrimLeft(value, "."))
+		case "max-age":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			if n <= 0 {
+				n = -1
+			}
+			c.MaxAge = n
+		case "expires":
+			for _, layout := range expiresLayouts {
+				if t, err := time.Parse(layout, value); err == nil {
+					c.Expires = t.Seconds()
+					break
+				}
+			}
+		case "secure":
+			c.Secure = true
+		case "httponly":
+			c.HTTPOnly = true
+		case "samesite":
+			switch strings.ToLower(value) {
+			case "lax":
+				c.SameSite = SameSiteLax
+			case "strict":
+				c.SameSite = SameSiteStrict
+			case "none":
+				c.SameSite = SameSiteNone
+			}
+		case "partitioned":
+			c.Partitioned = true
+		}
+	}
+	return c, nil
+}
+
+// ResponseCookies returns the cookies in the Set-Cookie headers. Invalid
+// header values are skipped.
+func ResponseCookies(header Header) []*SetCookie {
+	var cookies []*SetCookie
+	for _, s := range header[HeaderSetCookie] {
+		if c, err := ParseSetCookie(s); err == nil {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
@@ -0,0 +1,168 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var ParseCookieValuesTests = []struct {
+	values []string
+	m      Values
+}{
+	{[]string{"a=b"}, Values{"a": []string{"b"}}},
+	{[]string{"a=b; c"}, Values{"a": []string{"b"}}},
+	{[]string{"a=b; =c"}, Values{"a": []string{"b"}}},
+	{[]string{"a=b; ; "}, Values{"a": []string{"b"}}},
+	{[]string{"a=b; c=d"}, Values{"a": []string{"b"}, "c": []string{"d"}}},
+	{[]string{"a=b; c=d"}, Values{"a": []string{"b"}, "c": []string{"d"}}},
+	{[]string{"a=b;c=d"}, Values{"a": []string{"b"}, "c": []string{"d"}}},
+	{[]string{" a=b;c=d "}, Values{"a": []string{"b"}, "c": []string{"d"}}},
+	{[]string{"a=b", "c=d"}, Values{"a": []string{"b"}, "c": []string{"d"}}},
+	{[]string{"a=b", "c=x=y"}, Values{"a": []string{"b"}, "c": []string{"x=y"}}},
+	{[]string{`a="b"`}, Values{"a": []string{"b"}}},
+	{[]string{"a="}, Values{"a": []string{""}}},
+	{[]string{"a=b; a=c"}, Values{"a": []string{"b", "c"}}},
+	{[]string{"a=b c; d=e"}, Values{"d": []string{"e"}}},
+	{[]string{`a="b; c=d`}, Values{"c": []string{"d"}}},
+	{[]string{"a b=c; d=e"}, Values{"d": []string{"e"}}},
+	{[]string{"a=b,c; d=e"}, Values{"d": []string{"e"}}},
+}
+
+func TestParseCookieValues(t *testing.T) {
+	for _, pt := range ParseCookieValuesTests {
+		m := make(Values)
+		if err := parseCookieValues(pt.values, m); err != nil {
+			t.Errorf("parseCookieValues(%q) error %q", pt.values, err)
+		}
+		if !reflect.DeepEqual(pt.m, m) {
+			t.Errorf("parseCookieValues(%q) = %q, want %q", pt.values, m, pt.m)
+		}
+	}
+}
+
+var cookieStringTests = []struct {
+	c    *Cookie
+	want string
+}{
+	{NewCookie("a", "b"), "a=b; Path=/; HttpOnly"},
+	{NewCookie("a", "b").Path("").HTTPOnly(false), "a=b"},
+	{NewCookie("a", "b").Domain("example.com").Secure(true).SameSite(SameSiteStrict),
+		"a=b; Path=/; Domain=example.com; Secure; HttpOnly; SameSite=Strict"},
+	{NewCookie("a", "b").SameSite(SameSiteNone).Secure(true).Partitioned(true),
+		"a=b; Path=/; Secure; HttpOnly; SameSite=None; Partitioned"},
+	{NewCookie("__Host-a", "b"), "__Host-a=b; Path=/; Secure; HttpOnly"},
+}
+
+func TestCookieString(t *testing.T) {
+	for _, tt := range cookieStringTests {
+		if s := tt.c.String(); s != tt.want {
+			t.Errorf("String() = %q, want %q", s, tt.want)
+		}
+	}
+
+	s := NewCookie("a", "b").MaxAge(60).String()
+	if !strings.HasPrefix(s, "a=b; Path=/; Max-Age=60; Expires=") {
+		t.Errorf("max age cookie = %q", s)
+	}
+	s = NewCookie("a", "").Delete().String()
+	if !strings.HasPrefix(s, "a=; Path=/; Max-Age=0; Expires=") {
+		t.Errorf("delete cookie = %q", s)
+	}
+}
+
+var cookieValidateTests = []struct {
+	c  *Cookie
+	ok bool
+}{
+	{NewCookie("a", "b"), true},
+	{NewCookie("a", `"b"`), true},
+	{NewCookie("", "b"), false},
+	{NewCookie("a;", "b"), false},
+	{NewCookie("a", "b c"), false},
+	{NewCookie("a", "b").SameSite("Sometimes"), false},
+	{NewCookie("a", "b").SameSite(SameSiteNone), false},
+	{NewCookie("a", "b").SameSite(SameSiteNone).Secure(true), true},
+	{NewCookie("a", "b").Partitioned(true), false},
+	{NewCookie("__Secure-a", "b"), true},
+	{NewCookie("__Secure-a", "b").Secure(false), false},
+	{NewCookie("__Host-a", "b"), true},
+	{NewCookie("__Host-a", "b").Path("/x"), false},
+	{NewCookie("__Host-a", "b").Domain("example.com"), false},
+}
+
+func TestCookieValidate(t *testing.T) {
+	for _, tt := range cookieValidateTests {
+		err := tt.c.Validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("%q.Validate() = %v, want ok=%v", tt.c.String(), err, tt.ok)
+		}
+	}
+}
+
+var parseSetCookieTests = []struct {
+	s    string
+	want *SetCookie
+}{
+	{"a=b", &SetCookie{Name: "a", Value: "b"}},
+	{`a="b"; path=/x; domain=.Example.com; secure; httponly`,
+		&SetCookie{Name: "a", Value: "b", Path: "/x", Domain: "example.com", Secure: true, HTTPOnly: true}},
+	{"a=b; Max-Age=60; SameSite=lax; Partitioned",
+		&SetCookie{Name: "a", Value: "b", MaxAge: 60, SameSite: SameSiteLax, Partitioned: true}},
+	{"a=b; Max-Age=0; Expires=Thu, 01 Jan 1970 00:00:01 GMT",
+		&SetCookie{Name: "a", Value: "b", MaxAge: -1, Expires: 1}},
+	{"a=b; Path=x; Unknown=y", &SetCookie{Name: "a", Value: "b"}},
+	{"a", nil},
+	{"=b", nil},
+	{"a=b c", nil},
+}
+
+func TestParseSetCookie(t *testing.T) {
+	for _, tt := range parseSetCookieTests {
+		c, err := ParseSetCookie(tt.s)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseSetCookie(%q) did not return error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSetCookie(%q) returned error %v", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, tt.want) {
+			t.Errorf("ParseSetCookie(%q) = %+v, want %+v", tt.s, c, tt.want)
+		}
+	}
+}
+
+func TestResponseCookies(t *testing.T) {
+	header := NewHeader(
+		HeaderSetCookie, NewCookie("a", "b").SameSite(SameSiteLax).String(),
+		HeaderSetCookie, "bad",
+		HeaderSetCookie, NewCookie("c", "").Delete().String())
+	cookies := ResponseCookies(header)
+	if len(cookies) != 2 {
+		t.Fatalf("len(cookies) = %d, want 2", len(cookies))
+	}
+	if c := cookies[0]; c.Name != "a" || c.Value != "b" || c.Path != "/" || !c.HTTPOnly || c.SameSite != SameSiteLax {
+		t.Errorf("cookies[0] = %+v", c)
+	}
+	if c := cookies[1]; c.Name != "c" || c.MaxAge != -1 || c.Expires == 0 {
+		t.Errorf("cookies[1] = %+v", c)
+	}
+}
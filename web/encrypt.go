@@ -0,0 +1,162 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+)
+
+// deriveKey returns a key for purpose derived from secret.
+func deriveKey(secret, purpose string) []byte {
+	hm := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(hm, purpose)
+	return hm.Sum()
+}
+
+// encryptedMAC returns the HMAC SHA-256 of context, the initialization vector
+// and the ciphertext.
+func encryptedMAC(secret, context string, ivAndCiphertext []byte) []byte {
+	hm := hmac.New(sha256.New, deriveKey(secret, "twister authentication"))
+	io.WriteString(hm, context)
+	hm.Write([]byte{0})
+	hm.Write(ivAndCiphertext)
+	return hm.Sum()
+}
+
+// EncryptValue returns a string containing value and an expiration time
+// encrypted with AES in CTR mode and authenticated with HMAC SHA-256. The
+// expiration time is computed from the current time and maxAgeSeconds. The
+// encryption and authentication keys are derived from secret. The context is
+// included in the authenticated data so that a value encrypted for one
+// context is not accepted for another. Use the function DecryptValue to
+// extract the value.
+//
+// The returned string is URL-safe base64 encoded and can be used as a cookie
+// value.
+func EncryptValue(secret, context string, maxAgeSeconds int, value string) string {
+	block, err := aes.NewCipher(deriveKey(secret, "twister encryption"))
+	if err != nil {
+		panic("twister: " + err.String())
+	}
+
+	plaintext := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(plaintext, uint64(time.Seconds()+int64(maxAgeSeconds)))
+	copy(plaintext[8:], value)
+
+	p := make([]byte, aes.BlockSize+len(plaintext), aes.BlockSize+len(plaintext)+sha256.Size)
+	iv := p[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		panic("twister: rand read failed")
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(p[aes.BlockSize:], plaintext)
+	p = append(p, encryptedMAC(secret, context, p)...)
+
+	encoded := make([]byte, base64.URLEncoding.EncodedLen(len(p)))
+	base64.URLEncoding.Encode(encoded, p)
+	return string(encoded)
+}
+
+// DecryptValue extracts a value from a string created by EncryptValue. An
+// error is returned if the string was not created with secret and context,
+// the string was modified or the expiration time has elapsed.
+func DecryptValue(secret, context string, encryptedValue string) (string, os.Error) {
+	p := make([]byte, base64.URLEncoding.DecodedLen(len(encryptedValue)))
+	n, err := base64.URLEncoding.Decode(p, []byte(encryptedValue))
+	if err != nil {
+		return "", errVerificationFailure
+	}
+	p = p[:n]
+	if len(p) < aes.BlockSize+8+sha256.Size {
+		return "", errVerificationFailure
+	}
+
+	mac := p[len(p)-sha256.Size:]
+	p = p[:len(p)-sha256.Size]
+	if subtle.ConstantTimeCompare(mac, encryptedMAC(secret, context, p)) != 1 {
+		return "", errVerificationFailure
+	}
+
+	block, err := aes.NewCipher(deriveKey(secret, "twister encryption"))
+	if err != nil {
+		return "", err
+	}
+	plaintext := make([]byte, len(p)-aes.BlockSize)
+	cipher.NewCTR(block, p[:aes.BlockSize]).XORKeyStream(plaintext, p[aes.BlockSize:])
+
+	if int64(binary.BigEndian.Uint64(plaintext)) < time.Seconds() {
+		return "", errVerificationFailure
+	}
+	return string(plaintext[8:]), nil
+}
+
+// Keyring is a list of secrets for signing and encrypting values. The first
+// secret is used to sign and encrypt. All secrets are used to verify and
+// decrypt.
+//
+// To rotate secrets, add a new secret to the front of the list. Remove the
+// old secret from the list after values created with the old secret have
+// expired.
+//
+//  var keyring = web.Keyring{newSecret, oldSecret}
+//
+//  func uidCookieValue(uid string) string {
+//      s := keyring.EncryptValue("uid", uidCookieMaxAge, uid)
+//      return web.NewCookie("uid", s).MaxAge(uidCookieMaxAge).String()
+//  }
+type Keyring []string
+
+// SignValue signs value with the first secret in the keyring. See the
+// SignValue function for more information.
+func (k Keyring) SignValue(context string, maxAgeSeconds int, value string) string {
+	return SignValue(k[0], context, maxAgeSeconds, value)
+}
+
+// VerifyValue extracts a value from a string created by SignValue with any
+// of the secrets in the keyring.
+func (k Keyring) VerifyValue(context string, signedValue string) (string, os.Error) {
+	for _, secret := range k {
+		if value, err := VerifyValue(secret, context, signedValue); err == nil {
+			return value, nil
+		}
+	}
+	return "", errVerificationFailure
+}
+
+// EncryptValue encrypts value with the first secret in the keyring. See the
+// EncryptValue function for more information.
+func (k Keyring) EncryptValue(context string, maxAgeSeconds int, value string) string {
+	return EncryptValue(k[0], context, maxAgeSeconds, value)
+}
+
+// DecryptValue extracts a value from a string created by EncryptValue with
+// any of the secrets in the keyring.
+func (k Keyring) DecryptValue(context string, encryptedValue string) (string, os.Error) {
+	for _, secret := range k {
+		if value, err := DecryptValue(secret, context, encryptedValue); err == nil {
+			return value, nil
+		}
+	}
+	return "", errVerificationFailure
+}
@@ -0,0 +1,65 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptValue(t *testing.T) {
+	secret := "7d1355a24a7bc1ad97a01f0252a5ba23e8b0aa366f1aa4d2c84b78ccdd6743a7"
+	expectedValue := "token/secret"
+	s := EncryptValue(secret, "tok", 3600, expectedValue)
+	if strings.Contains(s, "token") {
+		t.Errorf("encrypted value %q contains plaintext", s)
+	}
+	if value, err := DecryptValue(secret, "tok", s); err != nil || value != expectedValue {
+		t.Error("decrypt failed", err, value)
+	}
+	if _, err := DecryptValue(secret, "tmp", s); err == nil {
+		t.Error("decrypt with wrong context succeeded")
+	}
+	if _, err := DecryptValue("other", "tok", s); err == nil {
+		t.Error("decrypt with wrong secret succeeded")
+	}
+	p := []byte(s)
+	p[30] ^= 1
+	if _, err := DecryptValue(secret, "tok", string(p)); err == nil {
+		t.Error("decrypt of modified value succeeded")
+	}
+	if _, err := DecryptValue(secret, "tok", EncryptValue(secret, "tok", -10, expectedValue)); err == nil {
+		t.Error("decrypt of expired value succeeded")
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	oldKeyring := Keyring{"old"}
+	newKeyring := Keyring{"new", "old"}
+
+	s := oldKeyring.EncryptValue("ctx", 3600, "value")
+	if value, err := newKeyring.DecryptValue("ctx", s); err != nil || value != "value" {
+		t.Error("decrypt with rotated keyring failed", err, value)
+	}
+	s = newKeyring.EncryptValue("ctx", 3600, "value")
+	if _, err := oldKeyring.DecryptValue("ctx", s); err == nil {
+		t.Error("value encrypted with old secret")
+	}
+
+	s = oldKeyring.SignValue("ctx", 3600, "value")
+	if value, err := newKeyring.VerifyValue("ctx", s); err != nil || value != "value" {
+		t.Error("verify with rotated keyring failed", err, value)
+	}
+}
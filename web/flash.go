@@ -0,0 +1,234 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"http"
+	"os"
+	"strings"
+)
+
+// DefaultFlashMaxSize is the default value of FlashOptions.MaxSize.
+const DefaultFlashMaxSize = 2048
+
+// DefaultFlashMaxAge is the default value of FlashOptions.MaxAge.
+const DefaultFlashMaxAge = 5 * 60
+
+var ErrFlashTooLarge = os.NewError("twister: flash messages too large")
+
+// Flash is a one-time message for display on the next page.
+type Flash struct {
+	// Category of the message, for example "error" or "notice".
+	Category string
+	Message  string
+}
+
+// FlashOptions specifies options for FlashHandler.
+type FlashOptions struct {
+	// Secret used to sign the flash cookie with SignValue. Required unless
+	// UseSession is true.
+	Secret string
+
+	// Store messages in the session instead of a cookie. The handler must be
+	// wrapped by SessionHandler.
+	UseSession bool
+
+	// Name of the flash cookie. If "", then "flash" is used.
+	CookieName string
+
+	// Cookie path. If "", then "/" is used.
+	Path string
+
+	// Secure sets the secure attribute on the cookie.
+	Secure bool
+
+	// Maximum age of the messages in seconds. If zero, then
+	// DefaultFlashMaxAge is used.
+	MaxAge int
+
+	// Maximum size in bytes of the encoded messages. If zero, then
+	// DefaultFlashMaxSize is used.
+	MaxSize int
+}
+
+// FlashHandler returns a handler that passes one-time messages from a request
+// to the next request from the same client. The typical use is to set a
+// notice before redirecting after a POST:
+//
+//  func saveHandler(req *web.Request) {
+//      ...
+//      web.AddFlash(req, "notice", "Your changes were saved.")
+//      req.Redirect("/", false)
+//  }
+//
+// The messages added with AddFlash are stored in a signed cookie or in the
+// session when the response is sent. On the next request, FlashHandler loads
+// the messages, makes them available through Flashes and clears the stored
+// messages. Messages survive exactly one request.
+func FlashHandler(options *FlashOptions, h Handler) Handler {
+	fh := &flashHandler{options: *options, h: h}
+	if fh.options.Secret == "" && !fh.options.UseSession {
+		panic("twister: FlashHandler secret not set")
+	}
+	if fh.options.CookieName == "" {
+		fh.options.CookieName = "flash"
+	}
+	if fh.options.Path == "" {
+		fh.options.Path = "/"
+	}
+	if fh.options.MaxAge == 0 {
+		fh.options.MaxAge = DefaultFlashMaxAge
+	}
+	if fh.options.MaxSize == 0 {
+		fh.options.MaxSize = DefaultFlashMaxSize
+	}
+	return fh
+}
+
+type flashHandler struct {
+	options FlashOptions
+	h       Handler
+}
+
+// flashState is stored in the request Env.
+type flashState struct {
+	incoming []Flash
+	outgoing []Flash
+	maxSize  int
+}
+
+// encodeFlashes encodes messages as URL encoded category=message pairs.
+func encodeFlashes(flashes []Flash) string {
+	var buf bytes.Buffer
+	for i, f := range flashes {
+		if i > 0 {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(http.URLEscape(f.Category))
+		buf.WriteByte('=')
+		buf.WriteString(http.URLEscape(f.Message))
+	}
+	return buf.String()
+}
+
+func decodeFlashes(s string) []Flash {
+	var flashes []Flash
+	for _, pair := range strings.Split(s, "&", -1) {
+		a := strings.Split(pair, "=", 2)
+		if len(a) != 2 {
+			continue
+		}
+		category, err := http.URLUnescape(a[0])
+		if err != nil {
+			continue
+		}
+		message, err := http.URLUnescape(a[1])
+		if err != nil {
+			continue
+		}
+		flashes = append(flashes, Flash{Category: category, Message: message})
+	}
+	return flashes
+}
+
+func (fh *flashHandler) cookie(value string, maxAge int) string {
+	return NewCookie(fh.options.CookieName, value).
+		Path(fh.options.Path).
+		Secure(fh.options.Secure).
+		SameSite(SameSiteLax).
+		MaxAge(maxAge).
+		String()
+}
+
+func (fh *flashHandler) ServeWeb(req *Request) {
+	state := &flashState{maxSize: fh.options.MaxSize}
+	req.Env["twister.web.flash"] = state
+
+	if fh.options.UseSession {
+		s := GetSession(req)
+		if s == nil {
+			panic("twister: FlashHandler UseSession requires SessionHandler")
+		}
+		if v := s.Get("flash"); v != "" {
+			state.incoming = decodeFlashes(v)
+			s.Delete("flash")
+		}
+		FilterRespond(req, func(status int, header Header) (int, Header) {
+			if len(state.outgoing) > 0 {
+				s.Set("flash", encodeFlashes(state.outgoing))
+			}
+			return status, header
+		})
+	} else {
+		v := req.Cookie.Get(fh.options.CookieName)
+		if v != "" {
+			if data, err := VerifyValue(fh.options.Secret, "flash", v); err == nil {
+				state.incoming = decodeFlashes(data)
+			}
+		}
+		FilterRespond(req, func(status int, header Header) (int, Header) {
+			if len(state.outgoing) > 0 {
+				value := SignValue(fh.options.Secret, "flash", fh.options.MaxAge, encodeFlashes(state.outgoing))
+				header.Add(HeaderSetCookie, fh.cookie(value, fh.options.MaxAge))
+			} else if v != "" {
+				header.Add(HeaderSetCookie, NewCookie(fh.options.CookieName, "").Path(fh.options.Path).Delete().String())
+			}
+			return status, header
+		})
+	}
+
+	fh.h.ServeWeb(req)
+}
+
+// AddFlash adds a message for the next request. AddFlash returns
+// ErrFlashTooLarge and does not add the message if the encoded messages
+// exceed FlashOptions.MaxSize. AddFlash panics if the request was not handled
+// by FlashHandler.
+func AddFlash(req *Request, category, message string) os.Error {
+	state, _ := req.Env["twister.web.flash"].(*flashState)
+	if state == nil {
+		panic("twister: AddFlash requires FlashHandler")
+	}
+	outgoing := append(state.outgoing, Flash{Category: category, Message: message})
+	if len(encodeFlashes(outgoing)) > state.maxSize {
+		return ErrFlashTooLarge
+	}
+	state.outgoing = outgoing
+	return nil
+}
+
+// Flashes returns the messages added by the previous request in the order
+// they were added. Flashes returns nil if there are no messages or the
+// request was not handled by FlashHandler.
+func Flashes(req *Request) []Flash {
+	state, _ := req.Env["twister.web.flash"].(*flashState)
+	if state == nil {
+		return nil
+	}
+	return state.incoming
+}
+
+// FlashMessages returns the messages in category added by the previous
+// request.
+func FlashMessages(req *Request, category string) []string {
+	var messages []string
+	for _, f := range Flashes(req) {
+		if f.Category == category {
+			messages = append(messages, f.Message)
+		}
+	}
+	return messages
+}
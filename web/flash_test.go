@@ -0,0 +1,119 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testFlashes = []Flash{{"notice", "Saved; a & b = c"}, {"error", "Oops"}, {"notice", "Again"}}
+
+func flashTestHandler(got *[]Flash, notices *[]string) Handler {
+	return HandlerFunc(func(req *Request) {
+		*got = Flashes(req)
+		*notices = FlashMessages(req, "notice")
+		if req.Method == "POST" {
+			for _, f := range testFlashes {
+				if err := AddFlash(req, f.Category, f.Message); err != nil {
+					panic(err)
+				}
+			}
+			req.Redirect("/", false)
+			return
+		}
+		req.Respond(StatusOK)
+	})
+}
+
+func TestFlashCookie(t *testing.T) {
+	var got []Flash
+	var notices []string
+	h := FlashHandler(&FlashOptions{Secret: "secret"}, flashTestHandler(&got, &notices))
+
+	_, header, _ := RunHandler("/", "POST", nil, nil, h)
+	cookies := ResponseCookies(header)
+	if len(cookies) != 1 || cookies[0].Name != "flash" || cookies[0].MaxAge <= 0 {
+		t.Fatalf("POST cookies = %v, want flash cookie", cookies)
+	}
+	if got != nil {
+		t.Errorf("POST flashes = %v, want nil", got)
+	}
+	cookie := "flash=" + cookies[0].Value
+
+	// The next request reads the messages and clears the cookie.
+	_, header, _ = RunHandler("/", "GET", NewHeader(HeaderCookie, cookie), nil, h)
+	if !reflect.DeepEqual(got, testFlashes) {
+		t.Errorf("GET flashes = %v, want %v", got, testFlashes)
+	}
+	if want := []string{"Saved; a & b = c", "Again"}; !reflect.DeepEqual(notices, want) {
+		t.Errorf("GET notices = %v, want %v", notices, want)
+	}
+	cookies = ResponseCookies(header)
+	if len(cookies) != 1 || cookies[0].Name != "flash" || cookies[0].MaxAge >= 0 {
+		t.Errorf("GET cookies = %v, want delete", cookies)
+	}
+
+	// Tampered cookies are ignored.
+	RunHandler("/", "GET", NewHeader(HeaderCookie, strings.Replace(cookie, "Oops", "Boom", 1)), nil, h)
+	if got != nil {
+		t.Errorf("tampered flashes = %v, want nil", got)
+	}
+
+	// No cookie, no flashes, no Set-Cookie.
+	_, header, _ = RunHandler("/", "GET", nil, nil, h)
+	if got != nil || len(ResponseCookies(header)) != 0 {
+		t.Errorf("flashes = %v, header = %v; want none", got, header)
+	}
+}
+
+func TestFlashSession(t *testing.T) {
+	var got []Flash
+	var notices []string
+	h := SessionHandler(NewMemorySessionStore(), nil,
+		FlashHandler(&FlashOptions{UseSession: true}, flashTestHandler(&got, &notices)))
+
+	_, header, _ := RunHandler("/", "POST", nil, nil, h)
+	cookies := ResponseCookies(header)
+	if len(cookies) != 1 || cookies[0].Name != "session" {
+		t.Fatalf("POST cookies = %v, want session cookie", cookies)
+	}
+	cookie := "session=" + cookies[0].Value
+
+	RunHandler("/", "GET", NewHeader(HeaderCookie, cookie), nil, h)
+	if !reflect.DeepEqual(got, testFlashes) {
+		t.Errorf("GET flashes = %v, want %v", got, testFlashes)
+	}
+
+	RunHandler("/", "GET", NewHeader(HeaderCookie, cookie), nil, h)
+	if got != nil {
+		t.Errorf("second GET flashes = %v, want nil", got)
+	}
+}
+
+func TestFlashTooLarge(t *testing.T) {
+	var err1, err2 os.Error
+	h := FlashHandler(&FlashOptions{Secret: "secret", MaxSize: 20}, HandlerFunc(func(req *Request) {
+		err1 = AddFlash(req, "a", "short")
+		err2 = AddFlash(req, "b", strings.Repeat("x", 20))
+		req.Respond(StatusOK)
+	}))
+	RunHandler("/", "POST", nil, nil, h)
+	if err1 != nil || err2 != ErrFlashTooLarge {
+		t.Errorf("AddFlash returned %v, %v; want nil, ErrFlashTooLarge", err1, err2)
+	}
+}
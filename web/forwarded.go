@@ -0,0 +1,219 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net"
+	"strings"
+)
+
+// ForwardedHop describes a hop in the chain of proxies that forwarded the
+// request. The fields are set from the Forwarded header (RFC 7239) or the
+// X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers.
+type ForwardedHop struct {
+	// Address of the client or proxy that sent the request to the next hop.
+	// The port is removed from the address.
+	For string
+
+	// Request protocol and host as received by the next hop or "" if not
+	// specified.
+	Proto string
+	Host  string
+}
+
+// parseCIDRs parses a list of networks in CIDR notation. A bare IP address is
+// interpreted as a network containing a single address.
+func parseCIDRs(cidrs []string) []*net.IPNet {
+	var result []*net.IPNet
+	for _, s := range cidrs {
+		if strings.IndexRune(s, '/') < 0 {
+			if strings.IndexRune(s, ':') < 0 {
+				s = s + "/32"
+			} else {
+				s = s + "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			panic("twister: bad CIDR " + s)
+		}
+		result = append(result, ipnet)
+	}
+	return result
+}
+
+// stripPort removes the port and IPv6 brackets from a node address.
+func stripPort(s string) string {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	if len(s) > 2 && s[0] == '[' && s[len(s)-1] == ']' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseForwarded parses the Forwarded header.
+func parseForwarded(header Header) []ForwardedHop {
+	var hops []ForwardedHop
+	for _, element := range header.GetList(HeaderForwarded) {
+		var hop ForwardedHop
+		for _, pair := range strings.Split(element, ";", -1) {
+			i := strings.IndexRune(pair, '=')
+			if i < 0 {
+				continue
+			}
+			name := strings.ToLower(strings.TrimSpace(pair[:i]))
+			value := UnquoteHeaderValue(strings.TrimSpace(pair[i+1:]))
+			switch name {
+			case "for":
+				hop.For = stripPort(value)
+			case "proto":
+				hop.Proto = strings.ToLower(value)
+			case "host":
+				hop.Host = value
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseXForwarded parses the X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host headers. If the number of protocol or host values matches
+// the number of addresses, then the values are applied to the hops.
+// Otherwise, the first value is returned as the protocol or host for the hop
+// selected as the client. The first value is set by the edge proxy; proxies
+// behind the edge usually append to X-Forwarded-For only.
+func parseXForwarded(header Header) (hops []ForwardedHop, proto, host string) {
+	addrs := header.GetList(HeaderXForwardedFor)
+	if len(addrs) == 0 {
+		return nil, "", ""
+	}
+	hops = make([]ForwardedHop, len(addrs))
+	for i, addr := range addrs {
+		hops[i].For = stripPort(addr)
+	}
+	if protos := header.GetList(HeaderXForwardedProto); len(protos) == len(hops) {
+		for i, p := range protos {
+			hops[i].Proto = strings.ToLower(p)
+		}
+	} else if len(protos) > 0 {
+		proto = strings.ToLower(protos[0])
+	}
+	if hosts := header.GetList(HeaderXForwardedHost); len(hosts) == len(hops) {
+		for i, h := range hosts {
+			hops[i].Host = h
+		}
+	} else if len(hosts) > 0 {
+		host = hosts[0]
+	}
+	return hops, proto, host
+}
+
+// ForwardedHandler returns a handler that sets the request RemoteAddr,
+// URL.Scheme and URL.Host fields from the headers added by trusted proxies.
+// The Forwarded header is used if present, otherwise the X-Forwarded-For,
+// X-Forwarded-Proto and X-Forwarded-Host headers are used.
+//
+// The headers are ignored unless the request is received from an address in
+// one of the trustedCIDRs networks. Starting from the most recent hop, the
+// handler walks the chain of forwarding addresses right-to-left until an
+// address not in a trusted network is found. That address is the client
+// address. Because each trusted proxy appends the address it received the
+// request from, a client cannot spoof its address by sending the headers.
+// Addresses that cannot be parsed, such as "unknown" and obfuscated
+// identifiers, are considered untrusted.
+//
+// The scheme and host are set from the protocol and host recorded by the
+// proxy that received the request from the client. If the number of
+// X-Forwarded-Proto or X-Forwarded-Host values does not match the number of
+// X-Forwarded-For addresses, then the first value is used for the client.
+//
+// The original values of the fields are stored in the request Env with keys
+// "twister.web.OriginalRemoteAddr", "twister.web.OriginalScheme" and
+// "twister.web.OriginalHost". The full chain of hops is stored in the request
+// Env with the key "twister.web.ForwardedHops" as a []ForwardedHop. The last
+// element of the chain is the hop for the connection to the server.
+//
+// ForwardedHandler panics if a network cannot be parsed. A bare IP address is
+// allowed as a network.
+//
+//  h = web.ForwardedHandler([]string{"127.0.0.1", "10.0.0.0/8"}, h)
+func ForwardedHandler(trustedCIDRs []string, h Handler) Handler {
+	return &forwardedHandler{trusted: parseCIDRs(trustedCIDRs), h: h}
+}
+
+type forwardedHandler struct {
+	trusted []*net.IPNet
+	h       Handler
+}
+
+func (fh *forwardedHandler) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range fh.trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fh *forwardedHandler) ServeWeb(req *Request) {
+	remoteAddr := stripPort(req.RemoteAddr)
+	if !fh.isTrusted(remoteAddr) {
+		fh.h.ServeWeb(req)
+		return
+	}
+
+	var proto, host string
+	hops := parseForwarded(req.Header)
+	if len(hops) == 0 {
+		hops, proto, host = parseXForwarded(req.Header)
+	}
+	hops = append(hops, ForwardedHop{For: remoteAddr})
+	req.Env["twister.web.ForwardedHops"] = hops
+
+	// Find the first untrusted hop from the right. If all hops are trusted,
+	// then the client is the leftmost hop.
+	i := len(hops) - 1
+	for i > 0 && fh.isTrusted(hops[i].For) {
+		i -= 1
+	}
+	client := hops[i]
+	if client.Proto == "" {
+		client.Proto = proto
+	}
+	if client.Host == "" {
+		client.Host = host
+	}
+
+	if client.For != "" && client.For != req.RemoteAddr {
+		req.Env["twister.web.OriginalRemoteAddr"] = req.RemoteAddr
+		req.RemoteAddr = client.For
+	}
+	if client.Proto != "" && client.Proto != req.URL.Scheme {
+		req.Env["twister.web.OriginalScheme"] = req.URL.Scheme
+		req.URL.Scheme = client.Proto
+	}
+	if client.Host != "" && client.Host != req.URL.Host {
+		req.Env["twister.web.OriginalHost"] = req.URL.Host
+		req.URL.Host = client.Host
+	}
+	fh.h.ServeWeb(req)
+}
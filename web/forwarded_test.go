@@ -0,0 +1,96 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"io"
+	"testing"
+)
+
+var forwardedTests = []struct {
+	trusted []string
+	header  Header
+	result  string // remoteAddr scheme host
+}{
+	{
+		// Remote address not trusted.
+		trusted: []string{"10.0.0.0/8"},
+		header:  NewHeader(HeaderXForwardedFor, "5.6.7.8"),
+		result:  "1.2.3.4 http example.com",
+	},
+	{
+		trusted: []string{"1.2.3.4"},
+		header: NewHeader(
+			HeaderXForwardedFor, "5.6.7.8",
+			HeaderXForwardedProto, "https",
+			HeaderXForwardedHost, "www.example.com"),
+		result: "5.6.7.8 https www.example.com",
+	},
+	{
+		// The edge proxy sets X-Forwarded-Proto and X-Forwarded-Host. An
+		// internal load balancer appends to X-Forwarded-For only.
+		trusted: []string{"1.2.3.4", "10.0.0.0/8"},
+		header: NewHeader(
+			HeaderXForwardedFor, "5.6.7.8, 10.1.1.1",
+			HeaderXForwardedProto, "https",
+			HeaderXForwardedHost, "www.example.com"),
+		result: "5.6.7.8 https www.example.com",
+	},
+	{
+		// Spoofed address on left is ignored.
+		trusted: []string{"1.2.3.0/24", "10.0.0.0/8"},
+		header:  NewHeader(HeaderXForwardedFor, "9.9.9.9, 5.6.7.8, 10.1.1.1"),
+		result:  "5.6.7.8 http example.com",
+	},
+	{
+		// All hops trusted.
+		trusted: []string{"1.2.3.0/24", "10.0.0.0/8"},
+		header:  NewHeader(HeaderXForwardedFor, "10.2.2.2, 10.1.1.1"),
+		result:  "10.2.2.2 http example.com",
+	},
+	{
+		// Forwarded header takes precedence.
+		trusted: []string{"1.2.3.4"},
+		header: NewHeader(
+			HeaderForwarded, `for=5.6.7.8;proto=https;host=a.example.com`,
+			HeaderXForwardedFor, "9.9.9.9"),
+		result: "5.6.7.8 https a.example.com",
+	},
+	{
+		trusted: []string{"1.2.3.4", "10.0.0.0/8"},
+		header: NewHeader(
+			HeaderForwarded, `for="[2001:db8::1]:4711";proto=https, for=10.1.1.1;proto=http`),
+		result: "2001:db8::1 https example.com",
+	},
+	{
+		trusted: []string{"1.2.3.4"},
+		header:  NewHeader(HeaderForwarded, `for=unknown`),
+		result:  "unknown http example.com",
+	},
+}
+
+func forwardedTestHandler(req *Request) {
+	io.WriteString(req.Respond(StatusOK), req.RemoteAddr+" "+req.URL.Scheme+" "+req.URL.Host)
+}
+
+func TestForwardedHandler(t *testing.T) {
+	for _, tt := range forwardedTests {
+		h := ForwardedHandler(tt.trusted, HandlerFunc(forwardedTestHandler))
+		_, _, body := RunHandler("http://example.com/", "GET", tt.header, nil, h)
+		if string(body) != tt.result {
+			t.Errorf("trusted=%v header=%v, got %q, want %q", tt.trusted, tt.header, body, tt.result)
+		}
+	}
+}
@@ -62,6 +62,7 @@ var (
 	ErrBadHeaderLine  = os.NewError("could not parse HTTP header line")
 	ErrHeaderTooLong  = os.NewError("HTTP header value too long")
 	ErrHeadersTooLong = os.NewError("too many HTTP headers")
+	ErrHeaderTooLarge = os.NewError("HTTP header too large")
 )
 
 // Header maps header names to a slice of header values. 
@@ -227,9 +228,20 @@ func (m Header) WriteHttpHeader(w io.Writer) os.Error {
 	return err
 }
 
+// DefaultMaxHeaderBytes is the maximum number of bytes read by
+// ParseHttpHeader.
+const DefaultMaxHeaderBytes = 1 << 20
+
 // ParseHttpHeader parses the HTTP headers and appends the values to the
 // supplied map. Header names are converted to canonical format.
-func (m Header) ParseHttpHeader(br *bufio.Reader) (err os.Error) {
+func (m Header) ParseHttpHeader(br *bufio.Reader) os.Error {
+	return m.ParseHttpHeaderLimit(br, DefaultMaxHeaderBytes)
+}
+
+// ParseHttpHeaderLimit parses the HTTP headers and appends the values to the
+// supplied map. ErrHeaderTooLarge is returned if the header, including line
+// terminators, is longer than maxBytes. 
+func (m Header) ParseHttpHeaderLimit(br *bufio.Reader, maxBytes int) (err os.Error) {
 
 	const (
 		// Max size for header line
@@ -254,6 +266,11 @@ func (m Header) ParseHttpHeader(br *bufio.Reader) (err os.Error) {
 			return err
 		}
 
+		maxBytes -= len(p)
+		if maxBytes < 0 {
+			return ErrHeaderTooLarge
+		}
+
 		// remove line terminator
 		if len(p) >= 2 && p[len(p)-2] == '\r' {
 			// \r\n
@@ -374,6 +391,7 @@ const (
 	HeaderEtag                 = "Etag"
 	HeaderExpect               = "Expect"
 	HeaderExpires              = "Expires"
+	HeaderForwarded            = "Forwarded"
 	HeaderFrom                 = "From"
 	HeaderHost                 = "Host"
 	HeaderIfMatch              = "If-Match"
@@ -389,6 +407,9 @@ const (
 	HeaderProxyAuthenticate    = "Proxy-Authenticate"
 	HeaderProxyAuthorization   = "Proxy-Authorization"
 	HeaderRange                = "Range"
+	HeaderRateLimitLimit       = "Ratelimit-Limit"
+	HeaderRateLimitRemaining   = "Ratelimit-Remaining"
+	HeaderRateLimitReset       = "Ratelimit-Reset"
 	HeaderReferer              = "Referer"
 	HeaderRetryAfter           = "Retry-After"
 	HeaderSecWebSocketKey1     = "Sec-Websocket-Key1"
@@ -405,6 +426,10 @@ const (
 	HeaderVia                  = "Via"
 	HeaderWWWAuthenticate      = "Www-Authenticate"
 	HeaderWarning              = "Warning"
+	HeaderXContentTypeOptions  = "X-Content-Type-Options"
+	HeaderXForwardedFor        = "X-Forwarded-For"
+	HeaderXForwardedHost       = "X-Forwarded-Host"
+	HeaderXForwardedProto      = "X-Forwarded-Proto"
 	HeaderXXSRFToken           = "X-Xsrftoken"
 )
 
@@ -17,6 +17,7 @@ package web
 import (
 	"bufio"
 	"bytes"
+	"os"
 	"reflect"
 	"testing"
 )
@@ -184,3 +185,23 @@ func TestGetAccept(t *testing.T) {
 		}
 	}
 }
+
+var parseHttpHeaderLimitTests = []struct {
+	s        string
+	maxBytes int
+	err      os.Error
+}{
+	{"A: b\r\n\r\n", 8, nil},
+	{"A: b\r\n\r\n", 7, ErrHeaderTooLarge},
+	{"A: b\r\nC: d\r\n\r\n", 12, ErrHeaderTooLarge},
+}
+
+func TestParseHttpHeaderLimit(t *testing.T) {
+	for _, tt := range parseHttpHeaderLimitTests {
+		b := bufio.NewReader(bytes.NewBufferString(tt.s))
+		err := Header{}.ParseHttpHeaderLimit(b, tt.maxBytes)
+		if err != tt.err {
+			t.Errorf("ParseHttpHeaderLimit(%q, %d) = %v, want %v", tt.s, tt.maxBytes, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"json"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var ErrNotJSON = os.NewError("twister: request content type is not JSON")
+
+const (
+	// Name of the request parameter that enables indented JSON responses.
+	JSONPrettyParam = "pretty"
+
+	// Name of the request parameter that holds the JSONP callback.
+	JSONPCallbackParam = "callback"
+)
+
+// UnknownFieldError is returned by DecodeJSONStrict when the request body
+// contains a member that does not correspond to a field in the destination.
+type UnknownFieldError struct {
+	// Path of the member, for example "owner.name" or "items[2].count".
+	Field string
+}
+
+func (e *UnknownFieldError) String() string {
+	return "json: unknown field " + strconv.Quote(e.Field)
+}
+
+// DecodeJSON decodes the JSON request body to v. The request content type
+// must be application/json or a media type with the +json suffix; otherwise
+// ErrNotJSON is returned. If the body is longer than maxLen, then
+// ErrRequestEntityTooLarge is returned. A negative maxLen disables the limit.
+func DecodeJSON(req *Request, maxLen int, v interface{}) os.Error {
+	p, err := jsonBody(req, maxLen)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(p, v)
+}
+
+// DecodeJSONStrict is like DecodeJSON, except that an UnknownFieldError is
+// returned when the body contains an object member that does not correspond
+// to a struct field in v.
+func DecodeJSONStrict(req *Request, maxLen int, v interface{}) os.Error {
+	p, err := jsonBody(req, maxLen)
+	if err != nil {
+		return err
+	}
+	var raw interface{}
+	if err := json.Unmarshal(p, &raw); err != nil {
+		return err
+	}
+	if field := unknownJSONField(raw, reflect.TypeOf(v), ""); field != "" {
+		return &UnknownFieldError{Field: field}
+	}
+	return json.Unmarshal(p, v)
+}
+
+func jsonBody(req *Request, maxLen int) ([]byte, os.Error) {
+	if !isJSONContentType(req.ContentType) {
+		return nil, ErrNotJSON
+	}
+	return req.BodyBytes(maxLen)
+}
+
+// unknownJSONField returns the path of the first member in the decoded value
+// v that does not have a corresponding field in type t.
+func unknownJSONField(v interface{}, t reflect.Type, path string) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, e := range v {
+			p := name
+			if path != "" {
+				p = path + "." + name
+			}
+			var et reflect.Type
+			switch t.Kind() {
+			case reflect.Map:
+				et = t.Elem()
+			case reflect.Struct:
+				f, ok := jsonField(t, name)
+				if !ok {
+					return p
+				}
+				et = f.Type
+			default:
+				return ""
+			}
+			if s := unknownJSONField(e, et, p); s != "" {
+				return s
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return ""
+		}
+		for i, e := range v {
+			if s := unknownJSONField(e, t.Elem(), path+"["+strconv.Itoa(i)+"]"); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// jsonField returns the field in struct type t that the json package decodes
+// the member name to.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	var fold reflect.StructField
+	found := false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		key := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if i := strings.Index(tag, ","); i >= 0 {
+				tag = tag[:i]
+			}
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				key = tag
+			}
+		}
+		if key == name {
+			return f, true
+		}
+		if !found && strings.ToLower(key) == strings.ToLower(name) {
+			fold, found = f, true
+		}
+	}
+	return fold, found
+}
+
+// marshalJSON encodes v, indented if the request has a true pretty parameter.
+func marshalJSON(req *Request, v interface{}) ([]byte, os.Error) {
+	switch req.Param.Get(JSONPrettyParam) {
+	case "", "0", "false":
+		return json.Marshal(v)
+	}
+	p, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(p, '\n'), nil
+}
+
+// RespondJSON responds to the request with v encoded as JSON. The response
+// is indented when the request has the parameter "pretty=1". If v cannot be
+// encoded, then RespondJSON responds with StatusInternalServerError and
+// returns the error.
+func RespondJSON(req *Request, status int, v interface{}, headerKeysAndValues ...string) os.Error {
+	p, err := marshalJSON(req, v)
+	if err != nil {
+		req.Error(StatusInternalServerError, err)
+		return err
+	}
+	header := NewHeader(headerKeysAndValues...)
+	header.Set(HeaderContentType, "application/json; charset=utf-8")
+	_, err = req.Responder.Respond(status, header).Write(p)
+	return err
+}
+
+// RespondJSONP responds with v wrapped in a call to the function named by the
+// callback request parameter. If the parameter is not present, then
+// RespondJSONP responds with plain JSON. Callback names are restricted to
+// JavaScript identifiers separated by dots; requests with other names are
+// rejected with StatusBadRequest.
+func RespondJSONP(req *Request, status int, v interface{}, headerKeysAndValues ...string) os.Error {
+	callback := req.Param.Get(JSONPCallbackParam)
+	if callback == "" {
+		return RespondJSON(req, status, v, headerKeysAndValues...)
+	}
+	if !validJSONPCallback(callback) {
+		err := os.NewError("twister: bad JSONP callback")
+		req.Error(StatusBadRequest, err)
+		return err
+	}
+	p, err := marshalJSON(req, v)
+	if err != nil {
+		req.Error(StatusInternalServerError, err)
+		return err
+	}
+	// U+2028 and U+2029 are valid in JSON strings, but not in JavaScript.
+	p = bytes.Replace(p, []byte("\u2028"), []byte(`\u2028`), -1)
+	p = bytes.Replace(p, []byte("\u2029"), []byte(`\u2029`), -1)
+
+	header := NewHeader(headerKeysAndValues...)
+	header.Set(HeaderContentType, "application/javascript; charset=utf-8")
+	header.Set(HeaderXContentTypeOptions, "nosniff")
+	w := req.Responder.Respond(status, header)
+	// The leading comment defends against content sniffing attacks that
+	// start the response with a crafted callback name.
+	if _, err := w.Write([]byte("/**/" + callback + "(")); err != nil {
+		return err
+	}
+	if _, err := w.Write(p); err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(");"))
+	return err
+}
+
+// validJSONPCallback returns true if s is a sequence of JavaScript
+// identifiers separated by dots.
+func validJSONPCallback(s string) bool {
+	if len(s) > 128 {
+		return false
+	}
+	start := true
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch {
+		case b == '.':
+			if start {
+				return false
+			}
+			start = true
+		case b == '_' || b == '$' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z':
+			start = false
+		case '0' <= b && b <= '9':
+			if start {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return !start
+}
+
+// acceptsJSON returns true if the request Accept header includes JSON. If
+// wildcard is true, then a missing Accept header and an Accept header with
+// only the */* and application/* media ranges also match JSON. Browsers list
+// text/html before */*, so their requests do not match. Media types with
+// q=0 are refused.
+func acceptsJSON(req *Request, wildcard bool) bool {
+	specific := false
+	for _, a := range req.Header.GetAccept(HeaderAccept) {
+		if q, ok := a.Param["q"]; ok {
+			if f, err := strconv.Atof64(q); err == nil && f == 0 {
+				specific = true
+				continue
+			}
+		}
+		mediaType := strings.ToLower(a.Value)
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+		if mediaType != "*/*" && mediaType != "application/*" {
+			specific = true
+		}
+	}
+	return wildcard && !specific
+}
+
+// Problem is an RFC 7807 problem details object. Pass a *Problem as the
+// reason to Request.Error to control the response from ProblemErrorHandler:
+//
+//  req.Error(web.StatusForbidden, &web.Problem{
+//      Type:   "https://example.com/probs/out-of-credit",
+//      Title:  "You do not have enough credit.",
+//      Detail: "Your current balance is 30, but that costs 50.",
+//  })
+type Problem struct {
+	// URI reference that identifies the problem type. If "", then
+	// "about:blank" is used.
+	Type string
+
+	// Short summary of the problem type. If "", then the status text is
+	// used.
+	Title string
+
+	// HTTP status code. If zero, then the status passed to the error
+	// handler is used.
+	Status int
+
+	// Explanation specific to this occurrence of the problem.
+	Detail string
+
+	// URI reference that identifies this occurrence of the problem. If "",
+	// then the request path is used.
+	Instance string
+
+	// Additional members.
+	Extensions map[string]interface{}
+}
+
+func (p *Problem) String() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+// ProblemErrorHandler returns an error handler that responds with an RFC 7807
+// application/problem+json body when the client accepts JSON. Requests that
+// do not accept JSON are passed to h. If h is nil, then the default error
+// handler is used.
+//
+// If the reason is a *Problem, then the members are taken from the problem.
+// If the reason is FieldErrors, then the field messages are included in the
+// "fields" member. Otherwise, the reason is included as the detail for
+// statuses below 500. Details of server errors are logged, not sent to the
+// client. Use FieldErrorHandler instead to respond with
+// application/problem+json for validation errors only.
+func ProblemErrorHandler(h ErrorHandler) ErrorHandler {
+	if h == nil {
+		h = defaultErrorHandler
+	}
+	return func(req *Request, status int, reason os.Error, header Header) {
+		if !acceptsJSON(req, false) {
+			h(req, status, reason, header)
+			return
+		}
+		respondProblem(req, status, reason, header, h)
+	}
+}
+
+// respondProblem responds with an application/problem+json body. If the body
+// cannot be encoded, then the error is passed to h.
+func respondProblem(req *Request, status int, reason os.Error, header Header, h ErrorHandler) {
+	if status >= 500 {
+		log.Println("ERROR", req.URL, status, reason)
+	}
+
+	var problem Problem
+	switch reason := reason.(type) {
+	case *Problem:
+		problem = *reason
+	case FieldErrors:
+		problem.Extensions = map[string]interface{}{"fields": reason.Map()}
+	case nil:
+	default:
+		if status < 500 {
+			problem.Detail = reason.String()
+		}
+	}
+	if problem.Status == 0 {
+		problem.Status = status
+	}
+	if problem.Type == "" {
+		problem.Type = "about:blank"
+	}
+	if problem.Title == "" {
+		problem.Title = StatusText(problem.Status)
+	}
+	if problem.Instance == "" {
+		problem.Instance = req.URL.Path
+	}
+
+	m := make(map[string]interface{})
+	for k, v := range problem.Extensions {
+		m[k] = v
+	}
+	m["type"] = problem.Type
+	m["title"] = problem.Title
+	m["status"] = problem.Status
+	m["instance"] = problem.Instance
+	if problem.Detail != "" {
+		m["detail"] = problem.Detail
+	}
+	p, err := json.Marshal(m)
+	if err != nil {
+		h(req, status, reason, header)
+		return
+	}
+	header.Set(HeaderContentType, "application/problem+json")
+	req.Responder.Respond(problem.Status, header).Write(p)
+}
@@ -0,0 +1,154 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"json"
+	"os"
+	"testing"
+)
+
+type jsonTarget struct {
+	Name  string `json:"name"`
+	Count int
+	Items []struct {
+		ID string `json:"id"`
+	} `json:"items"`
+	Extra map[string]interface{} `json:"extra"`
+}
+
+var decodeJSONTests = []struct {
+	contentType string
+	body        string
+	strict      bool
+	err         string
+}{
+	{"application/json", `{"name": "a", "count": 1, "items": [{"id": "x"}], "extra": {"any": 1}}`, true, ""},
+	{"application/vnd.api+json", `{"name": "a"}`, true, ""},
+	{"text/plain", `{"name": "a"}`, false, ErrNotJSON.String()},
+	{"application/json", `{"name": "a", "other": 1}`, false, ""},
+	{"application/json", `{"name": "a", "other": 1}`, true, `json: unknown field "other"`},
+	{"application/json", `{"items": [{"id": "x"}, {"id": "y", "size": 2}]}`, true, `json: unknown field "items[1].size"`},
+	{"application/json", `{"name": "` + string(make([]byte, 100)) + `"}`, false, ErrRequestEntityTooLarge.String()},
+}
+
+func TestDecodeJSON(t *testing.T) {
+	for _, tt := range decodeJSONTests {
+		var err os.Error
+		RunHandler("/", "POST", NewHeader(HeaderContentType, tt.contentType), []byte(tt.body),
+			HandlerFunc(func(req *Request) {
+				var v jsonTarget
+				if tt.strict {
+					err = DecodeJSONStrict(req, 100, &v)
+				} else {
+					err = DecodeJSON(req, 100, &v)
+				}
+				if err == nil && v.Name != "a" && len(v.Items) == 0 {
+					t.Errorf("%s: value not decoded", tt.body)
+				}
+				req.Respond(StatusOK)
+			}))
+		s := ""
+		if err != nil {
+			s = err.String()
+		}
+		if s != tt.err {
+			t.Errorf("%s: err = %q, want %q", tt.body, s, tt.err)
+		}
+	}
+}
+
+var respondJSONTests = []struct {
+	url         string
+	status      int
+	contentType string
+	body        string
+}{
+	{"/", StatusOK, "application/json; charset=utf-8", `{"a":1}`},
+	{"/?pretty=1", StatusOK, "application/json; charset=utf-8", "{\n  \"a\": 1\n}\n"},
+	{"/?callback=cb.f_1", StatusOK, "application/javascript; charset=utf-8", `/**/cb.f_1({"a":1});`},
+	{"/?callback=alert(1)", StatusBadRequest, "text/plain; charset=utf-8", "Bad Request"},
+	{"/?callback=1a", StatusBadRequest, "text/plain; charset=utf-8", "Bad Request"},
+}
+
+func TestRespondJSON(t *testing.T) {
+	h := HandlerFunc(func(req *Request) {
+		RespondJSONP(req, StatusOK, map[string]int{"a": 1})
+	})
+	for _, tt := range respondJSONTests {
+		status, header, body := RunHandler(tt.url, "GET", nil, nil, h)
+		if status != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.url, status, tt.status)
+		}
+		if ct := header.Get(HeaderContentType); ct != tt.contentType {
+			t.Errorf("%s: content type = %q, want %q", tt.url, ct, tt.contentType)
+		}
+		if string(body) != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.url, body, tt.body)
+		}
+	}
+}
+
+func TestProblemErrorHandler(t *testing.T) {
+	tests := []struct {
+		accept string
+		reason os.Error
+		status int
+		want   map[string]interface{}
+	}{
+		{"text/html", os.NewError("bad"), StatusBadRequest, nil},
+		{"application/json;q=0", os.NewError("bad"), StatusBadRequest, nil},
+		{"application/json", os.NewError("bad"), StatusBadRequest, map[string]interface{}{
+			"type": "about:blank", "title": "Bad Request", "status": float64(400), "instance": "/p", "detail": "bad"}},
+		{"application/problem+json", os.NewError("secret"), StatusInternalServerError, map[string]interface{}{
+			"type": "about:blank", "title": "Internal Server Error", "status": float64(500), "instance": "/p"}},
+		{"application/json", &Problem{Type: "urn:credit", Title: "No credit", Status: StatusForbidden,
+			Extensions: map[string]interface{}{"balance": 30}}, StatusBadRequest, map[string]interface{}{
+			"type": "urn:credit", "title": "No credit", "status": float64(403), "instance": "/p", "balance": float64(30)}},
+	}
+	for i, tt := range tests {
+		reason := tt.reason
+		status := tt.status
+		h := SetErrorHandler(ProblemErrorHandler(nil), HandlerFunc(func(req *Request) {
+			req.Error(status, reason)
+		}))
+		rstatus, header, body := RunHandler("/p", "GET", NewHeader(HeaderAccept, tt.accept), nil, h)
+		if tt.want == nil {
+			if ct := header.Get(HeaderContentType); ct != "text/plain; charset=utf-8" {
+				t.Errorf("%d: content type = %q, want text/plain", i, ct)
+			}
+			continue
+		}
+		if ct := header.Get(HeaderContentType); ct != "application/problem+json" {
+			t.Errorf("%d: content type = %q, want application/problem+json", i, ct)
+		}
+		if rstatus != int(tt.want["status"].(float64)) {
+			t.Errorf("%d: status = %d, want %v", i, rstatus, tt.want["status"])
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("%d: Unmarshal(%q) returned %v", i, body, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%d: body = %s, want %v", i, body, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("%d: %s = %v, want %v", i, k, got[k], v)
+			}
+		}
+	}
+}
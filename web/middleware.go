@@ -16,6 +16,7 @@ package web
 
 import (
 	"io"
+	"net"
 	"os"
 )
 
@@ -65,6 +66,11 @@ func SetErrorHandler(e ErrorHandler, h Handler) Handler {
 // header is not present.
 //
 // The header names must be in canonical header name format.
+//
+// ProxyHeaderHandler trusts the headers from all clients. If the application
+// can be reached without going through the proxy, then clients can spoof
+// their address. Use ForwardedHandler to only accept the headers from trusted
+// proxies.
 // 
 // Here's an example of how to use this handler with Nginx. In the nginx proxy
 // configuration, specify a header for the IP address and scheme. The host
@@ -145,7 +151,9 @@ type formHandler struct {
 func (h formHandler) ServeWeb(req *Request) {
 	if err := req.ParseForm(h.maxRequestBodyLen); err != nil {
 		status := StatusBadRequest
-		if err == ErrRequestEntityTooLarge {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			status = StatusRequestTimeout
+		} else if err == ErrRequestEntityTooLarge {
 			status = StatusRequestEntityTooLarge
 			if e := req.Header.Get(HeaderExpect); e != "" {
 				status = StatusExpectationFailed
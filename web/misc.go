@@ -18,7 +18,11 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"hash"
 	"io"
 	"os"
 	"strconv"
@@ -84,6 +88,9 @@ const (
 	StatusUnsupportedMediaType         = 415
 	StatusRequestedRangeNotSatisfiable = 416
 	StatusExpectationFailed            = 417
+	StatusUnprocessableEntity          = 422
+	StatusTooManyRequests              = 429
+	StatusRequestHeaderFieldsTooLarge  = 431
 	StatusInternalServerError          = 500
 	StatusNotImplemented               = 501
 	StatusBadGateway                   = 502
@@ -127,6 +134,9 @@ var statusText = map[int]string{
 	StatusUnsupportedMediaType:         "Unsupported Media Type",
 	StatusRequestedRangeNotSatisfiable: "Requested Range Not Satisfiable",
 	StatusExpectationFailed:            "Expectation Failed",
+	StatusUnprocessableEntity:          "Unprocessable Entity",
+	StatusTooManyRequests:              "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge:  "Request Header Fields Too Large",
 	StatusInternalServerError:          "Internal Server Error",
 	StatusNotImplemented:               "Not Implemented",
 	StatusBadGateway:                   "Bad Gateway",
@@ -160,51 +170,18 @@ const (
 	ProtocolVersion11 = 1001 // HTTP/1.1
 )
 
-// parseCookieValues parses cookies from values and adds them to m. The
-// function supports the Netscape draft specification for cookies
-// (http://goo.gl/1WSx3). 
-func parseCookieValues(values []string, m Values) os.Error {
-	for _, s := range values {
-		key := ""
-		begin := 0
-		end := 0
-		for i := 0; i < len(s); i++ {
-			switch s[i] {
-			case ' ', '\t':
-				// leading whitespace?
-				if begin == end {
-					begin = i + 1
-					end = begin
-				}
-			case '=':
-				if key == "" {
-					key = s[begin:end]
-					begin = i + 1
-					end = begin
-				} else {
-					end += 1
-				}
-			case ';':
-				if len(key) > 0 && begin < end {
-					value := s[begin:end]
-					m.Add(key, value)
-				}
-				key = ""
-				begin = i + 1
-				end = begin
-			default:
-				end = i + 1
-			}
-		}
-		if len(key) > 0 && begin < end {
-			m.Add(key, s[begin:end])
-		}
-	}
-	return nil
+// signature returns the HMAC SHA-256 signature of key, expiration and value.
+func signature(secret, key, expiration, value string) string {
+	return signatureWith(hmac.New(sha256.New, []byte(secret)), key, expiration, value)
 }
 
-func signature(secret, key, expiration, value string) string {
-	hm := hmac.NewSHA1([]byte(secret))
+// legacySignature returns the HMAC SHA-1 signature used by earlier versions
+// of SignValue.
+func legacySignature(secret, key, expiration, value string) string {
+	return signatureWith(hmac.NewSHA1([]byte(secret)), key, expiration, value)
+}
+
+func signatureWith(hm hash.Hash, key, expiration, value string) string {
 	io.WriteString(hm, key)
 	hm.Write([]byte{0})
 	io.WriteString(hm, expiration)
@@ -215,9 +192,10 @@ func signature(secret, key, expiration, value string) string {
 
 // SignValue returns a string containing value, an expiration time and a
 // signature. The expiration time is computed from the current time and
-// maxAgeSeconds.  The signature is an HMAC SHA-1 signature of value, context
+// maxAgeSeconds.  The signature is an HMAC SHA-256 signature of value, context
 // and the expiration time. Use the function VerifyValue to extract the value,
-// check the expiration time and verify the signature.
+// check the expiration time and verify the signature. The value is not
+// encrypted. Use EncryptValue to hide the value from the client.
 // 
 // SignValue can be used to store credentials in a cookie:
 //
@@ -247,6 +225,8 @@ var errVerificationFailure = os.NewError("verification failed")
 
 // VerifyValue extracts a value from a string created by SignValue. An error is
 // returned if the expiration time has elapsed or the signature is not correct.
+// Values signed with HMAC SHA-1 by earlier versions of SignValue are also
+// accepted.
 func VerifyValue(secret, context string, signedValue string) (string, os.Error) {
 	a := strings.Split(signedValue, "~", 3)
 	if len(a) != 3 {
@@ -256,121 +236,22 @@ func VerifyValue(secret, context string, signedValue string) (string, os.Error)
 	if err != nil || expiration < time.Seconds() {
 		return "", errVerificationFailure
 	}
-	expectedSig := signature(secret, context, a[1], a[2])
-	actualSig := a[0]
-	if len(actualSig) != len(expectedSig) {
+	var expectedSig string
+	switch len(a[0]) {
+	case sha256.Size * 2:
+		expectedSig = signature(secret, context, a[1], a[2])
+	case sha1.Size * 2:
+		expectedSig = legacySignature(secret, context, a[1], a[2])
+	default:
 		return "", errVerificationFailure
 	}
 	// Time independent compare
-	eq := 0
-	for i := 0; i < len(actualSig); i++ {
-		eq = eq | (int(actualSig[i]) ^ int(expectedSig[i]))
-	}
-	if eq != 0 {
+	if subtle.ConstantTimeCompare([]byte(a[0]), []byte(expectedSig)) != 1 {
 		return "", errVerificationFailure
 	}
 	return a[2], nil
 }
 
-// Cookie is a helper for constructing Set-Cookie header values. 
-// 
-// Cookie supports the ancient Netscape draft specification for cookies
-// (http://goo.gl/1WSx3) and the modern HttpOnly attribute
-// (http://www.owasp.org/index.php/HttpOnly). Cookie does not attempt to
-// support any RFC for cookies because the RFCs are not supported by popular
-// browsers.
-//
-// As a convenience, the NewCookie function returns a cookie with the path
-// attribute set to "/" and the httponly attribute set to true. 
-//
-// The following example shows how to set a cookie header using Cookie:
-//
-//  func myHandler(req *web.Request) {
-//      c := web.NewCookie("my-cookie-name", "my-cookie-value").String()
-//      w := req.Respond(web.StatusOK, web.HeaderSetCookie, c)
-//      io.WriteString(w, "<html><body>Hello</body></html>")
-//  }
-type Cookie struct {
-	name     string
-	value    string
-	path     string
-	domain   string
-	maxAge   int
-	secure   bool
-	httpOnly bool
-}
-
-// NewCookie returns a new cookie with the given name and value, the path
-// attribute set to "/" and the httponly attribute set to true.
-func NewCookie(name, value string) *Cookie {
-	return &Cookie{name: name, value: value, path: "/", httpOnly: true}
-}
-
-// Path sets the cookie path attribute. The path must either be "" or start with a
-// '/'.  The NewCookie function initializes the path to "/". If the path is "",
-// then the path attribute is not included in the header value. 
-func (c *Cookie) Path(path string) *Cookie { c.path = path; return c }
-
-// Domain sets the cookie domain attribute. If the host is "", then the domain
-// attribute is not included in the header value. 
-func (c *Cookie) Domain(domain string) *Cookie { c.domain = domain; return c }
-
-// MaxAge specifies the maximum age for a cookie. The age is converted to an
-// absolute expiration time when the header value is rendered. If the maximum
-// age is 0, then the expiration time is not included in the header value
-// and the browser will handle the cookie as a "session" cookie.
-func (c *Cookie) MaxAge(seconds int) *Cookie { c.maxAge = seconds; return c }
-
-// MaxAgeDays sets the maximum age for the cookie in days.
-func (c *Cookie) MaxAgeDays(days int) *Cookie { return c.MaxAge(days * 60 * 60 * 24) }
-
-// Delete sets the expiration date to a time in the past. 
-func (c *Cookie) Delete() *Cookie { return c.MaxAgeDays(-30).HTTPOnly(false) }
-
-// Secure sets the secure attribute. 
-func (c *Cookie) Secure(secure bool) *Cookie { c.secure = secure; return c }
-
-// HTTPOnly sets the httponly attribute. The NewCookie function
-// initializes the httponly attribute to true.
-func (c *Cookie) HTTPOnly(httpOnly bool) *Cookie {
-	c.httpOnly = httpOnly
-	return c
-}
-
-// String renders the Set-Cookie header value as a string.
-func (c *Cookie) String() string {
-	var buf bytes.Buffer
-
-	buf.WriteString(c.name)
-	buf.WriteByte('=')
-	buf.WriteString(c.value)
-
-	if c.path != "" {
-		buf.WriteString("; path=")
-		buf.WriteString(c.path)
-	}
-
-	if c.domain != "" {
-		buf.WriteString("; domain=")
-		buf.WriteString(c.domain)
-	}
-
-	if c.maxAge != 0 {
-		buf.WriteString("; expires=")
-		buf.WriteString(FormatDeltaSeconds(c.maxAge))
-	}
-
-	if c.secure {
-		buf.WriteString("; secure")
-	}
-
-	if c.httpOnly {
-		buf.WriteString("; HttpOnly")
-	}
-
-	return buf.String()
-}
-
 // HTMLEscapeString returns s with special HTML characters escaped. 
 func HTMLEscapeString(s string) string {
 	escape := false
@@ -427,7 +308,8 @@ func HTMLEscapeString(s string) string {
 // set to the token. The application should use the value of the paramName
 // parameter when generating hidden fields in POSTed forms.
 //
-// CheckXSRF also validates PUT and DELETE requests. 
+// CheckXSRF also validates PUT, PATCH, DELETE and other requests with
+// methods that are not safe. XSRFHandler provides stronger protection.
 //
 // The X-XSRFToken can be used to specifiy the token in addition to the
 // paramName request parameter.
@@ -461,9 +343,7 @@ func CheckXSRF(req *Request, cookieName string, paramName string) os.Error {
 	}
 	if expectedToken != actualToken {
 		req.Param.Set(paramName, expectedToken)
-		if req.Method == "POST" ||
-			req.Method == "PUT" ||
-			req.Method == "DELETE" {
+		if !safeMethods[req.Method] {
 			err := os.NewError("twister: bad xsrf token")
 			if actualToken == "" {
 				err = os.NewError("twister: missing xsrf token")
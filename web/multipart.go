@@ -17,10 +17,14 @@ package web
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"math"
 	"os"
+	"strconv"
+	"strings"
 )
 
 var scratch [1024]byte
@@ -68,7 +72,7 @@ func ParseMultipartForm(req *Request, maxRequestBodyLen int) ([]Part, os.Error)
 		}
 		if disp, dispParam := header.GetValueParam(HeaderContentDisposition); disp == "form-data" {
 			if name := dispParam["name"]; name != "" {
-				if filename := dispParam["filename"]; filename != "" {
+				if filename := dispositionFilename(dispParam); filename != "" {
 					contentType, contentParam := header.GetValueParam(HeaderContentType)
 					data, err := ioutil.ReadAll(r)
 					if err != nil {
@@ -94,7 +98,7 @@ func ParseMultipartForm(req *Request, maxRequestBodyLen int) ([]Part, os.Error)
 	return parts, nil
 }
 
-// MultipartReader reads a multipart/form-data request body.
+// MultipartReader reads a multipart body.
 type MultipartReader struct {
 	br       *bufio.Reader
 	err      os.Error
@@ -103,7 +107,10 @@ type MultipartReader struct {
 	r        *partReader
 }
 
-var ErrNotMultipartFormData = os.NewError("twister: request not multipart/form-data")
+var (
+	ErrNotMultipartFormData = os.NewError("twister: request not multipart/form-data")
+	ErrNotMultipart         = os.NewError("twister: body not multipart")
+)
 
 // NewMultipartReader returns a a multipart/form-data reader. 
 func NewMultipartReader(req *Request, maxRequestBodyLen int) (*MultipartReader, os.Error) {
@@ -112,15 +119,6 @@ func NewMultipartReader(req *Request, maxRequestBodyLen int) (*MultipartReader,
 		return nil, ErrNotMultipartFormData
 	}
 
-	boundary := req.ContentParam["boundary"]
-	if boundary == "" {
-		return nil, os.NewError("twister: multipart/form-data boundary missing")
-	}
-
-	if len(boundary) > 512 {
-		return nil, os.NewError("twister: multipart/form-data boundary too long")
-	}
-
 	if maxRequestBodyLen < 0 {
 		maxRequestBodyLen = math.MaxInt32
 	}
@@ -132,6 +130,29 @@ func NewMultipartReader(req *Request, maxRequestBodyLen int) (*MultipartReader,
 		body = io.LimitReader(body, int64(maxRequestBodyLen))
 	}
 
+	return newMultipartReader(body, req.ContentParam["boundary"])
+}
+
+// NewMultipartBodyReader returns a reader for a body with a multipart/*
+// media type such as multipart/mixed or multipart/byteranges. The media type
+// and boundary are read from the Content-Type header in header.
+func NewMultipartBodyReader(header Header, body io.Reader) (*MultipartReader, os.Error) {
+	mediaType, param := header.GetValueParam(HeaderContentType)
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, ErrNotMultipart
+	}
+	return newMultipartReader(body, param["boundary"])
+}
+
+func newMultipartReader(body io.Reader, boundary string) (*MultipartReader, os.Error) {
+	if boundary == "" {
+		return nil, os.NewError("twister: multipart boundary missing")
+	}
+
+	if len(boundary) > 512 {
+		return nil, os.NewError("twister: multipart boundary too long")
+	}
+
 	m := &MultipartReader{
 		br:       bufio.NewReader(body),
 		boundary: []byte("\r\n--" + boundary),
@@ -143,13 +164,13 @@ func NewMultipartReader(req *Request, maxRequestBodyLen int) (*MultipartReader,
 	}
 
 	if isPrefix || !bytes.Equal(p, m.boundary[2:]) {
-		return nil, os.NewError("twister: multipart/form-data body malformed")
+		return nil, os.NewError("twister: multipart body malformed")
 	}
 
 	return m, nil
 }
 
-// Next returns the next part of a multipart/form-data body.  Next returns
+// Next returns the next part of a multipart body.  Next returns
 // os.EOF if no more parts remain. 
 func (m *MultipartReader) Next() (Header, io.Reader, os.Error) {
 	if m.r != nil {
@@ -249,3 +270,160 @@ func (r *partReader) Read(p []byte) (int, os.Error) {
 	}
 	return 0, r.err
 }
+
+// MultipartWriter writes a multipart body (RFC 2046). The writer supports
+// multipart/mixed, multipart/form-data, multipart/byteranges and
+// multipart/x-mixed-replace bodies.
+//
+// The following example streams images as multipart/x-mixed-replace:
+//
+//  func cameraHandler(req *web.Request) {
+//      mw := web.RespondMultipart(req, web.StatusOK, "multipart/x-mixed-replace")
+//      for frame := range frames {
+//          w, err := mw.CreatePart(web.NewHeader(web.HeaderContentType, "image/jpeg"))
+//          if err != nil {
+//              return
+//          }
+//          w.Write(frame)
+//          if err := mw.EndPart(); err != nil {
+//              return
+//          }
+//      }
+//      mw.Close()
+//  }
+type MultipartWriter struct {
+	w        io.Writer
+	boundary string
+
+	// Number of parts created.
+	n int
+
+	// True if the delimiter following the current part has been written.
+	ended bool
+}
+
+// NewMultipartWriter returns a writer with a random boundary that writes to
+// w.
+func NewMultipartWriter(w io.Writer) *MultipartWriter {
+	p := make([]byte, 15)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		panic("twister: rand read failed")
+	}
+	return &MultipartWriter{w: w, boundary: hex.EncodeToString(p)}
+}
+
+// RespondMultipart responds to the request with a multipart body of the
+// given media type and returns a writer for the body. The Content-Type header
+// is set from the media type and the writer's boundary.
+func RespondMultipart(req *Request, status int, mediaType string, headerKeysAndValues ...string) *MultipartWriter {
+	m := NewMultipartWriter(nil)
+	header := NewHeader(headerKeysAndValues...)
+	header.Set(HeaderContentType, m.ContentType(mediaType))
+	m.w = req.Responder.Respond(status, header)
+	return m
+}
+
+// Boundary returns the boundary.
+func (m *MultipartWriter) Boundary() string {
+	return m.boundary
+}
+
+// ContentType returns the Content-Type header value for a body with the
+// given media type, for example "multipart/form-data".
+func (m *MultipartWriter) ContentType(mediaType string) string {
+	return mediaType + "; boundary=" + m.boundary
+}
+
+// CreatePart writes the delimiter and part header and returns a writer for
+// the part body. The part body must be written before the next call to
+// CreatePart, EndPart or Close.
+func (m *MultipartWriter) CreatePart(header Header) (io.Writer, os.Error) {
+	var err os.Error
+	switch {
+	case m.n == 0:
+		_, err = io.WriteString(m.w, "--"+m.boundary+"\r\n")
+	case m.ended:
+		_, err = io.WriteString(m.w, "\r\n")
+	default:
+		_, err = io.WriteString(m.w, "\r\n--"+m.boundary+"\r\n")
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.n += 1
+	m.ended = false
+	if header == nil {
+		header = Header{}
+	}
+	if err := header.WriteHttpHeader(m.w); err != nil {
+		return nil, err
+	}
+	return m.w, nil
+}
+
+// EndPart ends the current part by writing the delimiter that follows the
+// part and flushes the underlying writer if the writer implements Flusher.
+// Clients of multipart/x-mixed-replace streams display a part when the
+// delimiter following the part is received.
+func (m *MultipartWriter) EndPart() os.Error {
+	if m.n > 0 && !m.ended {
+		if _, err := io.WriteString(m.w, "\r\n--"+m.boundary); err != nil {
+			return err
+		}
+		m.ended = true
+	}
+	if f, ok := m.w.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// CreateFormField creates a multipart/form-data part for a form field.
+func (m *MultipartWriter) CreateFormField(name string) (io.Writer, os.Error) {
+	return m.CreatePart(NewHeader(HeaderContentDisposition,
+		"form-data; name="+QuoteHeaderValue(name)))
+}
+
+// WriteField writes a multipart/form-data part for a form field.
+func (m *MultipartWriter) WriteField(name, value string) os.Error {
+	w, err := m.CreateFormField(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, value)
+	return err
+}
+
+// CreateFormFile creates a multipart/form-data part for a file. If the
+// content type is "", then application/octet-stream is used.
+func (m *MultipartWriter) CreateFormFile(name, filename, contentType string) (io.Writer, os.Error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return m.CreatePart(NewHeader(
+		HeaderContentDisposition, "form-data; name="+QuoteHeaderValue(name)+"; filename="+QuoteHeaderValue(filename),
+		HeaderContentType, contentType))
+}
+
+// CreateByteRange creates a multipart/byteranges part for the bytes first
+// through last of a resource with the given size.
+func (m *MultipartWriter) CreateByteRange(contentType string, first, last, size int64) (io.Writer, os.Error) {
+	return m.CreatePart(NewHeader(
+		HeaderContentType, contentType,
+		HeaderContentRange, "bytes "+strconv.Itoa64(first)+"-"+strconv.Itoa64(last)+"/"+strconv.Itoa64(size)))
+}
+
+// Close writes the final delimiter.
+func (m *MultipartWriter) Close() os.Error {
+	var err os.Error
+	switch {
+	case m.n == 0:
+		_, err = io.WriteString(m.w, "--"+m.boundary+"--\r\n")
+	case m.ended:
+		_, err = io.WriteString(m.w, "--\r\n")
+	default:
+		_, err = io.WriteString(m.w, "\r\n--"+m.boundary+"--\r\n")
+	}
+	m.ended = true
+	return err
+}
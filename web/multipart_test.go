@@ -15,7 +15,11 @@
 package web
 
 import (
+	"bytes"
 	"http"
+	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -155,3 +159,142 @@ func TestMultiPart(t *testing.T) {
 		}
 	}
 }
+
+func TestMultipartWriterRoundTrip(t *testing.T) {
+	for _, endParts := range []bool{false, true} {
+		var buf bytes.Buffer
+		mw := NewMultipartWriter(&buf)
+		mw.WriteField("name", "value")
+		if endParts {
+			mw.EndPart()
+		}
+		w, _ := mw.CreateFormFile("file", `a "quoted" name.txt`, "text/plain")
+		io.WriteString(w, "\r\n--not a boundary\r\n")
+		if endParts {
+			mw.EndPart()
+		}
+		if err := mw.Close(); err != nil {
+			t.Fatal("Close", err)
+		}
+
+		req, err := NewRequest("", "POST", &http.URL{}, ProtocolVersion11,
+			NewHeader(HeaderContentType, mw.ContentType("multipart/form-data")))
+		if err != nil {
+			t.Fatal("NewRequest", err)
+		}
+		req.Body = &buf
+		parts, err := ParseMultipartForm(req, -1)
+		if err != nil {
+			t.Fatalf("endParts=%v, parse returned error %v", endParts, err)
+		}
+		if s := req.Param.Get("name"); s != "value" {
+			t.Errorf("endParts=%v, name = %q, want value", endParts, s)
+		}
+		if len(parts) != 1 {
+			t.Fatalf("endParts=%v, len(parts) = %d, want 1", endParts, len(parts))
+		}
+		if p := parts[0]; p.Filename != `a "quoted" name.txt` || p.ContentType != "text/plain" ||
+			string(p.Data) != "\r\n--not a boundary\r\n" {
+			t.Errorf("endParts=%v, part = %+v", endParts, p)
+		}
+	}
+}
+
+func TestMultipartWriterByteRanges(t *testing.T) {
+	h := HandlerFunc(func(req *Request) {
+		mw := RespondMultipart(req, StatusPartialContent, "multipart/byteranges")
+		w, _ := mw.CreateByteRange("text/plain", 0, 1, 10)
+		io.WriteString(w, "ab")
+		w, _ = mw.CreateByteRange("text/plain", 8, 9, 10)
+		io.WriteString(w, "ij")
+		mw.Close()
+	})
+	status, header, body := RunHandler("/", "GET", nil, nil, h)
+	if status != StatusPartialContent {
+		t.Fatalf("status = %d, want %d", status, StatusPartialContent)
+	}
+
+	if mediaType, _ := header.GetValueParam(HeaderContentType); mediaType != "multipart/byteranges" {
+		t.Fatalf("media type = %q, want multipart/byteranges", mediaType)
+	}
+	m, err := NewMultipartBodyReader(header, bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal("NewMultipartBodyReader", err)
+	}
+	for _, want := range []string{"bytes 0-1/10 ab", "bytes 8-9/10 ij"} {
+		partHeader, r, err := m.Next()
+		if err != nil {
+			t.Fatal("Next", err)
+		}
+		p, _ := ioutil.ReadAll(r)
+		if s := partHeader.Get(HeaderContentRange) + " " + string(p); s != want {
+			t.Errorf("part = %q, want %q", s, want)
+		}
+	}
+	if _, _, err := m.Next(); err != os.EOF {
+		t.Errorf("Next() error = %v, want EOF", err)
+	}
+}
+
+// flushRecorder records the body written before each call to Flush.
+type flushRecorder struct {
+	bytes.Buffer
+	flushed []string
+}
+
+func (w *flushRecorder) Flush() os.Error {
+	w.flushed = append(w.flushed, w.String())
+	return nil
+}
+
+func TestMultipartWriterMixedReplace(t *testing.T) {
+	var w flushRecorder
+	mw := NewMultipartWriter(&w)
+	for _, frame := range []string{"frame1", "frame2"} {
+		pw, _ := mw.CreatePart(NewHeader(HeaderContentType, "image/jpeg"))
+		io.WriteString(pw, frame)
+		if err := mw.EndPart(); err != nil {
+			t.Fatal("EndPart", err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal("Close", err)
+	}
+
+	// Each part is followed by its delimiter at the time of the flush.
+	if len(w.flushed) != 2 {
+		t.Fatalf("flushes = %d, want 2", len(w.flushed))
+	}
+	for i, frame := range []string{"frame1", "frame2"} {
+		if want := frame + "\r\n--" + mw.Boundary(); !strings.HasSuffix(w.flushed[i], want) {
+			t.Errorf("flush %d body = %q, want suffix %q", i, w.flushed[i], want)
+		}
+	}
+
+	m, err := NewMultipartBodyReader(
+		NewHeader(HeaderContentType, mw.ContentType("multipart/x-mixed-replace")),
+		bytes.NewBuffer(w.Bytes()))
+	if err != nil {
+		t.Fatal("NewMultipartBodyReader", err)
+	}
+	for _, want := range []string{"frame1", "frame2"} {
+		partHeader, r, err := m.Next()
+		if err != nil {
+			t.Fatal("Next", err)
+		}
+		p, _ := ioutil.ReadAll(r)
+		if s := string(p); s != want || partHeader.Get(HeaderContentType) != "image/jpeg" {
+			t.Errorf("part = %q %v, want %q", s, partHeader, want)
+		}
+	}
+	if _, _, err := m.Next(); err != os.EOF {
+		t.Errorf("Next() error = %v, want EOF", err)
+	}
+}
+
+func TestNewMultipartBodyReaderNotMultipart(t *testing.T) {
+	_, err := NewMultipartBodyReader(NewHeader(HeaderContentType, "text/plain"), strings.NewReader(""))
+	if err != ErrNotMultipart {
+		t.Errorf("err = %v, want ErrNotMultipart", err)
+	}
+}
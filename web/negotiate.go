@@ -0,0 +1,300 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrNotAcceptable = os.NewError("twister: no acceptable representation")
+
+// Offer specifies the representations that a handler can produce. Values
+// are listed in order of server preference. Empty lists are not negotiated.
+type Offer struct {
+	// Media types with optional parameters, for example "text/html" or
+	// "text/csv; header=present".
+	MediaTypes []string
+
+	// Language tags, for example "en-US".
+	Languages []string
+
+	// Charsets, for example "utf-8".
+	Charsets []string
+
+	// Content codings, for example "gzip" or "identity".
+	Encodings []string
+}
+
+// Negotiated is the result of content negotiation. A field is "" if the
+// corresponding list in the Offer is empty.
+type Negotiated struct {
+	MediaType string
+	Language  string
+	Charset   string
+	Encoding  string
+}
+
+// Negotiate selects the best offered representation for the request using
+// the Accept, Accept-Language, Accept-Charset and Accept-Encoding headers as
+// described in RFC 7231 section 5.3.
+//
+// An offer is assigned the quality of the most specific matching range in
+// the request header. For media types, a range with parameters is more
+// specific than a range without parameters, and "type/subtype" is more
+// specific than "type/*", which is more specific than "*/*". The offer with
+// the highest quality wins, with ties resolved in favor of the earlier offer.
+// All offers are acceptable when the request does not have the header.
+//
+// If no media type, charset or encoding is acceptable, then Negotiate returns
+// ErrNotAcceptable. When no language is acceptable, the first language is
+// selected; RFC 7231 recommends serving a default over a 406 response.
+//
+// Negotiate adds the negotiated header names to the response Vary header.
+func Negotiate(req *Request, offer *Offer) (*Negotiated, os.Error) {
+	var vary []string
+	if len(offer.MediaTypes) > 0 {
+		vary = append(vary, HeaderAccept)
+	}
+	if len(offer.Charsets) > 0 {
+		vary = append(vary, HeaderAcceptCharset)
+	}
+	if len(offer.Encodings) > 0 {
+		vary = append(vary, HeaderAcceptEncoding)
+	}
+	if len(offer.Languages) > 0 {
+		vary = append(vary, HeaderAcceptLanguage)
+	}
+
+	var n Negotiated
+	ok := true
+	if len(offer.MediaTypes) > 0 {
+		n.MediaType, ok = bestOffer(req.Header, HeaderAccept, offer.MediaTypes, matchMediaType, nil)
+	}
+	if ok && len(offer.Charsets) > 0 {
+		n.Charset, ok = bestOffer(req.Header, HeaderAcceptCharset, offer.Charsets, matchToken, nil)
+	}
+	if ok && len(offer.Encodings) > 0 {
+		n.Encoding, ok = bestOffer(req.Header, HeaderAcceptEncoding, offer.Encodings, matchToken, identityQuality)
+	}
+	if ok && len(offer.Languages) > 0 {
+		var found bool
+		n.Language, found = bestOffer(req.Header, HeaderAcceptLanguage, offer.Languages, matchLanguage, nil)
+		if !found {
+			n.Language = offer.Languages[0]
+		}
+	}
+
+	FilterRespond(req, func(status int, header Header) (int, Header) {
+		addVary(header, vary...)
+		return status, header
+	})
+
+	if !ok {
+		return nil, ErrNotAcceptable
+	}
+	return &n, nil
+}
+
+// addVary adds names to the Vary header if not already present.
+func addVary(header Header, names ...string) {
+	existing := header.GetList(HeaderVary)
+	for _, name := range names {
+		found := false
+		for _, s := range existing {
+			if s == "*" || strings.ToLower(s) == strings.ToLower(name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			header.Add(HeaderVary, name)
+			existing = append(existing, name)
+		}
+	}
+}
+
+// bestOffer returns the offer with the highest quality. The match function
+// returns the specificity of the match between a range in the header and an
+// offer or -1 if the range does not match. The defaultQuality function, if
+// not nil, returns the quality of an offer not matched by any range.
+func bestOffer(header Header, key string, offers []string, match func(a ValueParams, offer string) int, defaultQuality func(offer string) float64) (string, bool) {
+	if len(header[key]) == 0 {
+		return offers[0], true
+	}
+	accepts := header.GetAccept(key)
+	best := ""
+	bestQ := float64(0)
+	for _, offer := range offers {
+		q := float64(-1)
+		specificity := -1
+		for _, a := range accepts {
+			if s := match(a, offer); s > specificity {
+				specificity = s
+				q = acceptQuality(a)
+			}
+		}
+		if specificity < 0 {
+			q = 0
+			if defaultQuality != nil {
+				q = defaultQuality(offer)
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// acceptQuality returns the q parameter of an accept range.
+func acceptQuality(a ValueParams) float64 {
+	s, ok := a.Param["q"]
+	if !ok {
+		return 1
+	}
+	q, err := strconv.Atof64(s)
+	if err != nil || q < 0 {
+		return 0
+	}
+	if q > 1 {
+		return 1
+	}
+	return q
+}
+
+// identityQuality implements the rule that the identity coding is acceptable
+// unless explicitly excluded.
+func identityQuality(offer string) float64 {
+	if strings.ToLower(offer) == "identity" {
+		return 1
+	}
+	return 0
+}
+
+func splitMediaType(s string) (typ, subtype string) {
+	s = strings.ToLower(s)
+	if i := strings.Index(s, "/"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// matchMediaType matches a media range to an offered media type.
+func matchMediaType(a ValueParams, offer string) int {
+	offerValue, offerParam, _ := splitValueParam(offer)
+	offerType, offerSubtype := splitMediaType(offerValue)
+	rangeType, rangeSubtype := splitMediaType(a.Value)
+	switch {
+	case rangeType == "*" && rangeSubtype == "*":
+		return 0
+	case rangeType != offerType:
+		return -1
+	case rangeSubtype == "*":
+		return 1
+	case rangeSubtype != offerSubtype:
+		return -1
+	}
+	specificity := 2
+	for k, v := range a.Param {
+		if k == "q" {
+			continue
+		}
+		if strings.ToLower(offerParam[k]) != strings.ToLower(v) {
+			return -1
+		}
+		specificity = 3
+	}
+	return specificity
+}
+
+// matchToken matches a charset or coding range to an offered value.
+func matchToken(a ValueParams, offer string) int {
+	switch {
+	case a.Value == "*":
+		return 0
+	case strings.ToLower(a.Value) == strings.ToLower(offer):
+		return 1
+	}
+	return -1
+}
+
+// matchLanguage matches a language range to an offered language tag using
+// the basic filtering scheme from RFC 4647. Longer ranges are more specific.
+func matchLanguage(a ValueParams, offer string) int {
+	r := strings.ToLower(a.Value)
+	tag := strings.ToLower(offer)
+	switch {
+	case r == "*":
+		return 0
+	case r == tag:
+		return len(r)
+	case strings.HasPrefix(tag, r) && tag[len(r)] == '-':
+		return len(r)
+	}
+	return -1
+}
+
+// NegotiateHandler returns a handler that dispatches to the handler for the
+// best media type in the request Accept header. The structure of the
+// mediaTypesAndHandlers argument is:
+//
+// (mediaType handler)+
+//
+// where mediaType is a string and handler is a Handler or a func(*Request).
+// The media types are listed in order of server preference. If no media type
+// is acceptable, then the handler responds with StatusNotAcceptable.
+//
+//  router.Register("/report", "GET", web.NegotiateHandler(
+//      "text/html", reportHTML,
+//      "application/json", reportJSON,
+//      "text/csv", reportCSV))
+func NegotiateHandler(mediaTypesAndHandlers ...interface{}) Handler {
+	if len(mediaTypesAndHandlers)%2 != 0 || len(mediaTypesAndHandlers) == 0 {
+		panic("twister: Structure of NegotiateHandler arguments is [mediaType handler]+.")
+	}
+	nh := &negotiateHandler{handlers: make(map[string]Handler)}
+	for i := 0; i < len(mediaTypesAndHandlers); i += 2 {
+		mediaType, ok := mediaTypesAndHandlers[i].(string)
+		if !ok {
+			panic("twister: Bad media type for NegotiateHandler")
+		}
+		switch handler := mediaTypesAndHandlers[i+1].(type) {
+		case Handler:
+			nh.handlers[mediaType] = handler
+		case func(*Request):
+			nh.handlers[mediaType] = HandlerFunc(handler)
+		default:
+			panic("twister: Bad handler for media type " + mediaType)
+		}
+		nh.offer.MediaTypes = append(nh.offer.MediaTypes, mediaType)
+	}
+	return nh
+}
+
+type negotiateHandler struct {
+	offer    Offer
+	handlers map[string]Handler
+}
+
+func (nh *negotiateHandler) ServeWeb(req *Request) {
+	n, err := Negotiate(req, &nh.offer)
+	if err != nil {
+		req.Error(StatusNotAcceptable, err)
+		return
+	}
+	nh.handlers[n.MediaType].ServeWeb(req)
+}
@@ -0,0 +1,96 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var negotiateOffer = &Offer{
+	MediaTypes: []string{"text/html", "application/json", "text/csv; header=present"},
+	Languages:  []string{"en-US", "fr"},
+	Charsets:   []string{"utf-8", "iso-8859-1"},
+	Encodings:  []string{"gzip", "identity"},
+}
+
+var negotiateTests = []struct {
+	header Header
+	want   *Negotiated
+}{
+	{NewHeader(), &Negotiated{"text/html", "en-US", "utf-8", "gzip"}},
+	{NewHeader(HeaderAccept, "application/json"), &Negotiated{"application/json", "en-US", "utf-8", "gzip"}},
+	{NewHeader(HeaderAccept, "text/*;q=0.5, application/json;q=0.4"), &Negotiated{"text/html", "en-US", "utf-8", "gzip"}},
+	{NewHeader(HeaderAccept, "text/*, text/html;q=0.1, */*;q=0.2"), &Negotiated{"text/csv; header=present", "en-US", "utf-8", "gzip"}},
+	{NewHeader(HeaderAccept, "text/csv;header=absent, */*;q=0.1"), &Negotiated{"text/html", "en-US", "utf-8", "gzip"}},
+	{NewHeader(HeaderAccept, "text/csv;header=present, */*;q=0.1"), &Negotiated{"text/csv; header=present", "en-US", "utf-8", "gzip"}},
+	{NewHeader(HeaderAccept, "image/png"), nil},
+	{NewHeader(HeaderAccept, "text/html;q=0, application/*"), &Negotiated{"application/json", "en-US", "utf-8", "gzip"}},
+	{NewHeader(HeaderAcceptLanguage, "fr-CA, fr;q=0.9, en;q=0.8"), &Negotiated{"text/html", "fr", "utf-8", "gzip"}},
+	{NewHeader(HeaderAcceptLanguage, "en, *;q=0.5"), &Negotiated{"text/html", "en-US", "utf-8", "gzip"}},
+	{NewHeader(HeaderAcceptLanguage, "de"), &Negotiated{"text/html", "en-US", "utf-8", "gzip"}},
+	{NewHeader(HeaderAcceptCharset, "ISO-8859-1"), &Negotiated{"text/html", "en-US", "iso-8859-1", "gzip"}},
+	{NewHeader(HeaderAcceptCharset, "utf-16"), nil},
+	{NewHeader(HeaderAcceptEncoding, "deflate"), &Negotiated{"text/html", "en-US", "utf-8", "identity"}},
+	{NewHeader(HeaderAcceptEncoding, "gzip;q=0, *;q=0"), nil},
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tt := range negotiateTests {
+		var n *Negotiated
+		var err os.Error
+		_, header, _ := RunHandler("/", "GET", tt.header, nil, HandlerFunc(func(req *Request) {
+			n, err = Negotiate(req, negotiateOffer)
+			req.Respond(StatusOK)
+		}))
+		if tt.want == nil {
+			if err != ErrNotAcceptable {
+				t.Errorf("%v: Negotiate returned %v, %v; want ErrNotAcceptable", tt.header, n, err)
+			}
+		} else if !reflect.DeepEqual(n, tt.want) {
+			t.Errorf("%v: Negotiate returned %v, %v; want %v", tt.header, n, err, tt.want)
+		}
+		want := []string{HeaderAccept, HeaderAcceptCharset, HeaderAcceptEncoding, HeaderAcceptLanguage}
+		if vary := header[HeaderVary]; !reflect.DeepEqual(vary, want) {
+			t.Errorf("%v: Vary = %v, want %v", tt.header, vary, want)
+		}
+	}
+}
+
+func TestNegotiateHandler(t *testing.T) {
+	h := NegotiateHandler(
+		"text/html", func(req *Request) { io.WriteString(req.Respond(StatusOK), "html") },
+		"application/json", func(req *Request) { io.WriteString(req.Respond(StatusOK), "json") })
+	tests := []struct {
+		accept string
+		status int
+		body   string
+	}{
+		{"*/*", StatusOK, "html"},
+		{"application/json, text/html;q=0.9", StatusOK, "json"},
+		{"text/csv", StatusNotAcceptable, "Not Acceptable"},
+	}
+	for _, tt := range tests {
+		status, header, body := RunHandler("/", "GET", NewHeader(HeaderAccept, tt.accept), nil, h)
+		if status != tt.status || string(body) != tt.body {
+			t.Errorf("%s: status = %d, body = %q; want %d, %q", tt.accept, status, body, tt.status, tt.body)
+		}
+		if vary := header.Get(HeaderVary); vary != HeaderAccept {
+			t.Errorf("%s: Vary = %q, want Accept", tt.accept, vary)
+		}
+	}
+}
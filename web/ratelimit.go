@@ -0,0 +1,264 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = os.NewError("twister: rate limit exceeded")
+
+// RateLimitStatus is the state of a token bucket after an attempt to take a
+// token from the bucket.
+type RateLimitStatus struct {
+	// True if a token was taken from the bucket.
+	Allowed bool
+
+	// Number of tokens remaining in the bucket.
+	Remaining int
+
+	// Nanoseconds until a token is available. Zero if Allowed is true.
+	RetryAfter int64
+
+	// Nanoseconds until the bucket is full.
+	Reset int64
+}
+
+// RateLimitStore is the interface for token bucket storage.
+type RateLimitStore interface {
+	// Take attempts to take a token from the bucket for key. The bucket
+	// holds at most burst tokens and is refilled at rate tokens per second.
+	// A bucket that does not exist is considered full.
+	Take(key string, rate float64, burst int) RateLimitStatus
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   int64
+	rate   float64
+	burst  int
+}
+
+// MemoryRateLimitStore is an in-memory RateLimitStore.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	maxKeys   int
+	lastSweep int64
+}
+
+// NewMemoryRateLimitStore returns a new in-memory store. The store holds at
+// most maxKeys buckets. If the store is full, then buckets that have been
+// refilled are evicted. If no buckets can be evicted, then the least recently
+// used bucket is evicted. If maxKeys is zero, then the number of buckets is
+// not limited.
+func NewMemoryRateLimitStore(maxKeys int) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*tokenBucket), maxKeys: maxKeys}
+}
+
+// sweepInterval is the minimum time in nanoseconds between sweeps for full
+// buckets.
+const sweepInterval = 60e9
+
+// fill returns the number of tokens in the bucket at time now.
+func (b *tokenBucket) fill(now int64) float64 {
+	tokens := b.tokens + float64(now-b.last)*b.rate/1e9
+	if tokens > float64(b.burst) {
+		tokens = float64(b.burst)
+	}
+	return tokens
+}
+
+// sweep removes full buckets from the store. A full bucket is the same as a
+// bucket that does not exist.
+func (s *MemoryRateLimitStore) sweep(now int64) {
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if b.fill(now) >= float64(b.burst) {
+			s.buckets[key] = nil, false
+		}
+	}
+}
+
+// evictOldest removes the least recently used bucket from the store.
+func (s *MemoryRateLimitStore) evictOldest() {
+	var oldestKey string
+	var oldest *tokenBucket
+	for key, b := range s.buckets {
+		if oldest == nil || b.last < oldest.last {
+			oldestKey = key
+			oldest = b
+		}
+	}
+	if oldest != nil {
+		s.buckets[oldestKey] = nil, false
+	}
+}
+
+// Take implements the RateLimitStore interface.
+func (s *MemoryRateLimitStore) Take(key string, rate float64, burst int) RateLimitStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Nanoseconds()
+
+	b := s.buckets[key]
+	if b == nil {
+		full := s.maxKeys > 0 && len(s.buckets) >= s.maxKeys
+		if now-s.lastSweep > sweepInterval || (full && now-s.lastSweep > 1e9) {
+			s.sweep(now)
+		}
+		if s.maxKeys > 0 && len(s.buckets) >= s.maxKeys {
+			s.evictOldest()
+		}
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+
+	b.rate = rate
+	b.burst = burst
+	b.tokens = b.fill(now)
+	b.last = now
+
+	var status RateLimitStatus
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		status.Allowed = true
+	} else {
+		status.RetryAfter = int64((1 - b.tokens) * 1e9 / rate)
+	}
+	status.Remaining = int(b.tokens)
+	status.Reset = int64((float64(burst) - b.tokens) * 1e9 / rate)
+	return status
+}
+
+// RemoteAddrKey returns the IP address of the client. Use this function with
+// ProxyHeaderHandler when the application is behind a proxy.
+func RemoteAddrKey(req *Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// CookieKey returns a function that returns the value of the named cookie.
+func CookieKey(name string) func(*Request) string {
+	return func(req *Request) string { return req.Cookie.Get(name) }
+}
+
+// ParamKey returns a function that returns the value of the named request
+// parameter. This function is useful for limiting requests by API key.
+func ParamKey(name string) func(*Request) string {
+	return func(req *Request) string { return req.Param.Get(name) }
+}
+
+// HeaderKey returns a function that returns the value of the named request
+// header. The header name must be in canonical format.
+func HeaderKey(name string) func(*Request) string {
+	return func(req *Request) string { return req.Header.Get(name) }
+}
+
+// RateLimitOptions specifies options for RateLimitHandler.
+type RateLimitOptions struct {
+	// Key returns the rate limit key for the request. If the key is "", then
+	// the request is not limited. If Key is nil, then RemoteAddrKey is used.
+	Key func(req *Request) string
+
+	// Token bucket storage. If Store is nil, then an in-memory store is
+	// created for the handler. Handlers that share a store and return the
+	// same key from the Key function share a limit.
+	Store RateLimitStore
+}
+
+// RateLimitHandler returns a handler that limits the rate of requests using a
+// token bucket for each client. Each bucket holds at most burst tokens and is
+// refilled at rate tokens per second. A request takes one token from the
+// bucket. If the bucket is empty, then the handler responds with status 429
+// and the Retry-After header. The RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers are added to all responses. RateLimitHandler panics
+// if rate or burst is not positive.
+//
+// Per-route limits are created by wrapping the route handlers registered with
+// a router:
+//
+//  r := web.NewRouter().
+//      Register("/login", "POST",
+//          web.RateLimitHandler(0.1, 5, nil, loginHandler)).
+//      Register("/api/<:.*>", "*", web.RateLimitHandler(10, 100,
+//          &web.RateLimitOptions{Key: web.ParamKey("key")}, apiHandler))
+func RateLimitHandler(rate float64, burst int, options *RateLimitOptions, h Handler) Handler {
+	if rate <= 0 || burst <= 0 {
+		panic("twister: RateLimitHandler rate and burst must be positive")
+	}
+	rh := &rateLimitHandler{rate: rate, burst: burst, h: h}
+	if options != nil {
+		rh.key = options.Key
+		rh.store = options.Store
+	}
+	if rh.key == nil {
+		rh.key = RemoteAddrKey
+	}
+	if rh.store == nil {
+		rh.store = NewMemoryRateLimitStore(100000)
+	}
+	return rh
+}
+
+type rateLimitHandler struct {
+	rate  float64
+	burst int
+	key   func(*Request) string
+	store RateLimitStore
+	h     Handler
+}
+
+// seconds converts nanoseconds to seconds rounded up.
+func seconds(ns int64) string {
+	return strconv.Itoa64((ns + 1e9 - 1) / 1e9)
+}
+
+func (rh *rateLimitHandler) ServeWeb(req *Request) {
+	key := rh.key(req)
+	if key == "" {
+		rh.h.ServeWeb(req)
+		return
+	}
+
+	status := rh.store.Take(key, rh.rate, rh.burst)
+	limit := strconv.Itoa(rh.burst)
+	remaining := strconv.Itoa(status.Remaining)
+	reset := seconds(status.Reset)
+
+	if !status.Allowed {
+		req.Error(StatusTooManyRequests, ErrRateLimited,
+			HeaderRetryAfter, seconds(status.RetryAfter),
+			HeaderRateLimitLimit, limit,
+			HeaderRateLimitRemaining, remaining,
+			HeaderRateLimitReset, reset)
+		return
+	}
+
+	FilterRespond(req, func(status int, header Header) (int, Header) {
+		header.Set(HeaderRateLimitLimit, limit)
+		header.Set(HeaderRateLimitRemaining, remaining)
+		header.Set(HeaderRateLimitReset, reset)
+		return status, header
+	})
+	rh.h.ServeWeb(req)
+}
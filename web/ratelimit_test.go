@@ -0,0 +1,94 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"testing"
+)
+
+func rateLimitTestHandler(req *Request) {
+	req.Respond(StatusOK)
+}
+
+var rateLimitTests = []struct {
+	status     int
+	remaining  string
+	retryAfter string
+}{
+	{StatusOK, "1", ""},
+	{StatusOK, "0", ""},
+	{StatusTooManyRequests, "0", "10"},
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	h := RateLimitHandler(0.1, 2, nil, HandlerFunc(rateLimitTestHandler))
+	for i, tt := range rateLimitTests {
+		status, header, _ := RunHandler("/", "GET", nil, nil, h)
+		if status != tt.status {
+			t.Errorf("test %d, status = %d, want %d", i, status, tt.status)
+		}
+		if s := header.Get(HeaderRateLimitLimit); s != "2" {
+			t.Errorf("test %d, limit = %q, want 2", i, s)
+		}
+		if s := header.Get(HeaderRateLimitRemaining); s != tt.remaining {
+			t.Errorf("test %d, remaining = %q, want %q", i, s, tt.remaining)
+		}
+		if s := header.Get(HeaderRetryAfter); s != tt.retryAfter {
+			t.Errorf("test %d, retry after = %q, want %q", i, s, tt.retryAfter)
+		}
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	h := RateLimitHandler(0.1, 1, &RateLimitOptions{Key: ParamKey("key")}, HandlerFunc(rateLimitTestHandler))
+	for _, url := range []string{"/?key=a", "/?key=b", "/", "/"} {
+		if status, _, _ := RunHandler(url, "GET", nil, nil, h); status != StatusOK {
+			t.Errorf("%s, status = %d, want %d", url, status, StatusOK)
+		}
+	}
+	if status, _, _ := RunHandler("/?key=a", "GET", nil, nil, h); status != StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", status, StatusTooManyRequests)
+	}
+}
+
+func TestMemoryRateLimitStoreEviction(t *testing.T) {
+	s := NewMemoryRateLimitStore(2)
+	s.Take("a", 1, 1)
+	s.Take("b", 1, 1)
+	s.buckets["a"].last -= 1e6
+	s.Take("c", 1, 1)
+	if len(s.buckets) != 2 {
+		t.Errorf("len(buckets) = %d, want 2", len(s.buckets))
+	}
+	if _, found := s.buckets["a"]; found {
+		t.Error("oldest bucket not evicted")
+	}
+}
+
+func TestRateLimitHandlerBadConfig(t *testing.T) {
+	for _, tt := range []struct {
+		rate  float64
+		burst int
+	}{{0, 5}, {-1, 5}, {1, 0}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RateLimitHandler(%v, %d) did not panic", tt.rate, tt.burst)
+				}
+			}()
+			RateLimitHandler(tt.rate, tt.burst, nil, HandlerFunc(rateLimitTestHandler))
+		}()
+	}
+}
@@ -0,0 +1,499 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"io"
+	"json"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"template"
+)
+
+// RendererOptions specifies options for NewRenderer.
+type RendererOptions struct {
+	// Directory containing the templates. Required. Templates are named by
+	// their path relative to this directory, for example "user/edit.html".
+	Dir string
+
+	// Name of the layout template. If not "", pages with the same extension
+	// as the layout are rendered inside the layout. The layout includes the
+	// page with {Content|raw}.
+	Layout string
+
+	// Subdirectory of Dir containing partial templates. If "", then
+	// "partials" is used. The partial "partials/item.html" is available as
+	// the formatter "item": {@|item} executes the partial with the current
+	// value.
+	PartialDir string
+
+	// Reload templates when files in Dir change. Use in development only;
+	// the check stats every template file on each render.
+	Reload bool
+
+	// Formatters in addition to the standard formatters.
+	Formatters template.FormatterMap
+
+	// Name of the template used by the renderer's error handler. If "",
+	// then errors are passed through to the next error handler.
+	ErrorTemplate string
+
+	// Named URL paths for links in templates. The paths are available as
+	// {URL.name}. A path can contain router style parameters, for example
+	// "/users/<id>/posts/<post:[0-9]+>". The formatter "url_name" builds the
+	// path by replacing the parameters in order with the path escaped
+	// formatter values: {Data.User.ID Data.Post.ID|url_post}.
+	URLs map[string]string
+
+	// If not nil, Data returns application data for the request. The data
+	// is available to templates as App.
+	Data func(req *Request) interface{}
+}
+
+// TemplateData is the value passed to templates executed by a Renderer.
+type TemplateData struct {
+	// The request.
+	Request *Request
+
+	// The value passed to Render.
+	Data interface{}
+
+	// Application data from RendererOptions.Data.
+	App interface{}
+
+	// Masked XSRF token and hidden input element for the request. Render
+	// the hidden field with {XSRFField|raw}. Both are "" if the request was
+	// not handled by XSRFHandler.
+	XSRFToken string
+	XSRFField string
+
+	// Messages from the previous request. Nil if the request was not handled
+	// by FlashHandler. Render the messages with:
+	//
+	//  {.repeated section Flashes}<p class="{Category}">{Message}</p>{.end}
+	Flashes []Flash
+
+	// Named URL paths from RendererOptions.URLs. Use the url_name formatters
+	// to build paths with parameters.
+	URL map[string]string
+
+	// Rendered page. Set when executing the layout.
+	Content string
+}
+
+// ErrorData is the Data passed to the error template.
+type ErrorData struct {
+	Status     int
+	StatusText string
+
+	// Reason for the error. The reason is "" for server errors to avoid
+	// leaking internal details to the client.
+	Reason string
+}
+
+// Renderer renders templates from a directory. The templates use the
+// template package syntax with the following formatters:
+//
+//  ""      the default formatter. HTML escape the value.
+//  html    HTML escape the value.
+//  href    HTML escape the value for use in a URL attribute. URLs with a
+//          scheme other than http, https or mailto are replaced with "#".
+//  url     escape the value for use as a URL query component.
+//  js      encode the value as JSON for use in a script element.
+//  raw     write the value without escaping. Use only for trusted values.
+//
+// The default formatter HTML escapes values in all templates, including
+// XML, SVG and plain text templates and partials. Use {Value|raw} to write a
+// trusted value without escaping, for example in a plain text email.
+//
+// The template package does not track the context of a substitution and the
+// renderer does not provide contextual auto-escaping. The default formatter
+// is safe for HTML and XML text and quoted attribute values only. Use href for URL attributes such as href and src,
+// js for values in script elements and event handler attributes, and url for
+// query components. Values in other contexts, such as unquoted attributes or
+// style elements, must be escaped by the application.
+type Renderer struct {
+	options RendererOptions
+
+	mu  sync.Mutex
+	set *templateSet
+}
+
+type templateSet struct {
+	templates map[string]*template.Template
+	mtimes    map[string]int64
+}
+
+// NewRenderer returns a renderer for the templates in options.Dir. The
+// templates are parsed before NewRenderer returns.
+func NewRenderer(options *RendererOptions) (*Renderer, os.Error) {
+	r := &Renderer{options: *options}
+	if r.options.Dir == "" {
+		panic("twister: RendererOptions.Dir not set")
+	}
+	if r.options.PartialDir == "" {
+		r.options.PartialDir = "partials"
+	}
+	mtimes, err := r.scan()
+	if err != nil {
+		return nil, err
+	}
+	r.set, err = r.load(mtimes)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// scan returns the modification times of the template files.
+func (r *Renderer) scan() (map[string]int64, os.Error) {
+	mtimes := make(map[string]int64)
+	var walk func(dir string) os.Error
+	walk = func(dir string) os.Error {
+		f, err := os.Open(path.Join(r.options.Dir, dir))
+		if err != nil {
+			return err
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name, ".") {
+				continue
+			}
+			name := path.Join(dir, info.Name)
+			switch {
+			case info.IsDirectory():
+				if err := walk(name); err != nil {
+					return err
+				}
+			case info.IsRegular():
+				mtimes[name] = info.Mtime_ns
+			}
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return mtimes, nil
+}
+
+// load parses the templates.
+func (r *Renderer) load(mtimes map[string]int64) (*templateSet, os.Error) {
+	set := &templateSet{templates: make(map[string]*template.Template), mtimes: mtimes}
+
+	fmap, err := r.formatterMap(set, mtimes)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range mtimes {
+		t, err := template.ParseFile(path.Join(r.options.Dir, name), fmap)
+		if err != nil {
+			return nil, os.NewError("twister: template " + name + ": " + err.String())
+		}
+		set.templates[name] = t
+	}
+	return set, nil
+}
+
+// formatterMap returns the formatters for the templates.
+func (r *Renderer) formatterMap(set *templateSet, mtimes map[string]int64) (template.FormatterMap, os.Error) {
+	fmap := template.FormatterMap{
+		"":     htmlFormatter,
+		"html": htmlFormatter,
+		"href": hrefFormatter,
+		"url":  urlFormatter,
+		"js":   jsFormatter,
+		"raw":  rawFormatter,
+	}
+	for name, pattern := range r.options.URLs {
+		fmap["url_"+name] = urlBuilderFormatter(pattern)
+	}
+	for name, f := range r.options.Formatters {
+		fmap[name] = f
+	}
+	partialPrefix := r.options.PartialDir + "/"
+	for name := range mtimes {
+		if !strings.HasPrefix(name, partialPrefix) {
+			continue
+		}
+		base := name[len(partialPrefix):]
+		base = base[:len(base)-len(path.Ext(base))]
+		if _, ok := fmap[base]; ok {
+			return nil, os.NewError("twister: partial " + name + " conflicts with formatter " + base)
+		}
+		fmap[base] = partialFormatter(set, name)
+	}
+	return fmap, nil
+}
+
+// templates returns the current template set, reloading the set if required.
+func (r *Renderer) templates() (*templateSet, os.Error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.options.Reload {
+		return r.set, nil
+	}
+	mtimes, err := r.scan()
+	if err != nil {
+		return nil, err
+	}
+	changed := len(mtimes) != len(r.set.mtimes)
+	for name, mtime := range mtimes {
+		if r.set.mtimes[name] != mtime {
+			changed = true
+			break
+		}
+	}
+	if changed {
+		set, err := r.load(mtimes)
+		if err != nil {
+			return nil, err
+		}
+		r.set = set
+	}
+	return r.set, nil
+}
+
+func (r *Renderer) templateData(req *Request, data interface{}) *TemplateData {
+	td := &TemplateData{
+		Request:   req,
+		Data:      data,
+		XSRFToken: XSRFToken(req),
+		XSRFField: XSRFHiddenField(req),
+		Flashes:   Flashes(req),
+		URL:       r.options.URLs,
+	}
+	if r.options.Data != nil {
+		td.App = r.options.Data(req)
+	}
+	return td
+}
+
+// execute executes the named template and the layout to a buffer.
+func (r *Renderer) execute(name string, td *TemplateData) ([]byte, os.Error) {
+	set, err := r.templates()
+	if err != nil {
+		return nil, err
+	}
+	t := set.templates[name]
+	if t == nil {
+		return nil, os.NewError("twister: template " + name + " not found")
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, td); err != nil {
+		return nil, os.NewError("twister: template " + name + ": " + err.String())
+	}
+	layout := r.options.Layout
+	if layout == "" || name == layout || path.Ext(name) != path.Ext(layout) {
+		return buf.Bytes(), nil
+	}
+	t = set.templates[layout]
+	if t == nil {
+		return nil, os.NewError("twister: layout " + layout + " not found")
+	}
+	td.Content = buf.String()
+	buf.Reset()
+	if err := t.Execute(&buf, td); err != nil {
+		return nil, os.NewError("twister: template " + layout + ": " + err.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// isHTMLTemplate returns true if the named template is HTML.
+func isHTMLTemplate(name string) bool {
+	switch path.Ext(name) {
+	case ".html", ".htm", "":
+		return true
+	}
+	return false
+}
+
+// templateContentType returns the content type for a template name.
+func templateContentType(name string) string {
+	if isHTMLTemplate(name) {
+		return "text/html; charset=utf-8"
+	}
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// Render executes the named template with data and responds to the request
+// with the result. The Content-Type header is set from the template name
+// extension unless specified in headerKeysAndValues. The template is
+// executed to a buffer before responding. If the template fails, then Render
+// logs the error and responds with StatusInternalServerError using the
+// request's error handler.
+func (r *Renderer) Render(req *Request, status int, name string, data interface{}, headerKeysAndValues ...string) {
+	p, err := r.execute(name, r.templateData(req, data))
+	if err != nil {
+		log.Println("twister: render failed:", err)
+		req.Error(StatusInternalServerError, err)
+		return
+	}
+	header := NewHeader(headerKeysAndValues...)
+	if header.Get(HeaderContentType) == "" {
+		header.Set(HeaderContentType, templateContentType(name))
+	}
+	req.Responder.Respond(status, header).Write(p)
+}
+
+// ErrorHandler returns an error handler that renders
+// RendererOptions.ErrorTemplate with an ErrorData value. If the error
+// template is not set or fails, then the error is passed to h. If h is nil,
+// then the default error handler is used.
+func (r *Renderer) ErrorHandler(h ErrorHandler) ErrorHandler {
+	if h == nil {
+		h = defaultErrorHandler
+	}
+	return func(req *Request, status int, reason os.Error, header Header) {
+		if r.options.ErrorTemplate == "" {
+			h(req, status, reason, header)
+			return
+		}
+		data := &ErrorData{Status: status, StatusText: StatusText(status)}
+		if reason != nil && status < 500 {
+			data.Reason = reason.String()
+		}
+		p, err := r.execute(r.options.ErrorTemplate, r.templateData(req, data))
+		if err != nil {
+			log.Println("twister: render error page failed:", err)
+			h(req, status, reason, header)
+			return
+		}
+		if reason != nil || status >= 500 {
+			log.Println("ERROR", req.URL, status, reason)
+		}
+		header.Set(HeaderContentType, templateContentType(r.options.ErrorTemplate))
+		req.Responder.Respond(status, header).Write(p)
+	}
+}
+
+// formatterString returns the string representation of formatter values.
+func formatterString(values []interface{}) string {
+	if len(values) == 1 {
+		switch v := values[0].(type) {
+		case []byte:
+			return string(v)
+		case string:
+			return v
+		}
+	}
+	return fmt.Sprint(values...)
+}
+
+func htmlFormatter(w io.Writer, format string, values ...interface{}) {
+	io.WriteString(w, HTMLEscapeString(formatterString(values)))
+}
+
+func urlFormatter(w io.Writer, format string, values ...interface{}) {
+	io.WriteString(w, http.URLEscape(formatterString(values)))
+}
+
+// safeURL returns s if s is a relative URL or an absolute URL with an http,
+// https or mailto scheme. Otherwise, safeURL returns "#".
+func safeURL(s string) string {
+	i := strings.IndexAny(s, ":/?#")
+	if i < 0 || s[i] != ':' {
+		return s
+	}
+	switch strings.ToLower(s[:i]) {
+	case "http", "https", "mailto":
+		return s
+	}
+	return "#"
+}
+
+func hrefFormatter(w io.Writer, format string, values ...interface{}) {
+	io.WriteString(w, HTMLEscapeString(safeURL(strings.TrimSpace(formatterString(values)))))
+}
+
+// urlBuilderFormatter returns a formatter that replaces the parameters in the
+// router style pattern with the path escaped formatter values. The URL is
+// HTML escaped.
+func urlBuilderFormatter(pattern string) func(io.Writer, string, ...interface{}) {
+	return func(w io.Writer, format string, values ...interface{}) {
+		i := 0
+		s := parameterRegexp.ReplaceAllStringFunc(pattern, func(string) string {
+			if i >= len(values) {
+				log.Println("twister: missing parameter for URL", pattern)
+				return ""
+			}
+			v := strings.Replace(http.URLEscape(fmt.Sprint(values[i])), "+", "%20", -1)
+			i++
+			return v
+		})
+		io.WriteString(w, HTMLEscapeString(s))
+	}
+}
+
+func rawFormatter(w io.Writer, format string, values ...interface{}) {
+	io.WriteString(w, formatterString(values))
+}
+
+// jsFormatter encodes the value as JSON with the characters <, > and &
+// escaped so that the result can be included in a script element.
+func jsFormatter(w io.Writer, format string, values ...interface{}) {
+	var v interface{} = values
+	if len(values) == 1 {
+		v = values[0]
+	}
+	p, err := json.Marshal(v)
+	if err != nil {
+		log.Println("twister: js formatter failed:", err)
+		io.WriteString(w, "null")
+		return
+	}
+	var buf bytes.Buffer
+	for _, b := range p {
+		switch b {
+		case '<':
+			buf.WriteString(`\u003c`)
+		case '>':
+			buf.WriteString(`\u003e`)
+		case '&':
+			buf.WriteString(`\u0026`)
+		default:
+			buf.WriteByte(b)
+		}
+	}
+	w.Write(buf.Bytes())
+}
+
+// partialFormatter returns a formatter that executes the named template.
+func partialFormatter(set *templateSet, name string) func(io.Writer, string, ...interface{}) {
+	return func(w io.Writer, format string, values ...interface{}) {
+		var v interface{}
+		if len(values) > 0 {
+			v = values[0]
+		}
+		if err := set.templates[name].Execute(w, v); err != nil {
+			log.Println("twister: partial", name, "failed:", err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+var renderFiles = map[string]string{
+	"layout.html":        `<html><body>{Content|raw}</body></html>`,
+	"home.html":          `<h1>{Data.Title}</h1><ul>{.repeated section Data.Items}{@|item}{.end}</ul><a href="{URL.login}?next={Data.Next|url}">login</a><script>var t = {Data.Title|js};</script>{XSRFField|raw}<a href="{Data.Link|href}">x</a><a href="{Data.Title Data.Next|url_post}">p</a>`,
+	"broken.html":        `{Data.Missing}`,
+	"error.html":         `<p>{Data.Status} {Data.StatusText}</p>`,
+	"partials/item.html": `<li>{Name}</li>`,
+	"partials/entry.xml": `<entry>{Name}</entry>`,
+	"feed.txt":           `{Data.Title|raw} {Data.Title Data.Next|url_post}`,
+	"note.txt":           `{Data.Title}`,
+	"image.svg":          `<svg><text>{Data.Title}</text></svg>`,
+	"feed.xml":           `<feed><title>{Data.Title}</title>{.repeated section Data.Items}{@|entry}{.end}</feed>`,
+}
+
+type renderItem struct {
+	Name string
+}
+
+type renderPage struct {
+	Title string
+	Next  string
+	Link  string
+	Items []renderItem
+}
+
+func writeRenderFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fname := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(fname), 0700); err != nil {
+			t.Fatal("MkdirAll", err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(content), 0600); err != nil {
+			t.Fatal("WriteFile", err)
+		}
+	}
+}
+
+func TestRenderer(t *testing.T) {
+	dir := path.Join(os.TempDir(), "twister-render-test-"+newSessionID())
+	writeRenderFiles(t, dir, renderFiles)
+	defer os.RemoveAll(dir)
+
+	r, err := NewRenderer(&RendererOptions{
+		Dir:           dir,
+		Layout:        "layout.html",
+		ErrorTemplate: "error.html",
+		URLs:          map[string]string{"login": "/login", "post": "/users/<id>/posts/<post:[0-9]+>"},
+	})
+	if err != nil {
+		t.Fatal("NewRenderer", err)
+	}
+	page := &renderPage{Title: "A & B", Next: "/a b", Link: " javascript:alert(1)", Items: []renderItem{{"<x>"}, {"y"}}}
+
+	h := SetErrorHandler(r.ErrorHandler(nil), XSRFHandler(&XSRFOptions{Secret: "secret"},
+		HandlerFunc(func(req *Request) {
+			r.Render(req, StatusOK, req.Param.Get("t"), page)
+		})))
+
+	status, header, body := RunHandler("/?t=home.html", "GET", nil, nil, h)
+	if status != StatusOK {
+		t.Fatalf("status = %d, want %d", status, StatusOK)
+	}
+	if ct := header.Get(HeaderContentType); ct != "text/html; charset=utf-8" {
+		t.Errorf("content type = %q", ct)
+	}
+	s := string(body)
+	for _, want := range []string{
+		"<html><body><h1>A &amp; B</h1>",
+		"<li>&lt;x&gt;</li><li>y</li>",
+		"login?next=",
+		"+b\">login</a>",
+		`var t = "A \u0026 B";`,
+		`<input type="hidden" name="xsrf"`,
+		`<a href="#">x</a>`,
+		`<a href="/users/A%20%26%20B/posts/%2Fa%20b">p</a>`,
+		"</body></html>",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("body %q does not contain %q", s, want)
+		}
+	}
+
+	status, header, body = RunHandler("/?t=feed.txt", "GET", nil, nil, h)
+	if status != StatusOK || string(body) != "A & B /users/A%20%26%20B/posts/%2Fa%20b" || !strings.HasPrefix(header.Get(HeaderContentType), "text/plain") {
+		t.Errorf("feed.txt: status = %d, body = %q, content type = %q", status, body, header.Get(HeaderContentType))
+	}
+
+	// Values are HTML escaped by default in all templates.
+	page = &renderPage{Title: "<script>alert(1)</script>", Items: []renderItem{{"<script>x</script>"}}}
+	for _, tt := range []struct{ name, want string }{
+		{"image.svg", "<svg><text>&lt;script&gt;alert(1)&lt;/script&gt;</text></svg>"},
+		{"feed.xml", "<feed><title>&lt;script&gt;alert(1)&lt;/script&gt;</title><entry>&lt;script&gt;x&lt;/script&gt;</entry></feed>"},
+		{"note.txt", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+	} {
+		status, _, body = RunHandler("/?t="+tt.name, "GET", nil, nil, h)
+		if status != StatusOK || string(body) != tt.want {
+			t.Errorf("%s: status = %d, body = %q, want %q", tt.name, status, body, tt.want)
+		}
+	}
+
+	for _, name := range []string{"broken.html", "missing.html"} {
+		status, _, body = RunHandler("/?t="+name, "GET", nil, nil, h)
+		if status != StatusInternalServerError || !strings.Contains(string(body), "<p>500 Internal Server Error</p>") {
+			t.Errorf("%s: status = %d, body = %q", name, status, body)
+		}
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	for _, tt := range []struct{ in, out string }{
+		{"/a/b?c=d", "/a/b?c=d"},
+		{"b/c:d", "b/c:d"},
+		{"?next=javascript:x", "?next=javascript:x"},
+		{"https://example.com/", "https://example.com/"},
+		{"HTTP://example.com/", "HTTP://example.com/"},
+		{"mailto:a@example.com", "mailto:a@example.com"},
+		{"javascript:alert(1)", "#"},
+		{"JavaScript:alert(1)", "#"},
+		{"java\tscript:alert(1)", "#"},
+		{"data:text/html,x", "#"},
+	} {
+		if out := safeURL(tt.in); out != tt.out {
+			t.Errorf("safeURL(%q) = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestRendererReload(t *testing.T) {
+	dir := path.Join(os.TempDir(), "twister-render-test-"+newSessionID())
+	writeRenderFiles(t, dir, map[string]string{"page.html": "one"})
+	defer os.RemoveAll(dir)
+
+	for _, reload := range []bool{false, true} {
+		r, err := NewRenderer(&RendererOptions{Dir: dir, Reload: reload})
+		if err != nil {
+			t.Fatal("NewRenderer", err)
+		}
+		h := HandlerFunc(func(req *Request) { r.Render(req, StatusOK, "page.html", nil) })
+		writeRenderFiles(t, dir, map[string]string{"page.html": "two"})
+		mtime := time.Nanoseconds() + 10e9
+		if err := os.Chtimes(path.Join(dir, "page.html"), mtime, mtime); err != nil {
+			t.Fatal("Chtimes", err)
+		}
+		want := "one"
+		if reload {
+			want = "two"
+		}
+		if _, _, body := RunHandler("/", "GET", nil, nil, h); string(body) != want {
+			t.Errorf("reload=%v, body = %q, want %q", reload, body, want)
+		}
+		writeRenderFiles(t, dir, map[string]string{"page.html": "one"})
+	}
+}
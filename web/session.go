@@ -0,0 +1,524 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionTooLarge = os.NewError("twister: session too large for cookie")
+	ErrBadSession      = os.NewError("twister: bad session data")
+)
+
+// DefaultSessionMaxAge is the default value of SessionOptions.AbsoluteTimeout
+// in seconds.
+const DefaultSessionMaxAge = 30 * 24 * 60 * 60
+
+// Session is the server-side state for a client. Use GetSession to get the
+// session for a request.
+type Session struct {
+	// Identifier assigned by the store. The identifier is "" for a session
+	// that has not been saved.
+	ID string
+
+	// Session values.
+	Values Values
+
+	// Time in seconds since the epoch that the session was created.
+	Created int64
+
+	// Time in seconds since the epoch of the last request in the session.
+	Accessed int64
+
+	// Time in seconds since the epoch that the session expires. The
+	// expiration time is set by the session handler before the session is
+	// saved.
+	Expires int64
+
+	modified bool
+	rotate   bool
+	destroy  bool
+}
+
+// Get returns the first value for key or "" if there is no value.
+func (s *Session) Get(key string) string { return s.Values.Get(key) }
+
+// Set sets the value for key.
+func (s *Session) Set(key, value string) {
+	s.Values.Set(key, value)
+	s.modified = true
+}
+
+// Delete deletes the values for key.
+func (s *Session) Delete(key string) {
+	s.Values[key] = nil, false
+	s.modified = true
+}
+
+// Rotate assigns a new identifier to the session when the session is saved.
+// Call Rotate when the user logs in or the privileges of the session change
+// to prevent session fixation attacks.
+func (s *Session) Rotate() {
+	s.rotate = true
+	s.modified = true
+}
+
+// Destroy deletes the session from the store and clears the session cookie.
+func (s *Session) Destroy() {
+	s.destroy = true
+}
+
+// GetSession returns the session for the request or nil if the request was
+// not handled by SessionHandler.
+func GetSession(req *Request) *Session {
+	s, _ := req.Env["twister.web.session"].(*Session)
+	return s
+}
+
+// SessionStore is the interface for session storage.
+type SessionStore interface {
+	// Load returns the session for the session cookie value. Load returns nil
+	// and no error if the session does not exist or has expired.
+	Load(cookieValue string) (*Session, os.Error)
+
+	// Save saves the session and returns the session cookie value. If the
+	// session ID is "", then Save assigns a new ID to the session.
+	Save(s *Session) (string, os.Error)
+
+	// Delete deletes the session from the store.
+	Delete(s *Session) os.Error
+}
+
+// newSessionID returns a random session identifier.
+func newSessionID() string {
+	p := make([]byte, 16)
+	if _, err := rand.Reader.Read(p); err != nil {
+		panic("twister: rand read failed")
+	}
+	return hex.EncodeToString(p)
+}
+
+// validSessionID returns true if id has the format returned by newSessionID.
+func validSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if dehex(id[i]) == notHex {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeSession encodes the session times and values as a string.
+func encodeSession(s *Session) string {
+	return strconv.Itob64(s.Created, 16) + "~" +
+		strconv.Itob64(s.Accessed, 16) + "~" +
+		strconv.Itob64(s.Expires, 16) + "~" +
+		s.Values.FormEncodedString()
+}
+
+// decodeSession decodes a session encoded by encodeSession.
+func decodeSession(data string) (*Session, os.Error) {
+	a := strings.Split(data, "~", 4)
+	if len(a) != 4 {
+		return nil, ErrBadSession
+	}
+	var t [3]int64
+	for i := range t {
+		var err os.Error
+		t[i], err = strconv.Btoi64(a[i], 16)
+		if err != nil {
+			return nil, ErrBadSession
+		}
+	}
+	s := &Session{Values: make(Values), Created: t[0], Accessed: t[1], Expires: t[2]}
+	if err := s.Values.ParseFormEncodedBytes([]byte(a[3])); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CookieSessionStore stores sessions in the session cookie. The session is
+// signed with SignValue. Because the session is stored by the client,
+// Delete and Rotate do not invalidate copies of the cookie held by an
+// attacker before the session expires.
+type CookieSessionStore struct {
+	secret string
+}
+
+// NewCookieSessionStore returns a store that signs sessions with secret.
+func NewCookieSessionStore(secret string) *CookieSessionStore {
+	return &CookieSessionStore{secret: secret}
+}
+
+// maxCookieSessionLen is the maximum length of a session cookie value. Most
+// browsers limit cookies to 4096 bytes including the name and attributes.
+const maxCookieSessionLen = 3800
+
+// Load implements the SessionStore interface.
+func (cs *CookieSessionStore) Load(cookieValue string) (*Session, os.Error) {
+	data, err := VerifyValue(cs.secret, "session", cookieValue)
+	if err != nil {
+		return nil, nil
+	}
+	return decodeSession(data)
+}
+
+// Save implements the SessionStore interface.
+func (cs *CookieSessionStore) Save(s *Session) (string, os.Error) {
+	value := SignValue(cs.secret, "session", int(s.Expires-time.Seconds()), encodeSession(s))
+	if len(value) > maxCookieSessionLen {
+		return "", ErrSessionTooLarge
+	}
+	return value, nil
+}
+
+// Delete implements the SessionStore interface.
+func (cs *CookieSessionStore) Delete(s *Session) os.Error {
+	return nil
+}
+
+// MemorySessionStore is an in-memory SessionStore. Expired sessions are
+// removed periodically.
+type MemorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]string
+	expires   map[string]int64
+	lastSweep int64
+}
+
+// NewMemorySessionStore returns a new in-memory store.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]string),
+		expires:  make(map[string]int64),
+	}
+}
+
+// sweep removes expired sessions from the store.
+func (ms *MemorySessionStore) sweep(now int64) {
+	ms.lastSweep = now
+	for id, expires := range ms.expires {
+		if expires < now {
+			ms.sessions[id] = "", false
+			ms.expires[id] = 0, false
+		}
+	}
+}
+
+// Load implements the SessionStore interface.
+func (ms *MemorySessionStore) Load(cookieValue string) (*Session, os.Error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	data, found := ms.sessions[cookieValue]
+	if !found || ms.expires[cookieValue] < time.Seconds() {
+		return nil, nil
+	}
+	s, err := decodeSession(data)
+	if err != nil {
+		return nil, err
+	}
+	s.ID = cookieValue
+	return s, nil
+}
+
+// Save implements the SessionStore interface.
+func (ms *MemorySessionStore) Save(s *Session) (string, os.Error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Seconds()
+	if now-ms.lastSweep > sweepInterval/1e9 {
+		ms.sweep(now)
+	}
+	if s.ID == "" {
+		for {
+			s.ID = newSessionID()
+			if _, found := ms.sessions[s.ID]; !found {
+				break
+			}
+		}
+	}
+	ms.sessions[s.ID] = encodeSession(s)
+	ms.expires[s.ID] = s.Expires
+	return s.ID, nil
+}
+
+// Delete implements the SessionStore interface.
+func (ms *MemorySessionStore) Delete(s *Session) os.Error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sessions[s.ID] = "", false
+	ms.expires[s.ID] = 0, false
+	return nil
+}
+
+// FileSessionStore stores each session in a file in a directory. Expired
+// session files are removed when loaded. The application is responsible for
+// removing session files that are not loaded after they expire.
+type FileSessionStore struct {
+	dir string
+}
+
+// NewFileSessionStore returns a store that saves sessions in dir.
+func NewFileSessionStore(dir string) *FileSessionStore {
+	return &FileSessionStore{dir: dir}
+}
+
+func (fs *FileSessionStore) fname(id string) string {
+	return path.Join(fs.dir, "session-"+id)
+}
+
+// Load implements the SessionStore interface.
+func (fs *FileSessionStore) Load(cookieValue string) (*Session, os.Error) {
+	if !validSessionID(cookieValue) {
+		return nil, nil
+	}
+	fname := fs.fname(cookieValue)
+	p, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if e, ok := err.(*os.PathError); ok && e.Error == os.ENOENT {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s, err := decodeSession(string(p))
+	if err != nil {
+		return nil, err
+	}
+	if s.Expires < time.Seconds() {
+		os.Remove(fname)
+		return nil, nil
+	}
+	s.ID = cookieValue
+	return s, nil
+}
+
+// Save implements the SessionStore interface. The session is written to a
+// temporary file and renamed so that concurrent loads do not see a partial
+// session.
+func (fs *FileSessionStore) Save(s *Session) (string, os.Error) {
+	if s.ID == "" {
+		s.ID = newSessionID()
+	}
+	fname := fs.fname(s.ID)
+	tmp := fname + "." + newSessionID()
+	if err := ioutil.WriteFile(tmp, []byte(encodeSession(s)), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return s.ID, nil
+}
+
+// Delete implements the SessionStore interface.
+func (fs *FileSessionStore) Delete(s *Session) os.Error {
+	if !validSessionID(s.ID) {
+		return nil
+	}
+	err := os.Remove(fs.fname(s.ID))
+	if e, ok := err.(*os.PathError); ok && e.Error == os.ENOENT {
+		err = nil
+	}
+	return err
+}
+
+// SessionOptions specifies options for SessionHandler.
+type SessionOptions struct {
+	// Name of the session cookie. If "", then "session" is used.
+	CookieName string
+
+	// Path and domain attributes of the session cookie. If the path is "",
+	// then "/" is used.
+	Path   string
+	Domain string
+
+	// Set the secure attribute on the session cookie.
+	Secure bool
+
+	// SameSite attribute of the session cookie. If "", then SameSiteLax is
+	// used.
+	SameSite string
+
+	// Time in seconds after the last request that the session expires. Zero
+	// means no idle timeout. If the idle timeout is set, then the session is
+	// saved on every request to record the access time.
+	IdleTimeout int
+
+	// Time in seconds after the session is created that the session
+	// expires. If zero, then DefaultSessionMaxAge is used.
+	AbsoluteTimeout int
+}
+
+// SessionHandler returns a handler that loads the session for the request
+// from store and saves the session when the response is sent. Use
+// GetSession to get the session in the application's handlers:
+//
+//  func loginHandler(req *web.Request) {
+//      uid := ... check credentials
+//      s := web.GetSession(req)
+//      s.Set("uid", uid)
+//      s.Rotate()
+//      req.Redirect("/", false)
+//  }
+//
+//  func logoutHandler(req *web.Request) {
+//      web.GetSession(req).Destroy()
+//      req.Redirect("/", false)
+//  }
+//
+//  h := web.SessionHandler(web.NewMemorySessionStore(),
+//      &web.SessionOptions{IdleTimeout: 30 * 60}, router)
+//
+// The session is saved when the handler calls Respond. Changes made to the
+// session after Respond is called are not saved. New sessions are not saved
+// until a value is set.
+func SessionHandler(store SessionStore, options *SessionOptions, h Handler) Handler {
+	sh := &sessionHandler{store: store, h: h}
+	if options != nil {
+		sh.options = *options
+	}
+	if sh.options.CookieName == "" {
+		sh.options.CookieName = "session"
+	}
+	if sh.options.Path == "" {
+		sh.options.Path = "/"
+	}
+	if sh.options.SameSite == "" {
+		sh.options.SameSite = SameSiteLax
+	}
+	if sh.options.AbsoluteTimeout == 0 {
+		sh.options.AbsoluteTimeout = DefaultSessionMaxAge
+	}
+	return sh
+}
+
+type sessionHandler struct {
+	store   SessionStore
+	options SessionOptions
+	h       Handler
+}
+
+// expires returns the expiration time for the session.
+func (sh *sessionHandler) expires(s *Session) int64 {
+	expires := s.Created + int64(sh.options.AbsoluteTimeout)
+	if sh.options.IdleTimeout > 0 {
+		if idle := s.Accessed + int64(sh.options.IdleTimeout); idle < expires {
+			expires = idle
+		}
+	}
+	return expires
+}
+
+func (sh *sessionHandler) cookie(value string, maxAge int) string {
+	return NewCookie(sh.options.CookieName, value).
+		Path(sh.options.Path).
+		Domain(sh.options.Domain).
+		Secure(sh.options.Secure).
+		SameSite(sh.options.SameSite).
+		MaxAge(maxAge).
+		String()
+}
+
+// save saves the session and returns the Set-Cookie header value or "" if
+// the cookie does not need to be set.
+func (sh *sessionHandler) save(s *Session, persisted, cookieSent bool, now int64) string {
+	if s.destroy {
+		if persisted {
+			if err := sh.store.Delete(s); err != nil {
+				log.Println("twister: session delete failed:", err)
+			}
+		}
+		if cookieSent {
+			return NewCookie(sh.options.CookieName, "").Path(sh.options.Path).Domain(sh.options.Domain).Delete().String()
+		}
+		return ""
+	}
+
+	switch {
+	case s.modified:
+		if !persisted && len(s.Values) == 0 {
+			return ""
+		}
+	case persisted && sh.options.IdleTimeout > 0:
+		// Save to record the access time.
+	default:
+		return ""
+	}
+
+	if s.rotate && persisted {
+		if err := sh.store.Delete(s); err != nil {
+			log.Println("twister: session delete failed:", err)
+		}
+		s.ID = ""
+	}
+
+	s.Expires = sh.expires(s)
+	value, err := sh.store.Save(s)
+	if err != nil {
+		log.Println("twister: session save failed:", err)
+		return ""
+	}
+	return sh.cookie(value, int(s.Expires-now))
+}
+
+func (sh *sessionHandler) ServeWeb(req *Request) {
+	now := time.Seconds()
+	cookieValue := req.Cookie.Get(sh.options.CookieName)
+
+	var s *Session
+	if cookieValue != "" {
+		var err os.Error
+		s, err = sh.store.Load(cookieValue)
+		if err != nil {
+			log.Println("twister: session load failed:", err)
+			s = nil
+		}
+		if s != nil && now >= sh.expires(s) {
+			if err := sh.store.Delete(s); err != nil {
+				log.Println("twister: session delete failed:", err)
+			}
+			s = nil
+		}
+	}
+
+	persisted := s != nil
+	if s == nil {
+		s = &Session{Values: make(Values), Created: now}
+	}
+	s.Accessed = now
+	req.Env["twister.web.session"] = s
+
+	FilterRespond(req, func(status int, header Header) (int, Header) {
+		if c := sh.save(s, persisted, cookieValue != "", now); c != "" {
+			header.Add(HeaderSetCookie, c)
+		}
+		return status, header
+	})
+	sh.h.ServeWeb(req)
+}
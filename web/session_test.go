@@ -0,0 +1,138 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionTestHandler modifies the session as specified by the "op" request
+// parameter and writes the "uid" session value to the response body.
+func sessionTestHandler(req *Request) {
+	s := GetSession(req)
+	switch req.Param.Get("op") {
+	case "login":
+		s.Set("uid", req.Param.Get("uid"))
+		s.Rotate()
+	case "logout":
+		s.Destroy()
+	}
+	io.WriteString(req.Respond(StatusOK), s.Get("uid"))
+}
+
+// sessionCookie returns the value of the session cookie in the Set-Cookie
+// header or "" if the cookie is not set.
+func sessionCookie(header Header) string {
+	c := header.Get(HeaderSetCookie)
+	if !strings.HasPrefix(c, "session=") {
+		return ""
+	}
+	c = c[len("session="):]
+	if i := strings.IndexRune(c, ';'); i >= 0 {
+		c = c[:i]
+	}
+	return c
+}
+
+func runSessionRequest(h Handler, url, cookie string) (string, string) {
+	var header Header
+	if cookie != "" {
+		header = NewHeader(HeaderCookie, "session="+cookie)
+	}
+	_, header, body := RunHandler(url, "GET", header, nil, h)
+	return sessionCookie(header), string(body)
+}
+
+func testSessionStore(t *testing.T, name string, store SessionStore) {
+	h := SessionHandler(store, nil, HandlerFunc(sessionTestHandler))
+
+	if c, _ := runSessionRequest(h, "/", ""); c != "" {
+		t.Errorf("%s: empty session saved", name)
+	}
+
+	c1, _ := runSessionRequest(h, "/?op=login&uid=alice", "")
+	if c1 == "" {
+		t.Fatalf("%s: session not saved", name)
+	}
+
+	c, body := runSessionRequest(h, "/", c1)
+	if body != "alice" {
+		t.Errorf("%s: uid = %q, want alice", name, body)
+	}
+	if c != "" {
+		t.Errorf("%s: unmodified session saved", name)
+	}
+
+	c2, body := runSessionRequest(h, "/?op=login&uid=bob", c1)
+	if c2 == "" || c2 == c1 {
+		t.Errorf("%s: session not rotated", name)
+	}
+	if body != "bob" {
+		t.Errorf("%s: uid = %q, want bob", name, body)
+	}
+
+	_, header, _ := RunHandler("/?op=logout", "GET", NewHeader(HeaderCookie, "session="+c2), nil, h)
+	if c := header.Get(HeaderSetCookie); !strings.HasPrefix(c, "session=;") {
+		t.Errorf("%s: logout cookie = %q", name, c)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore()
+	testSessionStore(t, "memory", store)
+	if len(store.sessions) != 0 {
+		t.Errorf("memory: %d sessions after logout, want 0", len(store.sessions))
+	}
+}
+
+func TestCookieSessionStore(t *testing.T) {
+	testSessionStore(t, "cookie", NewCookieSessionStore("secret"))
+}
+
+func TestFileSessionStore(t *testing.T) {
+	dir := path.Join(os.TempDir(), "twister-session-test-"+newSessionID())
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal("Mkdir", err)
+	}
+	defer os.RemoveAll(dir)
+	testSessionStore(t, "file", NewFileSessionStore(dir))
+	if s, _ := NewFileSessionStore(dir).Load("../../etc/passwd"); s != nil {
+		t.Error("file: loaded session with bad id")
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	store := NewMemorySessionStore()
+	h := SessionHandler(store, &SessionOptions{IdleTimeout: 60}, HandlerFunc(sessionTestHandler))
+	c, _ := runSessionRequest(h, "/?op=login&uid=alice", "")
+
+	// Access within the idle timeout extends the session.
+	if c2, body := runSessionRequest(h, "/", c); c2 != c || body != "alice" {
+		t.Errorf("cookie = %q, body = %q, want %q, alice", c2, body, c)
+	}
+
+	// Move the last access time before the idle timeout.
+	s, _ := store.Load(c)
+	s.Accessed = time.Seconds() - 120
+	store.Save(s)
+	if _, body := runSessionRequest(h, "/", c); body != "" {
+		t.Errorf("body = %q, want expired session", body)
+	}
+}
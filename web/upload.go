@@ -0,0 +1,470 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"bytes"
+	"http"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrTooManyParts = os.NewError("twister: too many multipart/form-data parts")
+	ErrFileTooLarge = os.NewError("twister: uploaded file too large")
+)
+
+// Default values for MultipartOptions.
+const (
+	DefaultMaxParts       = 1000
+	DefaultMaxMemory      = 10 << 20
+	DefaultSpoolThreshold = 32 << 10
+)
+
+// MultipartOptions specifies limits for ParseMultipartFiles.
+type MultipartOptions struct {
+	// Maximum length of the request body. If zero, then the length is not
+	// limited.
+	MaxRequestBodyLen int
+
+	// Maximum number of parts. If zero, then DefaultMaxParts is used.
+	MaxParts int
+
+	// Maximum size of each uploaded file. If zero, then the size is not
+	// limited.
+	MaxFileSize int64
+
+	// Maximum total size of form fields and uploaded files held in memory.
+	// If zero, then DefaultMaxMemory is used.
+	MaxMemory int
+
+	// Uploaded files larger than SpoolThreshold are written to temporary
+	// files. If zero, then DefaultSpoolThreshold is used.
+	SpoolThreshold int
+
+	// Directory for temporary files. If "", then os.TempDir() is used.
+	TempDir string
+}
+
+// UploadedFile is a file part of a multipart/form-data request body.
+type UploadedFile struct {
+	// Name of the form field.
+	Name string
+
+	// Filename from the Content-Disposition header. RFC 2231 and RFC 5987
+	// encoded filenames are decoded.
+	Filename string
+
+	// Content type and parameters from the part header.
+	ContentType  string
+	ContentParam map[string]string
+
+	// Content type detected from the first 512 bytes of the file.
+	DetectedContentType string
+
+	// Size of the file in bytes.
+	Size int64
+
+	data  []byte
+	fname string
+}
+
+// File is the interface for reading an uploaded file.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// Open returns a reader for the file. The caller must close the reader.
+func (f *UploadedFile) Open() (File, os.Error) {
+	if f.fname != "" {
+		return os.Open(f.fname)
+	}
+	return &memFile{data: f.data}, nil
+}
+
+// remove removes the temporary file, if any.
+func (f *UploadedFile) remove() {
+	if f.fname != "" {
+		if err := os.Remove(f.fname); err != nil {
+			log.Println("twister: remove uploaded file failed:", err)
+		}
+		f.fname = ""
+	}
+	f.data = nil
+}
+
+// RemoveUploadedFiles removes the temporary files for the uploaded files.
+func RemoveUploadedFiles(files []*UploadedFile) {
+	for _, f := range files {
+		f.remove()
+	}
+}
+
+// memFile implements File for a file held in memory.
+type memFile struct {
+	data []byte
+	off  int64
+}
+
+func (f *memFile) Read(p []byte) (int, os.Error) {
+	if f.off >= int64(len(f.data)) {
+		return 0, os.EOF
+	}
+	n := copy(p, f.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, os.Error) {
+	if off < 0 {
+		return 0, os.EINVAL
+	}
+	if off >= int64(len(f.data)) {
+		return 0, os.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, os.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, os.Error) {
+	switch whence {
+	case 1:
+		offset += f.off
+	case 2:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, os.EINVAL
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() os.Error { return nil }
+
+// dispositionFilename returns the filename from Content-Disposition
+// parameters. The filename* parameter (RFC 5987) and RFC 2231 continuations
+// are preferred over the filename parameter.
+func dispositionFilename(param map[string]string) string {
+	if s, ok := decodeExtValue(param["filename*"]); ok {
+		return s
+	}
+
+	// Collect RFC 2231 continuations filename*0, filename*1*, ...
+	var keys []string
+	for k := range param {
+		if strings.HasPrefix(k, "filename*") && k != "filename*" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) > 0 {
+		sort.Sort(continuationKeys(keys))
+		var raw bytes.Buffer
+		charset := ""
+		for i, k := range keys {
+			n := strings.TrimRight(k[len("filename*"):], "*")
+			if n != strconv.Itoa(i) {
+				raw.Reset()
+				break
+			}
+			v := param[k]
+			if strings.HasSuffix(k, "*") {
+				if i == 0 {
+					a := strings.Split(v, "'", 3)
+					if len(a) != 3 {
+						raw.Reset()
+						break
+					}
+					charset = a[0]
+					v = a[2]
+				}
+				v = string(percentDecode(v))
+			}
+			raw.WriteString(v)
+		}
+		if raw.Len() > 0 {
+			return convertCharset(charset, raw.Bytes())
+		}
+	}
+
+	return param["filename"]
+}
+
+// continuationKeys sorts RFC 2231 parameter names by the section number.
+type continuationKeys []string
+
+func (p continuationKeys) Len() int      { return len(p) }
+func (p continuationKeys) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p continuationKeys) Less(i, j int) bool {
+	return continuationNumber(p[i]) < continuationNumber(p[j])
+}
+
+func continuationNumber(k string) int {
+	n, err := strconv.Atoi(strings.TrimRight(k[strings.IndexRune(k, '*')+1:], "*"))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// decodeExtValue decodes an RFC 5987 ext-value: charset'language'value.
+func decodeExtValue(s string) (string, bool) {
+	a := strings.Split(s, "'", 3)
+	if len(a) != 3 {
+		return "", false
+	}
+	return convertCharset(a[0], percentDecode(a[2])), true
+}
+
+// percentDecode decodes %XX escapes in s. Invalid escapes are copied
+// unchanged.
+func percentDecode(s string) []byte {
+	p := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			a, b := dehex(s[i+1]), dehex(s[i+2])
+			if a != notHex && b != notHex {
+				p = append(p, a<<4|b)
+				i += 2
+				continue
+			}
+		}
+		p = append(p, s[i])
+	}
+	return p
+}
+
+// convertCharset converts p in the charset to a UTF-8 string. UTF-8 and
+// ISO-8859-1 are supported. Bytes in other charsets are returned unchanged.
+func convertCharset(charset string, p []byte) string {
+	if strings.ToLower(charset) == "iso-8859-1" {
+		var buf bytes.Buffer
+		for _, b := range p {
+			buf.WriteRune(int(b))
+		}
+		return buf.String()
+	}
+	return string(p)
+}
+
+// ParseMultipartFiles parses a multipart/form-data body. Form fields are
+// added to the request Param. Uploaded files larger than the spool threshold
+// or that do not fit in the memory limit are written to temporary files.
+// The caller must remove the temporary files with RemoveUploadedFiles. Use
+// MultipartHandler to remove the files automatically.
+//
+// If an error is returned, then the temporary files are removed.
+func ParseMultipartFiles(req *Request, options *MultipartOptions) (files []*UploadedFile, err os.Error) {
+	var o MultipartOptions
+	if options != nil {
+		o = *options
+	}
+	if o.MaxRequestBodyLen == 0 {
+		o.MaxRequestBodyLen = -1
+	}
+	if o.MaxParts == 0 {
+		o.MaxParts = DefaultMaxParts
+	}
+	if o.MaxMemory == 0 {
+		o.MaxMemory = DefaultMaxMemory
+	}
+	if o.SpoolThreshold == 0 {
+		o.SpoolThreshold = DefaultSpoolThreshold
+	}
+
+	m, err := NewMultipartReader(req, o.MaxRequestBodyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			RemoveUploadedFiles(files)
+			files = nil
+		}
+	}()
+
+	memory := o.MaxMemory
+	var buf bytes.Buffer
+	for nparts := 0; ; nparts++ {
+		header, r, err := m.Next()
+		if err == os.EOF {
+			break
+		} else if err != nil {
+			return files, err
+		}
+		if nparts >= o.MaxParts {
+			return files, ErrTooManyParts
+		}
+		disp, dispParam := header.GetValueParam(HeaderContentDisposition)
+		if disp != "form-data" {
+			continue
+		}
+		name := dispParam["name"]
+		if name == "" {
+			continue
+		}
+		filename := dispositionFilename(dispParam)
+		if filename == "" {
+			buf.Reset()
+			n, err := buf.ReadFrom(io.LimitReader(r, int64(memory)+1))
+			if err != nil {
+				return files, err
+			}
+			if n > int64(memory) {
+				return files, ErrRequestEntityTooLarge
+			}
+			memory -= int(n)
+			req.Param.Add(name, buf.String())
+			continue
+		}
+
+		f := &UploadedFile{Name: name, Filename: filename}
+		f.ContentType, f.ContentParam = header.GetValueParam(HeaderContentType)
+		files = append(files, f)
+		if err := f.read(r, &o, &memory); err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// read reads the part body into memory or a temporary file.
+func (f *UploadedFile) read(r io.Reader, o *MultipartOptions, memory *int) os.Error {
+	if o.MaxFileSize > 0 {
+		r = io.LimitReader(r, o.MaxFileSize+1)
+	}
+
+	limit := o.SpoolThreshold
+	if limit > *memory {
+		limit = *memory
+	}
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return err
+	}
+
+	if n <= int64(limit) {
+		f.data = buf.Bytes()
+		f.Size = n
+		*memory -= int(n)
+	} else {
+		tmp, err := ioutil.TempFile(o.TempDir, "twister-upload-")
+		if err != nil {
+			return err
+		}
+		f.fname = tmp.Name()
+		n1, err := buf.WriteTo(tmp)
+		if err == nil {
+			var n2 int64
+			n2, err = io.Copy(tmp, r)
+			n1 += n2
+		}
+		if e := tmp.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+		f.Size = n1
+	}
+
+	if o.MaxFileSize > 0 && f.Size > o.MaxFileSize {
+		return ErrFileTooLarge
+	}
+	return f.detectContentType()
+}
+
+func (f *UploadedFile) detectContentType() os.Error {
+	rf, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	p := make([]byte, 512)
+	n, err := rf.ReadAt(p, 0)
+	if err != nil && err != os.EOF {
+		return err
+	}
+	f.DetectedContentType = http.DetectContentType(p[:n])
+	return nil
+}
+
+// MultipartHandler returns a handler that parses multipart/form-data
+// request bodies with ParseMultipartFiles. The uploaded files are available
+// to the handler through the RequestFiles function. Temporary files are
+// removed after the handler returns. Requests that are not
+// multipart/form-data are passed to the handler unchanged.
+//
+// If the body exceeds a limit, then the handler responds with status 413.
+// If the body is malformed, then the handler responds with status 400.
+func MultipartHandler(options *MultipartOptions, h Handler) Handler {
+	return &multipartHandler{options: options, h: h}
+}
+
+type multipartHandler struct {
+	options *MultipartOptions
+	h       Handler
+}
+
+func (mh *multipartHandler) ServeWeb(req *Request) {
+	if req.ContentType != "multipart/form-data" {
+		mh.h.ServeWeb(req)
+		return
+	}
+	files, err := ParseMultipartFiles(req, mh.options)
+	if err != nil {
+		status := StatusBadRequest
+		switch err {
+		case ErrRequestEntityTooLarge, ErrFileTooLarge, ErrTooManyParts:
+			status = StatusRequestEntityTooLarge
+		}
+		req.Error(status, err)
+		return
+	}
+	defer RemoveUploadedFiles(files)
+	req.Env["twister.web.files"] = files
+	mh.h.ServeWeb(req)
+}
+
+// RequestFiles returns the files uploaded with the request. The files are
+// set by MultipartHandler.
+func RequestFiles(req *Request) []*UploadedFile {
+	files, _ := req.Env["twister.web.files"].([]*UploadedFile)
+	return files
+}
+
+// RequestFile returns the first file uploaded with the form field name or nil
+// if there is no such file.
+func RequestFile(req *Request, name string) *UploadedFile {
+	for _, f := range RequestFiles(req) {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
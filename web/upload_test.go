@@ -0,0 +1,147 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const uploadBody = "--deadbeef\r\n" +
+	"Content-Disposition: form-data; name=title\r\n" +
+	"\r\n" +
+	"hello" +
+	"\r\n--deadbeef\r\n" +
+	"Content-Disposition: form-data; name=small; filename=\"small.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"small file" +
+	"\r\n--deadbeef\r\n" +
+	"Content-Disposition: form-data; name=large; filename*=UTF-8''na%C3%AFve.html\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"\r\n" +
+	"<html><body>large file contents</body></html>" +
+	"\r\n--deadbeef--\r\n"
+
+var uploadHeader = NewHeader(HeaderContentType, "multipart/form-data; boundary=deadbeef")
+
+func uploadTestHandler(req *Request) {
+	req.Respond(StatusOK)
+}
+
+func TestMultipartHandler(t *testing.T) {
+	var files []*UploadedFile
+	var fname string
+	h := MultipartHandler(&MultipartOptions{SpoolThreshold: 16}, HandlerFunc(func(req *Request) {
+		files = RequestFiles(req)
+		if s := req.Param.Get("title"); s != "hello" {
+			t.Errorf("title = %q, want hello", s)
+		}
+		large := RequestFile(req, "large")
+		if large == nil {
+			t.Fatal("large file missing")
+		}
+		fname = large.fname
+		if fname == "" {
+			t.Error("large file not spooled to disk")
+		}
+		for _, f := range files {
+			rf, err := f.Open()
+			if err != nil {
+				t.Fatal("Open", err)
+			}
+			rf.Seek(2, 0)
+			p, err := ioutil.ReadAll(rf)
+			rf.Close()
+			if err != nil {
+				t.Fatal("ReadAll", err)
+			}
+			if int64(len(p)+2) != f.Size {
+				t.Errorf("%s: read %d bytes, size %d", f.Name, len(p)+2, f.Size)
+			}
+		}
+		req.Respond(StatusOK)
+	}))
+
+	status, _, _ := RunHandler("/", "POST", uploadHeader, []byte(uploadBody), h)
+	if status != StatusOK {
+		t.Fatalf("status = %d, want %d", status, StatusOK)
+	}
+	if len(files) != 2 {
+		t.Fatalf("len(files) = %d, want 2", len(files))
+	}
+	small, large := files[0], files[1]
+	if small.Filename != "small.txt" || small.ContentType != "text/plain" || small.Size != 10 {
+		t.Errorf("small = %+v", small)
+	}
+	if !strings.HasPrefix(small.DetectedContentType, "text/plain") {
+		t.Errorf("small detected type = %q", small.DetectedContentType)
+	}
+	if large.Filename != "naïve.html" {
+		t.Errorf("large filename = %q", large.Filename)
+	}
+	if !strings.HasPrefix(large.DetectedContentType, "text/html") {
+		t.Errorf("large detected type = %q", large.DetectedContentType)
+	}
+	if _, err := os.Stat(fname); err == nil {
+		t.Error("temporary file not removed")
+	}
+}
+
+func TestMultipartLimits(t *testing.T) {
+	tests := []struct {
+		options MultipartOptions
+		status  int
+	}{
+		{MultipartOptions{MaxParts: 2}, StatusRequestEntityTooLarge},
+		{MultipartOptions{MaxFileSize: 20}, StatusRequestEntityTooLarge},
+		{MultipartOptions{MaxFileSize: 20, SpoolThreshold: 4}, StatusRequestEntityTooLarge},
+		{MultipartOptions{MaxMemory: 4}, StatusRequestEntityTooLarge},
+		{MultipartOptions{MaxMemory: 8, SpoolThreshold: 4}, StatusOK},
+		{MultipartOptions{MaxRequestBodyLen: 10}, StatusRequestEntityTooLarge},
+	}
+	for i, tt := range tests {
+		options := tt.options
+		h := MultipartHandler(&options, HandlerFunc(uploadTestHandler))
+		status, _, _ := RunHandler("/", "POST",
+			NewHeader(HeaderContentType, "multipart/form-data; boundary=deadbeef",
+				HeaderContentLength, "1000"),
+			[]byte(uploadBody), h)
+		if status != tt.status {
+			t.Errorf("test %d, status = %d, want %d", i, status, tt.status)
+		}
+	}
+}
+
+var dispositionFilenameTests = []struct {
+	param map[string]string
+	want  string
+}{
+	{map[string]string{"filename": "a.txt"}, "a.txt"},
+	{map[string]string{"filename": "a.txt", "filename*": "UTF-8''%E2%82%AC.txt"}, "€.txt"},
+	{map[string]string{"filename*": "iso-8859-1'en'%E9.txt"}, "é.txt"},
+	{map[string]string{"filename*0*": "UTF-8''%E2%82", "filename*1*": "%AC", "filename*2": ".txt"}, "€.txt"},
+	{map[string]string{"filename*0": "a", "filename*2": "b", "filename": "c"}, "c"},
+}
+
+func TestDispositionFilename(t *testing.T) {
+	for _, tt := range dispositionFilenameTests {
+		if s := dispositionFilename(tt.param); s != tt.want {
+			t.Errorf("dispositionFilename(%v) = %q, want %q", tt.param, s, tt.want)
+		}
+	}
+}
@@ -0,0 +1,526 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"utf8"
+)
+
+// ValidatorFunc checks the value of a field. The param argument is the text
+// following '=' in the rule. ValidatorFunc returns nil if the value is valid
+// or an error with a message suitable for display to the user.
+type ValidatorFunc func(v reflect.Value, param string) os.Error
+
+var validators = map[string]ValidatorFunc{
+	"min":    validateMin,
+	"max":    validateMax,
+	"len":    validateLen,
+	"email":  validateEmail,
+	"oneof":  validateOneOf,
+	"regexp": validateRegexp,
+}
+
+// crossFieldRules compare a field with another field in the same struct.
+var crossFieldRules = map[string]struct {
+	ok      func(c int) bool
+	message string
+}{
+	"eqfield":  {func(c int) bool { return c == 0 }, "must match "},
+	"nefield":  {func(c int) bool { return c != 0 }, "must be different from "},
+	"gtfield":  {func(c int) bool { return c > 0 }, "must be greater than "},
+	"gtefield": {func(c int) bool { return c >= 0 }, "must be greater than or equal to "},
+	"ltfield":  {func(c int) bool { return c < 0 }, "must be less than "},
+	"ltefield": {func(c int) bool { return c <= 0 }, "must be less than or equal to "},
+}
+
+// RegisterValidator registers a validation rule with the given name. Call
+// RegisterValidator from an init function; the registry is not safe for
+// concurrent modification.
+func RegisterValidator(name string, f ValidatorFunc) {
+	if _, ok := validators[name]; ok || name == "required" {
+		panic("twister: validator " + name + " already registered")
+	}
+	if _, ok := crossFieldRules[name]; ok {
+		panic("twister: validator " + name + " already registered")
+	}
+	validators[name] = f
+}
+
+var errRequired = os.NewError("is required")
+
+// Validate checks the fields of the struct pointed to by v against the rules
+// in the field's validate tag. Rules are separated by commas:
+//
+//  type Signup struct {
+//      Name     string `param:"name" validate:"required,max=40"`
+//      Email    string `param:"email" validate:"required,email"`
+//      Age      int    `param:"age" validate:"min=13"`
+//      Plan     string `param:"plan" validate:"oneof=free pro"`
+//      Password string `param:"password" validate:"required,min=8"`
+//      Confirm  string `param:"confirm" validate:"eqfield=Password"`
+//      Code     string `param:"code" validate:"regexp=^[A-Z]+-[0-9]+$"`
+//  }
+//
+// The rules are:
+//
+//  required    the value must not be empty, zero, false or nil.
+//  min=n       numbers must be >= n; strings, slices and maps must have at
+//              least n characters or items.
+//  max=n       like min, but the upper bound.
+//  len=n       strings, slices and maps must have exactly n characters or
+//              items.
+//  email       the string must look like an email address.
+//  oneof=a b   the value must be one of the space separated values.
+//  regexp=re   the string must match the regular expression. Because the
+//              expression can contain commas, regexp must be the last rule.
+//  eqfield=F   the value must equal the value of field F in the same struct.
+//              Also nefield, gtfield, gtefield, ltfield and ltefield.
+//
+// Rules other than required and the field comparison rules are not checked
+// for empty strings, slices and maps. The field comparison rules are checked
+// for empty values so that an empty Confirm does not match a non-empty
+// Password. Only required is checked for nil pointers. Use RegisterValidator
+// to add rules.
+//
+// Nested structs and slices of structs are validated. Errors are returned as
+// FieldErrors with the field names used by Bind, for example "owner.name" or
+// "items[0].count". At most one error is reported for each field.
+func Validate(v interface{}) os.Error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		panic("twister: Validate argument must be a struct or pointer to a struct")
+	}
+	var vd validator
+	vd.validateStruct(rv, "")
+	if len(vd.errs) > 0 {
+		return vd.errs
+	}
+	return nil
+}
+
+// BindValid binds the request to dst using Bind and validates dst using
+// Validate. Fields with bind errors are not validated. BindValid returns the
+// combined FieldErrors.
+func BindValid(req *Request, dst interface{}) os.Error {
+	err := Bind(req, dst)
+	bindErrs, ok := err.(FieldErrors)
+	if err != nil && !ok {
+		return err
+	}
+	err = Validate(dst)
+	if err == nil {
+		if len(bindErrs) > 0 {
+			return bindErrs
+		}
+		return nil
+	}
+	errs := bindErrs
+	for _, fe := range err.(FieldErrors) {
+		if bindErrs.Get(fe.Field) == "" {
+			errs = append(errs, fe)
+		}
+	}
+	return errs
+}
+
+// Get returns the message for the first error for the named field or "" if
+// there is no error for the field.
+func (e FieldErrors) Get(name string) string {
+	for _, fe := range e {
+		if fe.Field == name {
+			return fe.Err.String()
+		}
+	}
+	return ""
+}
+
+// Map returns a map from field name to the message for the first error for
+// the field. The map is convenient for rendering errors next to form inputs.
+func (e FieldErrors) Map() map[string]string {
+	m := make(map[string]string)
+	for _, fe := range e {
+		if _, ok := m[fe.Field]; !ok {
+			m[fe.Field] = fe.Err.String()
+		}
+	}
+	return m
+}
+
+// FieldErrorHandler returns an error handler that responds with an RFC 7807
+// application/problem+json body when the reason is FieldErrors. The field
+// messages are included in the "fields" member:
+//
+//  {"type": "about:blank", "title": "Unprocessable Entity", "status": 422,
+//   "instance": "/signup", "fields": {"email": "is required"}}
+//
+// Clients that send no Accept header or accept */* get JSON. Other errors
+// and requests with an Accept header that excludes JSON, such as HTML form
+// posts from browsers, are passed to h. If h is nil, then the default error
+// handler is used. Install the handler with SetErrorHandler and report
+// validation errors with:
+//
+//  if err := web.BindValid(req, &form); err != nil {
+//      req.Error(web.StatusUnprocessableEntity, err)
+//      return
+//  }
+//
+// Use ProblemErrorHandler instead to respond to all errors with
+// application/problem+json. Both handlers render FieldErrors the same way.
+func FieldErrorHandler(h ErrorHandler) ErrorHandler {
+	if h == nil {
+		h = defaultErrorHandler
+	}
+	return func(req *Request, status int, reason os.Error, header Header) {
+		if _, ok := reason.(FieldErrors); ok && acceptsJSON(req, true) {
+			respondProblem(req, status, reason, header, h)
+			return
+		}
+		h(req, status, reason, header)
+	}
+}
+
+type validator struct {
+	errs FieldErrors
+}
+
+func (vd *validator) validateStruct(v reflect.Value, prefix string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		source, name := fieldSource(f, prefix)
+		if source == "" {
+			continue
+		}
+		vd.validateField(v, v.Field(i), name, f.Tag.Get("validate"))
+	}
+}
+
+// validateField checks the rules in tag against field v of struct parent
+// and then validates nested structs.
+func (vd *validator) validateField(parent, v reflect.Value, name, tag string) {
+	if tag != "" {
+		if err := checkRules(parent, v, tag); err != nil {
+			vd.errs = append(vd.errs, &FieldError{Field: name, Err: err})
+			return
+		}
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch {
+	case isScalar(v.Type()):
+	case v.Kind() == reflect.Struct:
+		vd.validateStruct(v, name)
+	case v.Kind() == reflect.Slice && !isScalar(v.Type().Elem()):
+		for i := 0; i < v.Len(); i++ {
+			vd.validateField(v, v.Index(i), name+"["+strconv.Itoa(i)+"]", "")
+		}
+	}
+}
+
+type validationRule struct {
+	name, param string
+}
+
+// parseRules splits a validate tag into rules. The regexp rule consumes the
+// remainder of the tag.
+func parseRules(tag string) []validationRule {
+	var rules []validationRule
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regexp=") {
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+		r := validationRule{name: strings.TrimSpace(rule)}
+		if i := strings.Index(rule, "="); i >= 0 {
+			r.name, r.param = strings.TrimSpace(rule[:i]), rule[i+1:]
+		}
+		if r.name != "" {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// checkRules returns the first rule violation for field v of struct parent.
+func checkRules(parent, v reflect.Value, tag string) os.Error {
+	rules := parseRules(tag)
+	for _, r := range rules {
+		if r.name == "required" && isZeroValue(v) {
+			return errRequired
+		}
+	}
+	empty := isEmptyValue(v)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	for _, r := range rules {
+		var err os.Error
+		if r.name == "required" {
+			continue
+		} else if cr, ok := crossFieldRules[r.name]; ok {
+			err = checkCrossField(parent, v, r.param, cr.ok, cr.message)
+		} else if f, ok := validators[r.name]; ok {
+			if !empty {
+				err = f(v, r.param)
+			}
+		} else {
+			panic("twister: unknown validation rule " + r.name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEmptyValue returns true for values that are not checked by validators.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// isZeroValue returns true for values that fail the required rule.
+func isZeroValue(v reflect.Value) bool {
+	if isEmptyValue(v) {
+		return true
+	}
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		return t.Year == 0 && t.Month == 0 && t.Day == 0
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+	return false
+}
+
+// ruleNumber parses the parameter for rule name.
+func ruleNumber(name, param string) float64 {
+	n, err := strconv.Atof64(param)
+	if err != nil {
+		panic("twister: bad parameter for validation rule " + name + ": " + param)
+	}
+	return n
+}
+
+// valueSize returns the number for numeric values or the length and units
+// for strings, slices and maps.
+func valueSize(name string, v reflect.Value) (n float64, units string) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), ""
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), ""
+	}
+	panic("twister: validation rule " + name + " not supported for " + v.Type().String())
+}
+
+func validateMin(v reflect.Value, param string) os.Error {
+	n, units := valueSize("min", v)
+	if n < ruleNumber("min", param) {
+		if units != "" {
+			return os.NewError("must have at least " + param + units)
+		}
+		return os.NewError("must be at least " + param)
+	}
+	return nil
+}
+
+func validateMax(v reflect.Value, param string) os.Error {
+	n, units := valueSize("max", v)
+	if n > ruleNumber("max", param) {
+		if units != "" {
+			return os.NewError("must have at most " + param + units)
+		}
+		return os.NewError("must be at most " + param)
+	}
+	return nil
+}
+
+func validateLen(v reflect.Value, param string) os.Error {
+	n, units := valueSize("len", v)
+	if n != ruleNumber("len", param) {
+		return os.NewError("must have exactly " + param + units)
+	}
+	return nil
+}
+
+// emailRegexp matches addresses of the form local@domain.tld. The check is
+// deliberately loose; the only reliable test is to send a message.
+var emailRegexp = regexp.MustCompile("^[^@ \t\r\n]+@[^@ \t\r\n]+\\.[^@ \t\r\n]+$")
+
+func validateEmail(v reflect.Value, param string) os.Error {
+	if v.Kind() != reflect.String {
+		panic("twister: validation rule email not supported for " + v.Type().String())
+	}
+	if !emailRegexp.MatchString(v.String()) {
+		return os.NewError("must be a valid email address")
+	}
+	return nil
+}
+
+func validateOneOf(v reflect.Value, param string) os.Error {
+	var s string
+	switch v.Kind() {
+	case reflect.String:
+		s = v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s = strconv.Itoa64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s = strconv.Uitoa64(v.Uint())
+	default:
+		panic("twister: validation rule oneof not supported for " + v.Type().String())
+	}
+	values := strings.Fields(param)
+	for _, value := range values {
+		if s == value {
+			return nil
+		}
+	}
+	return os.NewError("must be one of " + strings.Join(values, ", "))
+}
+
+var (
+	regexpCacheMu sync.Mutex
+	regexpCache   = make(map[string]*regexp.Regexp)
+)
+
+func validateRegexp(v reflect.Value, param string) os.Error {
+	if v.Kind() != reflect.String {
+		panic("twister: validation rule regexp not supported for " + v.Type().String())
+	}
+	regexpCacheMu.Lock()
+	re := regexpCache[param]
+	if re == nil {
+		re = regexp.MustCompile(param)
+		regexpCache[param] = re
+	}
+	regexpCacheMu.Unlock()
+	if !re.MatchString(v.String()) {
+		return os.NewError("has an invalid format")
+	}
+	return nil
+}
+
+// checkCrossField compares v with the field named other in parent.
+func checkCrossField(parent, v reflect.Value, other string, ok func(int) bool, message string) os.Error {
+	if parent.Kind() != reflect.Struct {
+		panic("twister: cross field validation used outside of a struct")
+	}
+	f, found := parent.Type().FieldByName(other)
+	if !found {
+		panic("twister: cross field validation references unknown field " + other)
+	}
+	ov := parent.FieldByIndex(f.Index)
+	if ov.Kind() == reflect.Ptr {
+		if ov.IsNil() {
+			return nil
+		}
+		ov = ov.Elem()
+	}
+	if ok(compareValues(v, ov)) {
+		return nil
+	}
+	_, name := fieldSource(f, "")
+	return os.NewError(message + name)
+}
+
+// compareValues returns -1, 0 or 1 as a is less than, equal to or greater
+// than b.
+func compareValues(a, b reflect.Value) int {
+	if a.Type() != b.Type() {
+		panic("twister: cross field validation of different types " + a.Type().String() + " and " + b.Type().String())
+	}
+	if a.Type() == timeType {
+		ta := a.Interface().(time.Time)
+		tb := b.Interface().(time.Time)
+		return compareFloats(float64(ta.Seconds()), float64(tb.Seconds()))
+	}
+	switch a.Kind() {
+	case reflect.String:
+		sa, sb := a.String(), b.String()
+		switch {
+		case sa < sb:
+			return -1
+		case sa > sb:
+			return 1
+		}
+		return 0
+	case reflect.Bool:
+		if a.Bool() == b.Bool() {
+			return 0
+		}
+		return 1
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareFloats(float64(a.Int()), float64(b.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareFloats(float64(a.Uint()), float64(b.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return compareFloats(a.Float(), b.Float())
+	}
+	panic("twister: cross field validation not supported for " + a.Type().String())
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
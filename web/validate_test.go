@@ -0,0 +1,169 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func init() {
+	RegisterValidator("even", func(v reflect.Value, param string) os.Error {
+		if v.Int()%2 != 0 {
+			return os.NewError("must be even")
+		}
+		return nil
+	})
+}
+
+type validateItem struct {
+	Count int `param:"count" validate:"min=1,max=10"`
+}
+
+type validateTarget struct {
+	Name     string         `param:"name" validate:"required,max=5"`
+	Email    string         `param:"email" validate:"email"`
+	Plan     string         `param:"plan" validate:"oneof=free pro"`
+	Password string         `param:"password" validate:"required,min=4"`
+	Confirm  string         `param:"confirm" validate:"eqfield=Password"`
+	Low      int            `param:"low"`
+	High     int            `param:"high" validate:"gtfield=Low"`
+	Code     string         `param:"code" validate:"len=3,regexp=^[A-Z]+(,[A-Z]+)*$"`
+	Number   int            `param:"number" validate:"even"`
+	Agree    bool           `param:"agree" validate:"required"`
+	Tags     []string       `param:"tag" validate:"max=2"`
+	Items    []validateItem `param:"items"`
+	Owner    *struct {
+		Name string `param:"name" validate:"required"`
+	} `param:"owner"`
+}
+
+var validateTests = []struct {
+	query  string
+	errors map[string]string
+}{
+	{
+		"name=bob&password=abcd&confirm=abcd&low=1&high=2&code=A,B&agree=1",
+		map[string]string{},
+	},
+	{
+		"name=bob&password=abcd&low=1&high=2&code=A,B&agree=1",
+		map[string]string{"confirm": "must match password"},
+	},
+	{
+		"",
+		map[string]string{"name": "is required", "password": "is required", "agree": "is required",
+			"high": "must be greater than low"},
+	},
+	{
+		"name=bobbybob&email=bob&plan=gold&password=abc&confirm=abcd&low=2&high=1&code=ab1&number=3&agree=1" +
+			"&tag=a&tag=b&tag=c&items[0].count=1&items[1].count=11&owner.name=",
+		map[string]string{
+			"name":           "must have at most 5 characters",
+			"email":          "must be a valid email address",
+			"plan":           "must be one of free, pro",
+			"password":       "must have at least 4 characters",
+			"confirm":        "must match password",
+			"high":           "must be greater than low",
+			"code":           "has an invalid format",
+			"number":         "must be even",
+			"tag":            "must have at most 2 items",
+			"items[1].count": "must be at most 10",
+			"owner.name":     "is required",
+		},
+	},
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range validateTests {
+		var dst validateTarget
+		var err os.Error
+		RunHandler("/?"+tt.query, "GET", nil, nil, HandlerFunc(func(req *Request) {
+			err = BindValid(req, &dst)
+			req.Respond(StatusOK)
+		}))
+		errs, _ := err.(FieldErrors)
+		if err != nil && errs == nil {
+			t.Errorf("%q: BindValid returned %v", tt.query, err)
+			continue
+		}
+		if m := errs.Map(); !reflect.DeepEqual(m, tt.errors) {
+			t.Errorf("%q:\n got %v\nwant %v", tt.query, m, tt.errors)
+		}
+	}
+}
+
+func TestBindValidSkipsBindErrors(t *testing.T) {
+	var dst struct {
+		Count int `param:"count" validate:"required"`
+	}
+	var err os.Error
+	RunHandler("/?count=x", "GET", nil, nil, HandlerFunc(func(req *Request) {
+		err = BindValid(req, &dst)
+		req.Respond(StatusOK)
+	}))
+	errs, ok := err.(FieldErrors)
+	if !ok || len(errs) != 1 || errs[0].Value != "x" {
+		t.Errorf("BindValid returned %v, want one bind error", err)
+	}
+}
+
+func TestFieldErrorHandler(t *testing.T) {
+	h := SetErrorHandler(FieldErrorHandler(nil), HandlerFunc(func(req *Request) {
+		var dst validateTarget
+		if err := BindValid(req, &dst); err != nil {
+			req.Error(StatusUnprocessableEntity, err)
+			return
+		}
+		req.Respond(StatusOK)
+	}))
+	url := "/?name=bob&password=abcd&agree=1&low=-1&email=x"
+	status, header, body := RunHandler(url, "GET", NewHeader(HeaderAccept, "application/json"), nil, h)
+	if status != StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", status, StatusUnprocessableEntity)
+	}
+	if ct := header.Get(HeaderContentType); ct != "application/problem+json" {
+		t.Errorf("content type = %q", ct)
+	}
+	var v struct {
+		Title  string
+		Status int
+		Fields map[string]string
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("Unmarshal(%q) returned %v", body, err)
+	}
+	if v.Title != "Unprocessable Entity" || v.Status != StatusUnprocessableEntity || len(v.Fields) != 1 || v.Fields["email"] == "" {
+		t.Errorf("body = %s", body)
+	}
+
+	// Clients that send no Accept header or accept anything get JSON.
+	for _, accept := range []Header{nil, NewHeader(HeaderAccept, "*/*")} {
+		status, header, _ = RunHandler(url, "GET", accept, nil, h)
+		if status != StatusUnprocessableEntity || header.Get(HeaderContentType) != "application/problem+json" {
+			t.Errorf("status = %d, content type = %q; want problem+json", status, header.Get(HeaderContentType))
+		}
+	}
+
+	// Clients that do not accept JSON get the response from the next error
+	// handler.
+	status, header, _ = RunHandler(url, "GET", NewHeader(HeaderAccept, "text/html,*/*;q=0.8"), nil, h)
+	if status != StatusUnprocessableEntity || strings.Contains(header.Get(HeaderContentType), "json") {
+		t.Errorf("browser: status = %d, content type = %q", status, header.Get(HeaderContentType))
+	}
+}
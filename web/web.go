@@ -18,6 +18,7 @@ package web
 
 import (
 	"bufio"
+	"crypto/tls"
 	"http"
 	"io"
 	"io/ioutil"
@@ -66,6 +67,11 @@ type Request struct {
 	// The IP address of the client sending the request to the server.
 	RemoteAddr string
 
+	// TLS connection state or nil if the request was not received over TLS.
+	// The client certificate chains verified by the server are in the
+	// VerifiedChains field of the connection state.
+	TLS *tls.ConnectionState
+
 	// Header maps canonical header names to slices of header values.
 	Header Header
 
@@ -0,0 +1,335 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"http"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	ErrXSRFMissingToken = os.NewError("twister: missing xsrf token")
+	ErrXSRFBadToken     = os.NewError("twister: bad xsrf token")
+	ErrXSRFBadOrigin    = os.NewError("twister: xsrf origin check failed")
+	ErrXSRFNoReferer    = os.NewError("twister: missing referer for secure request")
+)
+
+// xsrfSecretLen is the length in bytes of the per-client secret.
+const xsrfSecretLen = 16
+
+// safeMethods are the methods that do not require an XSRF token.
+var safeMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+}
+
+// XSRFOptions specifies options for XSRFHandler.
+type XSRFOptions struct {
+	// Secret used to compute tokens from the per-client secret. Required.
+	Secret string
+
+	// Name of the cookie that holds the per-client secret. If "", then
+	// "xsrf_secret" is used. The cookie is not used if UseSession is true.
+	CookieName string
+
+	// Secure sets the secure attribute on the cookie.
+	Secure bool
+
+	// Store the per-client secret in the session instead of a cookie. The
+	// handler must be wrapped by SessionHandler.
+	UseSession bool
+
+	// Name of the request parameter that holds the token. If "", then
+	// XSRFParamName is used.
+	ParamName string
+
+	// Name of the request header that holds the token. If "", then the
+	// X-XSRFToken header is used. The header name must be in canonical
+	// format.
+	HeaderName string
+
+	// Origins in addition to the request origin that are allowed to send
+	// unsafe requests. An origin has the format scheme://host[:port].
+	TrustedOrigins []string
+
+	// If not nil and Exempt returns true, then the request is not checked.
+	Exempt func(req *Request) bool
+
+	// Status for rejected requests. If zero, then StatusForbidden is used.
+	ErrorStatus int
+
+	// If not nil, ErrorHandler is called to respond to rejected requests.
+	// Otherwise, the request's Error method is called.
+	ErrorHandler ErrorHandler
+}
+
+// ExemptPaths returns a function for XSRFOptions.Exempt that exempts requests
+// where the path starts with one of the prefixes.
+func ExemptPaths(prefixes ...string) func(req *Request) bool {
+	return func(req *Request) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(req.URL.Path, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// XSRFHandler returns a handler that implements cross-site request forgery
+// protection. Here's how it works:
+//
+// The handler stores a random per-client secret in a cookie or in the
+// session. The token for the client is the HMAC SHA-256 of the per-client
+// secret using options.Secret. Because a third party site cannot read the
+// cookie or compute the HMAC, the third party site cannot generate the
+// token.
+//
+// Requests with methods other than GET, HEAD, OPTIONS and TRACE must include
+// the token in the request parameter or request header. These requests must
+// also pass an origin check: the Origin header, or if the Origin header is
+// not present, the Referer header must match the request URL or one of the
+// trusted origins. HTTPS requests without either header are rejected.
+//
+// Use the functions XSRFToken, XSRFHiddenField and XSRFMetaTag to include
+// the token in pages. The token is masked with a random pad each time it is
+// rendered so that the token is not exposed to compression attacks such as
+// BREACH.
+//
+// The request body must be parsed before the token is checked. Wrap the
+// handler with FormHandler:
+//
+//  h := web.FormHandler(10000, false,
+//      web.XSRFHandler(&web.XSRFOptions{Secret: secret}, router))
+func XSRFHandler(options *XSRFOptions, h Handler) Handler {
+	xh := &xsrfHandler{options: *options, h: h}
+	if xh.options.Secret == "" {
+		panic("twister: XSRFHandler secret not set")
+	}
+	if xh.options.CookieName == "" {
+		xh.options.CookieName = "xsrf_secret"
+	}
+	if xh.options.ParamName == "" {
+		xh.options.ParamName = XSRFParamName
+	}
+	if xh.options.HeaderName == "" {
+		xh.options.HeaderName = HeaderXXSRFToken
+	}
+	if xh.options.ErrorStatus == 0 {
+		xh.options.ErrorStatus = StatusForbidden
+	}
+	return xh
+}
+
+type xsrfHandler struct {
+	options XSRFOptions
+	h       Handler
+}
+
+// xsrfState is stored in the request Env for use by the template helpers.
+type xsrfState struct {
+	token     []byte
+	paramName string
+}
+
+func (xh *xsrfHandler) token(secret string) []byte {
+	hm := hmac.New(sha256.New, []byte(xh.options.Secret))
+	io.WriteString(hm, secret)
+	return hm.Sum()
+}
+
+// clientSecret returns the per-client secret for the request, creating the
+// secret if necessary.
+func (xh *xsrfHandler) clientSecret(req *Request) string {
+	if xh.options.UseSession {
+		s := GetSession(req)
+		if s == nil {
+			panic("twister: XSRFHandler UseSession requires SessionHandler")
+		}
+		secret := s.Get("xsrf")
+		if len(secret) != xsrfSecretLen*2 {
+			secret = newXSRFSecret()
+			s.Set("xsrf", secret)
+		}
+		return secret
+	}
+
+	secret := req.Cookie.Get(xh.options.CookieName)
+	if len(secret) != xsrfSecretLen*2 {
+		secret = newXSRFSecret()
+		c := NewCookie(xh.options.CookieName, secret).
+			Secure(xh.options.Secure).
+			SameSite(SameSiteLax).
+			String()
+		FilterRespond(req, func(status int, header Header) (int, Header) {
+			header.Add(HeaderSetCookie, c)
+			return status, header
+		})
+	}
+	return secret
+}
+
+func newXSRFSecret() string {
+	p := make([]byte, xsrfSecretLen)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		panic("twister: rand read failed")
+	}
+	return hex.EncodeToString(p)
+}
+
+// requestOrigin returns the origin of the request URL.
+func requestOrigin(req *Request) string {
+	return strings.ToLower(req.URL.Scheme + "://" + req.URL.Host)
+}
+
+// checkOrigin verifies the Origin or Referer header of the request.
+func (xh *xsrfHandler) checkOrigin(req *Request) os.Error {
+	origin := req.Header.Get(HeaderOrigin)
+	if origin == "" || origin == "null" {
+		referer := req.Header.Get(HeaderReferer)
+		if referer == "" {
+			if req.URL.Scheme == "https" {
+				return ErrXSRFNoReferer
+			}
+			return nil
+		}
+		u, err := http.ParseURL(referer)
+		if err != nil {
+			return ErrXSRFBadOrigin
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	origin = strings.ToLower(origin)
+	if origin == requestOrigin(req) {
+		return nil
+	}
+	for _, trusted := range xh.options.TrustedOrigins {
+		if origin == strings.ToLower(trusted) {
+			return nil
+		}
+	}
+	return ErrXSRFBadOrigin
+}
+
+func (xh *xsrfHandler) check(req *Request, token []byte) os.Error {
+	if err := xh.checkOrigin(req); err != nil {
+		return err
+	}
+	masked := req.Param.Get(xh.options.ParamName)
+	if masked == "" {
+		masked = req.Header.Get(xh.options.HeaderName)
+	}
+	if masked == "" {
+		return ErrXSRFMissingToken
+	}
+	if subtle.ConstantTimeCompare(unmaskXSRFToken(masked), token) != 1 {
+		return ErrXSRFBadToken
+	}
+	return nil
+}
+
+func (xh *xsrfHandler) ServeWeb(req *Request) {
+	token := xh.token(xh.clientSecret(req))
+	req.Env["twister.web.xsrf"] = &xsrfState{token: token, paramName: xh.options.ParamName}
+
+	if !safeMethods[req.Method] && (xh.options.Exempt == nil || !xh.options.Exempt(req)) {
+		if err := xh.check(req, token); err != nil {
+			if xh.options.ErrorHandler != nil {
+				xh.options.ErrorHandler(req, xh.options.ErrorStatus, err, NewHeader())
+			} else {
+				req.Error(xh.options.ErrorStatus, err)
+			}
+			return
+		}
+	}
+	xh.h.ServeWeb(req)
+}
+
+// maskXSRFToken returns the token XORed with a random pad. The pad is
+// prepended to the result.
+func maskXSRFToken(token []byte) string {
+	p := make([]byte, 2*len(token))
+	pad := p[:len(token)]
+	if _, err := io.ReadFull(rand.Reader, pad); err != nil {
+		panic("twister: rand read failed")
+	}
+	for i, b := range token {
+		p[len(token)+i] = pad[i] ^ b
+	}
+	encoded := make([]byte, base64.URLEncoding.EncodedLen(len(p)))
+	base64.URLEncoding.Encode(encoded, p)
+	return string(encoded)
+}
+
+// unmaskXSRFToken returns the token from a string created by maskXSRFToken
+// or nil if the string is not valid.
+func unmaskXSRFToken(masked string) []byte {
+	p := make([]byte, base64.URLEncoding.DecodedLen(len(masked)))
+	n, err := base64.URLEncoding.Decode(p, []byte(masked))
+	if err != nil || n != 2*sha256.Size {
+		return nil
+	}
+	token := make([]byte, sha256.Size)
+	for i := range token {
+		token[i] = p[i] ^ p[sha256.Size+i]
+	}
+	return token
+}
+
+// XSRFToken returns a masked XSRF token for the request. A different string
+// is returned on each call. XSRFToken returns "" if the request was not
+// handled by XSRFHandler.
+func XSRFToken(req *Request) string {
+	state, _ := req.Env["twister.web.xsrf"].(*xsrfState)
+	if state == nil {
+		return ""
+	}
+	return maskXSRFToken(state.token)
+}
+
+// XSRFHiddenField returns an HTML hidden input element containing an XSRF
+// token for the request. Include the field in forms that use an unsafe
+// method:
+//
+//  <form method="post" action="/update">{xsrf}...</form>
+func XSRFHiddenField(req *Request) string {
+	state, _ := req.Env["twister.web.xsrf"].(*xsrfState)
+	if state == nil {
+		return ""
+	}
+	return `<input type="hidden" name="` + HTMLEscapeString(state.paramName) +
+		`" value="` + maskXSRFToken(state.token) + `">`
+}
+
+// XSRFMetaTag returns an HTML meta element containing an XSRF token for the
+// request. Script on the page can read the token and send it in the
+// X-XSRFToken header.
+func XSRFMetaTag(req *Request) string {
+	token := XSRFToken(req)
+	if token == "" {
+		return ""
+	}
+	return `<meta name="xsrf-token" content="` + token + `">`
+}
@@ -0,0 +1,116 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package web
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func xsrfTokenHandler(req *Request) {
+	io.WriteString(req.Respond(StatusOK), XSRFToken(req))
+}
+
+func TestXSRFHandler(t *testing.T) {
+	h := FormHandler(1000, false, XSRFHandler(&XSRFOptions{
+		Secret:         "secret",
+		TrustedOrigins: []string{"https://trusted.example.com"},
+		Exempt:         ExemptPaths("/hook/"),
+	}, HandlerFunc(xsrfTokenHandler)))
+
+	// Get a secret and token.
+	status, header, body := RunHandler("http://example.com/", "GET", nil, nil, h)
+	if status != StatusOK {
+		t.Fatalf("GET status = %d, want %d", status, StatusOK)
+	}
+	cookies := ResponseCookies(header)
+	if len(cookies) != 1 || cookies[0].Name != "xsrf_secret" {
+		t.Fatalf("cookies = %v, want xsrf_secret", cookies)
+	}
+	cookie := "xsrf_secret=" + cookies[0].Value
+	token := string(body)
+
+	// The token is masked differently on each request.
+	_, _, body = RunHandler("http://example.com/", "GET", NewHeader(HeaderCookie, cookie), nil, h)
+	if string(body) == token {
+		t.Error("token not masked")
+	}
+	otherToken := string(body)
+
+	tests := []struct {
+		url    string
+		method string
+		header Header
+		body   string
+		status int
+	}{
+		{"http://example.com/", "POST", NewHeader(HeaderCookie, cookie, HeaderContentType, "application/x-www-form-urlencoded"), "xsrf=" + token, StatusOK},
+		{"http://example.com/", "POST", NewHeader(HeaderCookie, cookie, HeaderContentType, "application/x-www-form-urlencoded"), "xsrf=" + otherToken, StatusOK},
+		{"http://example.com/", "PATCH", NewHeader(HeaderCookie, cookie, HeaderXXSRFToken, token), "", StatusOK},
+		{"http://example.com/", "PATCH", NewHeader(HeaderCookie, cookie), "", StatusForbidden},
+		{"http://example.com/", "DELETE", NewHeader(HeaderCookie, cookie, HeaderXXSRFToken, token[1:]), "", StatusForbidden},
+		{"http://example.com/", "POST", NewHeader(HeaderXXSRFToken, token), "", StatusForbidden},
+		{"http://example.com/", "POST", NewHeader(HeaderCookie, cookie, HeaderXXSRFToken, token, HeaderOrigin, "http://evil.example.com"), "", StatusForbidden},
+		{"http://example.com/", "POST", NewHeader(HeaderCookie, cookie, HeaderXXSRFToken, token, HeaderOrigin, "http://example.com"), "", StatusOK},
+		{"http://example.com/", "POST", NewHeader(HeaderCookie, cookie, HeaderXXSRFToken, token, HeaderReferer, "http://evil.example.com/page"), "", StatusForbidden},
+		{"http://example.com/", "POST", NewHeader(HeaderCookie, cookie, HeaderXXSRFToken, token, HeaderReferer, "http://example.com/page"), "", StatusOK},
+		{"https://example.com/", "POST", NewHeader(HeaderCookie, cookie, HeaderXXSRFToken, token), "", StatusForbidden},
+		{"https://example.com/", "POST", NewHeader(HeaderCookie, cookie, HeaderXXSRFToken, token, HeaderOrigin, "https://trusted.example.com"), "", StatusOK},
+		{"http://example.com/hook/x", "POST", nil, "", StatusOK},
+	}
+	for i, tt := range tests {
+		status, _, _ := RunHandler(tt.url, tt.method, tt.header, []byte(tt.body), h)
+		if status != tt.status {
+			t.Errorf("test %d, status = %d, want %d", i, status, tt.status)
+		}
+	}
+}
+
+func TestXSRFHandlerSession(t *testing.T) {
+	store := NewMemorySessionStore()
+	h := SessionHandler(store, nil, XSRFHandler(&XSRFOptions{Secret: "secret", UseSession: true, ErrorStatus: StatusBadRequest},
+		HandlerFunc(xsrfTokenHandler)))
+	_, header, body := RunHandler("http://example.com/", "GET", nil, nil, h)
+	cookies := ResponseCookies(header)
+	if len(cookies) != 1 || cookies[0].Name != "session" {
+		t.Fatalf("cookies = %v, want session", cookies)
+	}
+	cookie := "session=" + cookies[0].Value
+	status, _, _ := RunHandler("http://example.com/", "POST", NewHeader(HeaderCookie, cookie, HeaderXXSRFToken, string(body)), nil, h)
+	if status != StatusOK {
+		t.Errorf("status = %d, want %d", status, StatusOK)
+	}
+	status, _, _ = RunHandler("http://example.com/", "POST", NewHeader(HeaderXXSRFToken, string(body)), nil, h)
+	if status != StatusBadRequest {
+		t.Errorf("status = %d, want %d", status, StatusBadRequest)
+	}
+}
+
+func TestXSRFTemplateHelpers(t *testing.T) {
+	var field, meta string
+	h := XSRFHandler(&XSRFOptions{Secret: "secret"}, HandlerFunc(func(req *Request) {
+		field = XSRFHiddenField(req)
+		meta = XSRFMetaTag(req)
+		req.Respond(StatusOK)
+	}))
+	RunHandler("http://example.com/", "GET", nil, nil, h)
+	if !strings.HasPrefix(field, `<input type="hidden" name="xsrf" value="`) {
+		t.Errorf("hidden field = %q", field)
+	}
+	if !strings.HasPrefix(meta, `<meta name="xsrf-token" content="`) {
+		t.Errorf("meta tag = %q", meta)
+	}
+}
@@ -185,8 +185,11 @@ func Upgrade(req *web.Request, readBufSize, writeBufSize int, header web.Header)
 	hash.Write(key3)
 	response := hash.Sum()
 
-	// TODO: handle tls
-	location := "ws://" + req.URL.Host + req.URL.RawPath
+	scheme := "ws://"
+	if req.TLS != nil || req.URL.Scheme == "https" {
+		scheme = "wss://"
+	}
+	location := scheme + req.URL.Host + req.URL.RawPath
 	protocol := req.Header.Get(web.HeaderSecWebSocketProtocol)
 
 	h := make(web.Header)
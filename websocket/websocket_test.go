@@ -126,3 +126,30 @@ func TestWebSocket(t *testing.T) {
 		}
 	}
 }
+
+func TestWebSocketLocation(t *testing.T) {
+	header := web.NewHeader(
+		"Connection", "Upgrade",
+		"Origin", "https://localhost:8080",
+		"Host", "localhost:8080",
+		"Upgrade", "WebSocket",
+		"Sec-Websocket-Key2", "z 4 d0 3 0a>mU 7N 1@991HP I {2",
+		"Sec-Websocket-Key1", "284<qQA84i92708  /")
+	for _, scheme := range []string{"http", "https"} {
+		_, _, out := web.RunHandler(scheme+"://example.com/chat", "GET", header, []byte("P\u05e4>mX\x18k"), web.HandlerFunc(testHandler))
+		br := bufio.NewReader(bytes.NewBuffer(out))
+		br.ReadSlice('\n')
+		h := make(web.Header)
+		if err := h.ParseHttpHeader(br); err != nil {
+			t.Errorf("%s, header parse error %v", scheme, err)
+			continue
+		}
+		want := "ws://example.com/chat"
+		if scheme == "https" {
+			want = "wss://example.com/chat"
+		}
+		if location := h.Get("Sec-Websocket-Location"); location != want {
+			t.Errorf("%s, location = %q, want %q", scheme, location, want)
+		}
+	}
+}